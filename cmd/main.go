@@ -1,15 +1,25 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/drift"
 	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
 	"github.com/marcaudefroy/grpc-hot-mock/pkg/mocks"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/payload"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/protodir"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/redact"
 	"github.com/marcaudefroy/grpc-hot-mock/pkg/reflection"
 	"github.com/marcaudefroy/grpc-hot-mock/pkg/server/grpc"
 	hotServer "github.com/marcaudefroy/grpc-hot-mock/pkg/server/http"
@@ -17,11 +27,35 @@ import (
 
 var version = "dev"
 
+// stringsFlag is a flag which can be repeated
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
 func main() {
 	showVersion := flag.Bool("version", false, "print version and exit")
 	grpcPort := flag.String("grpc_port", ":50051", "gRPC listen address")
 	httpPort := flag.String("http_port", ":8080", "HTTP config address")
 	proxyAddr := flag.String("proxy", "", "Optional gRPC proxy backend address")
+	historyMaxEntries := flag.Int("history_max_entries", 10000, "Maximum number of calls kept in history (0 = unlimited)")
+	historyMaxBytes := flag.Int64("history_max_bytes", 0, "Approximate maximum size in bytes of the history (0 = unlimited)")
+	historyMaxPayloadBytes := flag.Int("history_max_payload_bytes", 1<<20, "Maximum size in bytes of a message payload kept in history, larger ones are truncated (0 = unlimited)")
+	historyMaxAge := flag.Duration("history_max_age", 0, "Retention of calls in history, e.g. 24h (0 = unlimited)")
+	historyFile := flag.String("history_file", "", "Optional file persisting the history across restarts (default: in memory only)")
+	redactConfig := flag.String("redact_config", "", "Optional JSON file holding the redaction rules applied to history (default: sensitive metadata keys and debug_redact fields)")
+	var protoDirs stringsFlag
+	flag.Var(&protoDirs, "proto_dir", "Directory of .proto files loaded at startup and watched for changes (repeatable)")
+	var protoImportPaths stringsFlag
+	flag.Var(&protoImportPaths, "proto_import_path", "Import root of the -proto_dir files, like protoc -I (repeatable, default: each directory is the root of its files)")
+	proxyReflection := flag.Bool("proxy_reflection", false, "Import the descriptors of the proxy backend through its reflection service at startup")
+	reflectionMerge := flag.Bool("reflection_merge", false, "Merge the reflection service of the proxy backend with the local one")
+	protoDirPoll := flag.Duration("proto_dir_poll", 2*time.Second, "Interval between two checks of the proto directories for changes (0 = load at startup only)")
+	flag.Parse()
 
 	if *showVersion {
 		fmt.Println(version)
@@ -36,22 +70,104 @@ func main() {
 
 	descriptorRegistry := reflection.NewDefaultDescriptorRegistry()
 	mockRegistry := &mocks.DefaultRegistry{}
-	historyRegistry := &history.DefaultRegistry{}
+	historyConfig := history.Config{
+		MaxEntries:      *historyMaxEntries,
+		MaxBytes:        *historyMaxBytes,
+		MaxPayloadBytes: *historyMaxPayloadBytes,
+		MaxAge:          *historyMaxAge,
+	}
+	var historyRegistry history.RegisterReadWriter = history.NewDefaultRegistry(historyConfig)
+	var fileRegistry *history.FileRegistry
+	if *historyFile != "" {
+		var err error
+		fileRegistry, err = history.NewFileRegistry(*historyFile, historyConfig)
+		if err != nil {
+			log.Fatalf("open history file %s: %v", *historyFile, err)
+		}
+		historyRegistry = fileRegistry
+	}
+
+	rules := redact.DefaultRules()
+	if *redactConfig != "" {
+		raw, err := os.ReadFile(*redactConfig)
+		if err != nil {
+			log.Fatalf("read redaction rules %s: %v", *redactConfig, err)
+		}
+		rules = redact.Rules{}
+		if err := json.Unmarshal(raw, &rules); err != nil {
+			log.Fatalf("parse redaction rules %s: %v", *redactConfig, err)
+		}
+	}
+	redactor, err := redact.New(rules)
+	if err != nil {
+		log.Fatalf("invalid redaction rules: %v", err)
+	}
+	driftTracker := &drift.Tracker{}
 
-	httpServer := hotServer.NewServer(descriptorRegistry, mockRegistry, historyRegistry)
+	decoder := payload.NewDecoder(descriptorRegistry, redactor)
+	if len(protoDirs) > 0 {
+		watcher := protodir.New(descriptorRegistry, protoDirs)
+		watcher.ImportPaths = protoImportPaths
+		// Set before the first load, so that the history restored from -history_file is decoded
+		watcher.OnReload = func() {
+			historyRegistry.UpdateHistories(decoder.Redecode)
+		}
+		if err := watcher.Load(); err != nil {
+			log.Printf("warning: load proto directories: %v", err)
+		}
+		if *protoDirPoll > 0 {
+			go watcher.Run(context.Background(), *protoDirPoll)
+		}
+	}
+
+	if *proxyAddr != "" && *proxyReflection {
+		go func() {
+			// The backend may start after the mock, it is waited for a while.
+			// Started after the local protos are loaded, which it doesn't replace
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			paths, err := reflection.ImportUpstream(ctx, descriptorRegistry, *proxyAddr, false)
+			if err != nil {
+				log.Printf("warning: import proxy backend descriptors: %v", err)
+				return
+			}
+			log.Printf("imported %d files from the proxy backend reflection", len(paths))
+			historyRegistry.UpdateHistories(decoder.Redecode)
+		}()
+	}
+
+	httpServer := hotServer.NewServer(descriptorRegistry, mockRegistry, historyRegistry,
+		hotServer.WithRedactor(redactor),
+		hotServer.WithReplayTarget(*proxyAddr),
+		hotServer.WithDriftTracker(driftTracker),
+	)
 	go func() {
 		log.Printf("HTTP config server on %s", *httpPort)
 		log.Fatal(http.ListenAndServe(*httpPort, httpServer))
 	}()
 
-	server := grpc.NewServer(*proxyAddr, descriptorRegistry, mockRegistry, historyRegistry)
+	server := grpc.NewServer(*proxyAddr, descriptorRegistry, mockRegistry, historyRegistry, grpc.WithRedactor(redactor), grpc.WithDriftTracker(driftTracker), grpc.WithReflectionMerge(*reflectionMerge))
 	lis, err := net.Listen("tcp", *grpcPort)
 	if err != nil {
 		log.Fatalf("listen %s: %v", *grpcPort, err)
 	}
+	// Stopped on SIGINT or SIGTERM, so that the history file is written completely
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		log.Printf("shutting down")
+		server.Stop()
+	}()
+
 	log.Printf("gRPC listening on %s (proxy=%q)", *grpcPort, *proxyAddr)
 	err = server.Serve(lis)
 	if err != nil {
 		log.Fatalf("Unable to run grpc server %v", err)
 	}
+	if fileRegistry != nil {
+		if err := fileRegistry.Close(); err != nil {
+			log.Printf("warning: close history file: %v", err)
+		}
+	}
 }
@@ -0,0 +1,149 @@
+// Package diff compares recorded and actual gRPC payloads.
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Difference is a value differing between the expected and the actual payloads.
+// A missing side is nil.
+type Difference struct {
+	Path     string `json:"path"`
+	Expected any    `json:"expected"`
+	Actual   any    `json:"actual"`
+}
+
+// Ignore matches the paths excluded from a comparison. A rule matches a path and everything
+// below it; list indexes are left out of the rules ("items.price" matches "items[3].price").
+type Ignore []string
+
+var indexRe = regexp.MustCompile(`\[\d+\]`)
+
+func (ig Ignore) match(path string) bool {
+	if len(ig) == 0 {
+		return false
+	}
+	path = indexRe.ReplaceAllString(path, "")
+	for _, rule := range ig {
+		if path == rule || strings.HasPrefix(path, rule+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Messages compares two messages of the same type field by field. They are compared through
+// their canonical JSON form, so that neither the encoding order nor default values matter.
+func Messages(expected, actual proto.Message, ignore Ignore) ([]Difference, error) {
+	if proto.Equal(expected, actual) {
+		return nil, nil
+	}
+	e, err := toValue(expected)
+	if err != nil {
+		return nil, err
+	}
+	a, err := toValue(actual)
+	if err != nil {
+		return nil, err
+	}
+	return Values(e, a, ignore), nil
+}
+
+func toValue(m proto.Message) (any, error) {
+	b, err := protojson.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("marshal %s: %w", m.ProtoReflect().Descriptor().FullName(), err)
+	}
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Prefix roots the paths of diffs at path.
+func Prefix(path string, diffs []Difference) []Difference {
+	for i := range diffs {
+		diffs[i].Path = join(path, diffs[i].Path)
+	}
+	return diffs
+}
+
+// Values compares two JSON values, as decoded by encoding/json. Payloads decoded from
+// protobuf with the same descriptor are compared field by field, by their JSON names.
+func Values(expected, actual any, ignore Ignore) []Difference {
+	return values("", expected, actual, ignore)
+}
+
+func values(path string, expected, actual any, ignore Ignore) []Difference {
+	if ignore.match(path) {
+		return nil
+	}
+	switch e := expected.(type) {
+	case map[string]any:
+		a, ok := actual.(map[string]any)
+		if !ok {
+			break
+		}
+		var diffs []Difference
+		for _, k := range unionKeys(e, a) {
+			diffs = append(diffs, values(join(path, k), e[k], a[k], ignore)...)
+		}
+		return diffs
+	case []any:
+		a, ok := actual.([]any)
+		if !ok {
+			break
+		}
+		var diffs []Difference
+		for i := 0; i < max(len(e), len(a)); i++ {
+			var ev, av any
+			if i < len(e) {
+				ev = e[i]
+			}
+			if i < len(a) {
+				av = a[i]
+			}
+			diffs = append(diffs, values(fmt.Sprintf("%s[%d]", path, i), ev, av, ignore)...)
+		}
+		return diffs
+	}
+	if reflect.DeepEqual(expected, actual) {
+		return nil
+	}
+	return []Difference{{Path: path, Expected: expected, Actual: actual}}
+}
+
+func unionKeys(a, b map[string]any) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func join(path, key string) string {
+	switch {
+	case path == "":
+		return key
+	case key == "":
+		return path
+	case strings.HasPrefix(key, "["):
+		return path + key
+	}
+	return path + "." + key
+}
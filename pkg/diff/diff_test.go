@@ -0,0 +1,33 @@
+package diff_test
+
+import (
+	"testing"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/diff"
+)
+
+func TestValues(t *testing.T) {
+	expected := map[string]any{
+		"name":  "Alice",
+		"items": []any{map[string]any{"id": "1", "price": 10.0}, map[string]any{"id": "2", "price": 20.0}},
+		"extra": true,
+	}
+	actual := map[string]any{
+		"name":  "Bob",
+		"items": []any{map[string]any{"id": "9", "price": 10.0}},
+	}
+
+	diffs := diff.Values(expected, actual, diff.Ignore{"items.id"})
+	got := map[string]bool{}
+	for _, d := range diffs {
+		got[d.Path] = true
+	}
+	for _, path := range []string{"name", "items[1]", "extra"} {
+		if !got[path] {
+			t.Errorf("expected a difference on %s, got %+v", path, diffs)
+		}
+	}
+	if len(diffs) != 3 {
+		t.Errorf("expected 3 differences, got %+v", diffs)
+	}
+}
@@ -0,0 +1,136 @@
+// Package drift detects upstream messages that don't match the registered descriptors,
+// a sign that the uploaded protos are out of date with the running backend.
+package drift
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Inspect lists the parts of m unknown to its descriptor: unknown fields and enum values.
+func Inspect(m protoreflect.Message) []string {
+	var issues []string
+	inspect(m, &issues)
+	return issues
+}
+
+func inspect(m protoreflect.Message, issues *[]string) {
+	name := m.Descriptor().FullName()
+	for b := m.GetUnknown(); len(b) > 0; {
+		num, _, n := protowire.ConsumeField(b)
+		if n < 0 {
+			break
+		}
+		*issues = append(*issues, fmt.Sprintf("unknown field %d in %s", num, name))
+		b = b[n:]
+	}
+
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+				inspectValue(fd.MapValue(), mv, issues)
+				return true
+			})
+		case fd.IsList():
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				inspectValue(fd, list.Get(i), issues)
+			}
+		default:
+			inspectValue(fd, v, issues)
+		}
+		return true
+	})
+}
+
+func inspectValue(fd protoreflect.FieldDescriptor, v protoreflect.Value, issues *[]string) {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		inspect(v.Message(), issues)
+	case protoreflect.EnumKind:
+		if fd.Enum().Values().ByNumber(v.Enum()) == nil {
+			*issues = append(*issues, fmt.Sprintf("unknown value %d of enum %s in %s", v.Enum(), fd.Enum().FullName(), fd.FullName()))
+		}
+	}
+}
+
+// MethodReport sums up the drift observed on the upstream responses of a method.
+type MethodReport struct {
+	Method string `json:"method"`
+	// Responses is the number of inspected upstream responses
+	Responses int `json:"responses"`
+	// Drifted is the number of responses with at least one issue
+	Drifted        int `json:"drifted"`
+	DecodeFailures int `json:"decode_failures"`
+	// Issues counts the responses by issue
+	Issues     map[string]int `json:"issues"`
+	LastSeen   time.Time      `json:"last_seen,omitempty"`
+	LastCallID string         `json:"last_call_id,omitempty"`
+}
+
+// Tracker aggregates the drift by method. The zero value is ready to use.
+type Tracker struct {
+	mu      sync.Mutex
+	methods map[string]*MethodReport
+}
+
+// Record accounts an inspected upstream response of the call callID on method.
+// decodeFailed is set when the response couldn't be decoded at all.
+func (t *Tracker) Record(method, callID string, issues []string, decodeFailed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.methods == nil {
+		t.methods = map[string]*MethodReport{}
+	}
+	r, ok := t.methods[method]
+	if !ok {
+		r = &MethodReport{Method: method, Issues: map[string]int{}}
+		t.methods[method] = r
+	}
+	r.Responses++
+	if len(issues) == 0 && !decodeFailed {
+		return
+	}
+	r.Drifted++
+	if decodeFailed {
+		r.DecodeFailures++
+	}
+	for _, issue := range issues {
+		r.Issues[issue]++
+	}
+	r.LastSeen = time.Now()
+	r.LastCallID = callID
+}
+
+// Report returns the methods whose responses drifted, sorted by method.
+func (t *Tracker) Report() []MethodReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res := []MethodReport{}
+	for _, r := range t.methods {
+		if r.Drifted == 0 {
+			continue
+		}
+		c := *r
+		c.Issues = make(map[string]int, len(r.Issues))
+		for k, v := range r.Issues {
+			c.Issues[k] = v
+		}
+		res = append(res, c)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Method < res[j].Method })
+	return res
+}
+
+// Reset forgets everything recorded so far.
+func (t *Tracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.methods = nil
+}
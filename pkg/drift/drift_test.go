@@ -0,0 +1,68 @@
+package drift_test
+
+import (
+	"testing"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/drift"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestInspect(t *testing.T) {
+	// google.protobuf.Value with null_value = 7 (undefined) and an unknown field 99
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, 7)
+	b = protowire.AppendTag(b, 99, protowire.VarintType)
+	b = protowire.AppendVarint(b, 1)
+
+	m := dynamicpb.NewMessage((&structpb.Value{}).ProtoReflect().Descriptor())
+	if err := proto.Unmarshal(b, m); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	issues := drift.Inspect(m)
+	want := map[string]bool{
+		"unknown field 99 in google.protobuf.Value":                                             true,
+		"unknown value 7 of enum google.protobuf.NullValue in google.protobuf.Value.null_value": true,
+	}
+	if len(issues) != len(want) {
+		t.Fatalf("expected %d issues, got %v", len(want), issues)
+	}
+	for _, issue := range issues {
+		if !want[issue] {
+			t.Errorf("unexpected issue %q", issue)
+		}
+	}
+
+	valid := dynamicpb.NewMessage((&structpb.Value{}).ProtoReflect().Descriptor())
+	if issues := drift.Inspect(valid); len(issues) != 0 {
+		t.Errorf("expected no issue on a valid message, got %v", issues)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	var tracker drift.Tracker
+	tracker.Record("/svc.S/Clean", "1", nil, false)
+	tracker.Record("/svc.S/Drifted", "2", []string{"unknown field 7 in svc.Resp"}, false)
+	tracker.Record("/svc.S/Drifted", "3", nil, true)
+	tracker.Record("/svc.S/Drifted", "4", nil, false)
+
+	report := tracker.Report()
+	if len(report) != 1 {
+		t.Fatalf("expected only the drifted method, got %+v", report)
+	}
+	r := report[0]
+	if r.Method != "/svc.S/Drifted" || r.Responses != 3 || r.Drifted != 2 || r.DecodeFailures != 1 {
+		t.Errorf("unexpected report %+v", r)
+	}
+	if r.Issues["unknown field 7 in svc.Resp"] != 1 || r.LastCallID != "3" {
+		t.Errorf("unexpected issues %+v", r)
+	}
+
+	tracker.Reset()
+	if report := tracker.Report(); len(report) != 0 {
+		t.Errorf("expected an empty report after reset, got %+v", report)
+	}
+}
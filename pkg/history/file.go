@@ -0,0 +1,335 @@
+package history
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// compactMinOps is the number of logged operations below which the log is never compacted
+	compactMinOps = 10000
+	// flushInterval bounds the operations lost by a crash, the log is flushed on Close otherwise
+	flushInterval = time.Second
+)
+
+// FileRegistry is a history store persisted on local disk.
+//
+// Calls are served from an embedded DefaultRegistry, so reads and queries behave exactly
+// like the in-memory store. Every write is also appended to a JSON Lines operation log,
+// replayed when the registry is opened. The log is compacted, rewritten with the live calls
+// only, when it's opened and once it holds much more operations than live calls.
+type FileRegistry struct {
+	*DefaultRegistry
+
+	path string
+
+	// mu serializes the writes so that the log follows the order of the in-memory operations
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	ops  int
+	// done stops the periodic flush
+	done chan struct{}
+}
+
+type fileOp string
+
+const (
+	opSave   fileOp = "save"
+	opAppend fileOp = "append"
+	opDelete fileOp = "delete"
+	opClear  fileOp = "clear"
+)
+
+// fileRecord is a line of the operation log.
+type fileRecord struct {
+	Op      fileOp   `json:"op"`
+	History *History `json:"history,omitempty"`
+	ID      string   `json:"id,omitempty"`
+	Message *Message `json:"message,omitempty"`
+}
+
+// NewFileRegistry opens, or creates, the history stored in path, bounded by cfg.
+// The registry must be closed to write its last operations.
+func NewFileRegistry(path string, cfg Config) (*FileRegistry, error) {
+	r := &FileRegistry{DefaultRegistry: NewDefaultRegistry(cfg), path: path, done: make(chan struct{})}
+	if err := r.replay(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.compact(); err != nil {
+		return nil, err
+	}
+	go r.flushLoop()
+	return r, nil
+}
+
+// flushLoop writes the buffered operations to disk every flushInterval until Close,
+// so that the calls don't wait for the disk.
+func (r *FileRegistry) flushLoop() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			if err := r.Flush(); err != nil {
+				log.Printf("warning: write history file: %v", err)
+			}
+		}
+	}
+}
+
+// Flush writes the buffered operations to disk.
+func (r *FileRegistry) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	return r.w.Flush()
+}
+
+// replay loads the operation log into memory. Unreadable lines, like a line cut by a crash, are skipped.
+func (r *FileRegistry) replay() error {
+	f, err := os.Open(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open history file: %w", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		b, err := reader.ReadBytes('\n')
+		if len(b) > 0 {
+			var rec fileRecord
+			if jsonErr := json.Unmarshal(b, &rec); jsonErr != nil {
+				log.Printf("warning: skip history file %s line %d: %v", r.path, line, jsonErr)
+			} else {
+				r.apply(rec)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read history file: %w", err)
+		}
+	}
+}
+
+func (r *FileRegistry) apply(rec fileRecord) {
+	switch rec.Op {
+	case opSave:
+		if rec.History != nil {
+			for i := range rec.History.Messages {
+				restoreRawPayload(&rec.History.Messages[i])
+			}
+			r.DefaultRegistry.SaveHistory(*rec.History)
+		}
+	case opAppend:
+		if rec.Message != nil {
+			restoreRawPayload(rec.Message)
+			r.DefaultRegistry.AppendMessage(rec.ID, *rec.Message)
+		}
+	case opDelete:
+		r.DefaultRegistry.DeleteHistory(rec.ID)
+	case opClear:
+		r.DefaultRegistry.Clear()
+	}
+}
+
+// restoreRawPayload recovers the bytes of an unrecognized message, not logged since
+// PayloadString already holds them in base64.
+func restoreRawPayload(m *Message) {
+	if m.Recognized || m.Truncated || m.RawPayload != nil {
+		return
+	}
+	if b, err := base64.StdEncoding.DecodeString(m.PayloadString); err == nil {
+		m.RawPayload = b
+	}
+}
+
+func (r *FileRegistry) SaveHistory(h History) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.DefaultRegistry.SaveHistory(h)
+	// The stored call is logged rather than h: its payloads are truncated
+	r.writeSaved(h.ID)
+}
+
+func (r *FileRegistry) CreateHistory(h History) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.DefaultRegistry.CreateHistory(h) {
+		return false
+	}
+	r.writeSaved(h.ID)
+	return true
+}
+
+func (r *FileRegistry) AppendMessage(id string, m Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cfg.MaxPayloadBytes > 0 {
+		m = TruncateMessage(m, r.cfg.MaxPayloadBytes)
+	}
+	r.DefaultRegistry.AppendMessage(id, m)
+	r.write(fileRecord{Op: opAppend, ID: id, Message: &m})
+}
+
+func (r *FileRegistry) UpdateHistory(id string, update func(h *History) bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.DefaultRegistry.UpdateHistory(id, update) {
+		return false
+	}
+	r.writeSaved(id)
+	return true
+}
+
+func (r *FileRegistry) UpdateHistories(update func(h *History) bool) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ids []string
+	n := r.DefaultRegistry.UpdateHistories(func(h *History) bool {
+		if !update(h) {
+			return false
+		}
+		ids = append(ids, h.ID)
+		return true
+	})
+	for _, id := range ids {
+		r.writeSaved(id)
+	}
+	return n
+}
+
+func (r *FileRegistry) DeleteHistory(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.DefaultRegistry.DeleteHistory(id) {
+		return false
+	}
+	r.write(fileRecord{Op: opDelete, ID: id})
+	return true
+}
+
+func (r *FileRegistry) Clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.DefaultRegistry.Clear()
+	r.write(fileRecord{Op: opClear})
+}
+
+// Compact rewrites the log with the live calls only.
+func (r *FileRegistry) Compact() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.compact()
+}
+
+// Close flushes and closes the log. The registry must not be written afterwards.
+func (r *FileRegistry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	close(r.done)
+	err := r.w.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file = nil
+	return err
+}
+
+// writeSaved logs the current state of a call, it may have been evicted meanwhile.
+func (r *FileRegistry) writeSaved(id string) {
+	if h, ok := r.DefaultRegistry.GetHistory(id); ok {
+		r.write(fileRecord{Op: opSave, History: &h})
+	}
+}
+
+// write appends rec to the log. Failures are logged: losing the persistence must not fail the calls.
+func (r *FileRegistry) write(rec fileRecord) {
+	if r.file == nil {
+		return
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("warning: encode history record: %v", err)
+		return
+	}
+	b = append(b, '\n')
+	// Buffered, flushLoop writes it to disk
+	if _, err := r.w.Write(b); err != nil {
+		log.Printf("warning: write history file: %v", err)
+		return
+	}
+	r.ops++
+	if r.ops > compactMinOps && r.ops > 4*r.DefaultRegistry.Stats().Entries {
+		if err := r.compact(); err != nil {
+			log.Printf("warning: compact history file: %v", err)
+		}
+	}
+}
+
+// compact writes the live calls to a temporary file then atomically replaces the log with it.
+func (r *FileRegistry) compact() error {
+	tmp := r.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create history file: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	histories := r.DefaultRegistry.GetHistories()
+	for i := range histories {
+		if err := enc.Encode(fileRecord{Op: opSave, History: &histories[i]}); err != nil {
+			f.Close()
+			return fmt.Errorf("write history file: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("write history file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync history file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close history file: %w", err)
+	}
+
+	if err := os.Rename(tmp, r.path); err != nil {
+		return fmt.Errorf("replace history file: %w", err)
+	}
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open history file: %w", err)
+	}
+	r.file = file
+	r.w = bufio.NewWriter(file)
+	r.ops = len(histories)
+	return nil
+}
@@ -0,0 +1,95 @@
+package history_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
+)
+
+func TestFileRegistry_SurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	r, err := history.NewFileRegistry(path, history.Config{})
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	now := time.Now()
+	r.SaveHistory(history.History{ID: "a", StartTime: now, FullMethod: "/example.Greeter/SayHello", State: history.StateOpen})
+	r.AppendMessage("a", history.Message{Direction: "recv", PayloadString: "CAE=", RawPayload: []byte{0x08, 0x01}})
+	r.SaveHistory(history.History{ID: "b", StartTime: now.Add(time.Second), FullMethod: "/example.Greeter/SayBye", State: history.StateClosed, Session: "s1"})
+	r.SaveHistory(history.History{ID: "c", StartTime: now.Add(2 * time.Second), FullMethod: "/example.Greeter/SayBye", State: history.StateClosed})
+	r.DeleteHistory("c")
+	if err := r.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	r, err = history.NewFileRegistry(path, history.Config{})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer r.Close()
+
+	if got := ids(r.GetHistories()); strings.Join(got, ",") != "a,b" {
+		t.Fatalf("unexpected histories after restart %v", got)
+	}
+	a, _ := r.GetHistory("a")
+	if len(a.Messages) != 1 || string(a.Messages[0].RawPayload) != "\x08\x01" {
+		t.Errorf("expected the appended message with its raw bytes, got %+v", a.Messages)
+	}
+	if page := r.Query(history.Query{Session: "s1"}); len(page.Histories) != 1 || page.Histories[0].ID != "b" {
+		t.Errorf("unexpected query result %v", ids(page.Histories))
+	}
+
+	// Reopening compacts the log to the live calls
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines != 2 {
+		t.Errorf("expected 2 lines after compaction, got %d", lines)
+	}
+}
+
+func TestFileRegistry_Flush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	r, err := history.NewFileRegistry(path, history.Config{})
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer r.Close()
+	r.SaveHistory(history.History{ID: "a", FullMethod: "/example.Greeter/SayHello", State: history.StateOpen})
+
+	// Writes are buffered rather than written by the calls
+	if b, _ := os.ReadFile(path); len(b) != 0 {
+		t.Errorf("expected the operation to be buffered, got %s", b)
+	}
+	if err := r.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if b, _ := os.ReadFile(path); !strings.Contains(string(b), `"id":"a"`) {
+		t.Errorf("expected the flushed operation in the log, got %s", b)
+	}
+}
+
+func TestFileRegistry_MaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	r, err := history.NewFileRegistry(path, history.Config{})
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	r.SaveHistory(history.History{ID: "old", StartTime: time.Now().Add(-2 * time.Hour)})
+	r.SaveHistory(history.History{ID: "new", StartTime: time.Now()})
+	r.Close()
+
+	r, err = history.NewFileRegistry(path, history.Config{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer r.Close()
+	if got := ids(r.GetHistories()); len(got) != 1 || got[0] != "new" {
+		t.Errorf("expected expired calls to be dropped, got %v", got)
+	}
+}
@@ -1,9 +1,9 @@
 package history
 
 import (
-	"sort"
-	"sync"
 	"time"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/diff"
 )
 
 type State string
@@ -22,6 +22,30 @@ type History struct {
 	State       State      `json:"state"`
 	GrpcCode    int32      `json:"grpc_code"`
 	GrpcMessage string     `json:"grpc_message"`
+	Proxified   bool       `json:"proxified"`
+	Session     string     `json:"session,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	// ReplayOf is the ID of the recorded call this call replays
+	ReplayOf string `json:"replay_of,omitempty"`
+	// Shadow holds the answer of the side not served to the client, for shadowed mocks
+	Shadow *Shadow `json:"shadow,omitempty"`
+
+	// Connection and call properties
+	Peer        string     `json:"peer,omitempty"`
+	Authority   string     `json:"authority,omitempty"`
+	Deadline    *time.Time `json:"deadline,omitempty"`
+	Compression string     `json:"compression,omitempty"`
+
+	// Metadata exchanged with the client. Values of binary keys (suffixed by "-bin") are base64 encoded.
+	RequestMetadata  map[string][]string `json:"request_metadata,omitempty"`
+	ResponseHeaders  map[string][]string `json:"response_headers,omitempty"`
+	ResponseTrailers map[string][]string `json:"response_trailers,omitempty"`
+	// Metadata received from the upstream when the call is proxified
+	UpstreamHeaders  map[string][]string `json:"upstream_headers,omitempty"`
+	UpstreamTrailers map[string][]string `json:"upstream_trailers,omitempty"`
+
+	// StatusDetails holds the decoded details of the final status (grpc-status-details-bin)
+	StatusDetails []any `json:"status_details,omitempty"`
 }
 
 type Message struct {
@@ -31,55 +55,56 @@ type Message struct {
 	Proxified     bool        `json:"proxified"`
 	PayloadString string      `json:"payload_string"`
 	Payload       interface{} `json:"payload"`
+	// Truncated is set when the payload exceeded the registry payload cap,
+	// PayloadString is then cut and Payload dropped
+	Truncated   bool `json:"truncated,omitempty"`
+	PayloadSize int  `json:"payload_size,omitempty"`
+	// Guessed is set when Payload was decoded without schema, from the wire format only
+	Guessed bool `json:"guessed,omitempty"`
+	// Drift lists what doesn't match the registered descriptor in a message decoded from the wire:
+	// unknown fields or enum values, or the reason it couldn't be decoded
+	Drift []string `json:"drift,omitempty"`
+	// RawPayload keeps the wire bytes of the message, redacted when it's recognized.
+	// Unrecognized messages are decoded from them once their descriptors are known.
+	RawPayload []byte `json:"-"`
+}
+
+// Shadow compares the answers of the mock and of the upstream to a shadowed call.
+// Differences are given with the upstream as expected and the mock as actual.
+type Shadow struct {
+	// Served is the side which answered the client, "mock" or "upstream"
+	Served string `json:"served"`
+	// Outcome of the other side
+	GrpcCode    int32     `json:"grpc_code"`
+	GrpcMessage string    `json:"grpc_message"`
+	Messages    []Message `json:"messages"`
+
+	Diverged    bool              `json:"diverged"`
+	Differences []diff.Difference `json:"differences,omitempty"`
 }
 
 type RegisterReadWriter interface {
 	RegistryWriter
 	RegistryReader
+	Observable
 }
 
 type RegistryWriter interface {
+	// SaveHistory creates or replaces a call
 	SaveHistory(History)
+	// CreateHistory saves a new call, it saves nothing and reports false when the ID is already taken
+	CreateHistory(History) bool
+	// AppendMessage adds a message to an already saved call, it's a no-op if the call doesn't exist
+	AppendMessage(id string, m Message)
+	// UpdateHistory modifies a saved call in place, update reports whether it changed it
+	UpdateHistory(id string, update func(h *History) bool) bool
+	// UpdateHistories applies update to every saved call and returns the number of changed calls
+	UpdateHistories(update func(h *History) bool) int
+	DeleteHistory(id string) bool
 	Clear()
 }
 type RegistryReader interface {
 	GetHistories() []History
-}
-
-type DefaultRegistry struct {
-	histories []History
-	mu        sync.RWMutex
-}
-
-func (r *DefaultRegistry) SaveHistory(h History) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	for i := range r.histories {
-		if r.histories[i].ID == h.ID {
-			r.histories[i] = h
-			return
-		}
-	}
-	r.histories = append(r.histories, h)
-}
-
-func (r *DefaultRegistry) GetHistories() []History {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-
-	histories := make([]History, len(r.histories))
-	copy(histories, r.histories)
-
-	sort.Slice(histories, func(i, j int) bool {
-		return histories[i].StartTime.Before(histories[j].StartTime)
-	})
-
-	return histories
-}
-
-func (r *DefaultRegistry) Clear() {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.histories = []History{}
+	GetHistory(id string) (History, bool)
+	Query(Query) Page
 }
@@ -0,0 +1,234 @@
+package history_test
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
+)
+
+func seedRegistry(t *testing.T) *history.DefaultRegistry {
+	t.Helper()
+	r := &history.DefaultRegistry{}
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.SaveHistory(history.History{ID: "1", StartTime: base, FullMethod: "/grpc.reflection.v1.ServerReflection/ServerReflectionInfo", State: history.StateClosed})
+	r.SaveHistory(history.History{ID: "2", StartTime: base.Add(time.Second), FullMethod: "/example.Greeter/SayHello", State: history.StateClosed, Session: "s1",
+		Messages: []history.Message{{Direction: "recv", PayloadString: `{"name":"Alice"}`}}})
+	r.SaveHistory(history.History{ID: "3", StartTime: base.Add(2 * time.Second), FullMethod: "/example.Greeter/SayBye", State: history.StateClosed, GrpcCode: 5, Proxified: true, Tags: []string{"slow"}})
+	r.SaveHistory(history.History{ID: "4", StartTime: base.Add(3 * time.Second), FullMethod: "/example.Other/Watch", State: history.StateOpen})
+	return r
+}
+
+func ids(histories []history.History) []string {
+	res := make([]string, 0, len(histories))
+	for _, h := range histories {
+		res = append(res, h.ID)
+	}
+	return res
+}
+
+func TestQuery_Filters(t *testing.T) {
+	r := seedRegistry(t)
+	notFound := int32(5)
+	proxified := true
+
+	tests := []struct {
+		name     string
+		query    history.Query
+		expected []string
+	}{
+		{"no filter", history.Query{}, []string{"1", "2", "3", "4"}},
+		{"exclude reflection", history.Query{ExcludeReflection: true}, []string{"2", "3", "4"}},
+		{"exact method", history.Query{Method: "/example.Greeter/SayHello"}, []string{"2"}},
+		{"method prefix", history.Query{MethodPrefix: "/example.Greeter/"}, []string{"2", "3"}},
+		{"method regex", history.Query{MethodRegex: regexp.MustCompile(`Say(Bye|Nothing)$`)}, []string{"3"}},
+		{"state", history.Query{State: history.StateOpen}, []string{"4"}},
+		{"grpc code", history.Query{GrpcCode: &notFound}, []string{"3"}},
+		{"proxified", history.Query{Proxified: &proxified}, []string{"3"}},
+		{"time range", history.Query{
+			Since: time.Date(2025, 1, 1, 0, 0, 1, 0, time.UTC),
+			Until: time.Date(2025, 1, 1, 0, 0, 2, 0, time.UTC),
+		}, []string{"2", "3"}},
+		{"session", history.Query{Session: "s1"}, []string{"2"}},
+		{"tag", history.Query{Tag: "slow"}, []string{"3"}},
+		{"payload", history.Query{PayloadContains: "Alice"}, []string{"2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ids(r.Query(tt.query).Histories)
+			if len(got) != len(tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+			for i := range got {
+				if got[i] != tt.expected[i] {
+					t.Fatalf("expected %v, got %v", tt.expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestQuery_Pagination(t *testing.T) {
+	r := seedRegistry(t)
+
+	page := r.Query(history.Query{Limit: 3})
+	if got := ids(page.Histories); len(got) != 3 || got[0] != "1" || got[2] != "3" {
+		t.Fatalf("unexpected first page %v", got)
+	}
+	if page.NextCursor == "" {
+		t.Fatal("expected a next cursor")
+	}
+
+	// The cursor must survive the deletion of the entry it points to
+	if !r.DeleteHistory("3") {
+		t.Fatal("expected history 3 to be deleted")
+	}
+	page = r.Query(history.Query{Limit: 3, Cursor: page.NextCursor})
+	if got := ids(page.Histories); len(got) != 1 || got[0] != "4" {
+		t.Fatalf("unexpected second page %v", got)
+	}
+	if page.NextCursor != "" {
+		t.Errorf("expected no next cursor on last page, got %q", page.NextCursor)
+	}
+}
+
+func TestGetAndDeleteHistory(t *testing.T) {
+	r := seedRegistry(t)
+
+	h, ok := r.GetHistory("2")
+	if !ok || h.FullMethod != "/example.Greeter/SayHello" {
+		t.Fatalf("unexpected history %+v (found=%v)", h, ok)
+	}
+	if !r.DeleteHistory("2") {
+		t.Fatal("expected delete to succeed")
+	}
+	if _, ok := r.GetHistory("2"); ok {
+		t.Error("history 2 still present after delete")
+	}
+	if r.DeleteHistory("2") {
+		t.Error("expected second delete to report a missing history")
+	}
+}
+
+func TestCreateHistory_Concurrent(t *testing.T) {
+	r := &history.DefaultRegistry{}
+	var created atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r.CreateHistory(history.History{ID: "req-1", FullMethod: fmt.Sprint(i)}) {
+				created.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if created.Load() != 1 {
+		t.Errorf("expected the ID to be reserved once, got %d", created.Load())
+	}
+}
+
+func TestDefaultRegistry_EvictsOldestEntries(t *testing.T) {
+	r := history.NewDefaultRegistry(history.Config{MaxEntries: 2})
+	base := time.Now()
+	for i, id := range []string{"1", "2", "3"} {
+		r.SaveHistory(history.History{ID: id, StartTime: base.Add(time.Duration(i) * time.Second)})
+	}
+
+	if got := ids(r.GetHistories()); len(got) != 2 || got[0] != "2" || got[1] != "3" {
+		t.Fatalf("expected [2 3], got %v", got)
+	}
+	if _, ok := r.GetHistory("1"); ok {
+		t.Error("history 1 should have been evicted")
+	}
+	if stats := r.Stats(); stats.Entries != 2 || stats.Evicted != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// Updating an entry keeps its position
+	r.SaveHistory(history.History{ID: "2", StartTime: base.Add(time.Second), State: history.StateClosed})
+	if got := ids(r.GetHistories()); got[0] != "2" {
+		t.Errorf("expected update in place, got %v", got)
+	}
+}
+
+func TestDefaultRegistry_EvictsOnBytes(t *testing.T) {
+	payload := string(make([]byte, 1000))
+	r := history.NewDefaultRegistry(history.Config{MaxBytes: 5000})
+	base := time.Now()
+	for i := range 10 {
+		r.SaveHistory(history.History{
+			ID:        string(rune('a' + i)),
+			StartTime: base.Add(time.Duration(i) * time.Second),
+			Messages:  []history.Message{{PayloadString: payload}},
+		})
+	}
+	stats := r.Stats()
+	if stats.Bytes > 5000 || stats.Entries == 0 || stats.Entries == 10 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	histories := r.GetHistories()
+	if histories[len(histories)-1].ID != "j" {
+		t.Errorf("expected most recent call to be kept, got %v", ids(histories))
+	}
+}
+
+func TestDefaultRegistry_TruncatesPayloads(t *testing.T) {
+	r := history.NewDefaultRegistry(history.Config{MaxPayloadBytes: 10})
+	original := []history.Message{
+		{PayloadString: `{"name":"Alice in wonderland"}`, Payload: map[string]any{"name": "Alice in wonderland"}},
+		{PayloadString: `{}`},
+	}
+	r.SaveHistory(history.History{ID: "1", Messages: original})
+
+	h, _ := r.GetHistory("1")
+	m := h.Messages[0]
+	if !m.Truncated || len(m.PayloadString) != 10 || m.Payload != nil || m.PayloadSize != len(original[0].PayloadString) {
+		t.Errorf("unexpected truncated message %+v", m)
+	}
+	if h.Messages[1].Truncated {
+		t.Error("small payload should not be truncated")
+	}
+	if original[0].Truncated {
+		t.Error("caller messages must not be modified")
+	}
+}
+
+func TestDefaultRegistry_Subscribe(t *testing.T) {
+	r := &history.DefaultRegistry{}
+	sub := r.Subscribe(history.Query{Method: "/example.Greeter/SayHello"}, 10)
+	defer sub.Close()
+
+	r.SaveHistory(history.History{ID: "other", FullMethod: "/example.Other/Call", State: history.StateOpen})
+	r.SaveHistory(history.History{ID: "1", FullMethod: "/example.Greeter/SayHello", State: history.StateOpen})
+	r.AppendMessage("1", history.Message{Direction: "recv", PayloadString: `{"name":"Alice"}`})
+	r.SaveHistory(history.History{ID: "1", FullMethod: "/example.Greeter/SayHello", State: history.StateClosed})
+	// Rewriting a closed call isn't a transition
+	r.SaveHistory(history.History{ID: "1", FullMethod: "/example.Greeter/SayHello", State: history.StateClosed})
+
+	expected := []history.EventType{history.EventCallOpened, history.EventMessage, history.EventCallClosed}
+	for _, typ := range expected {
+		select {
+		case e := <-sub.C:
+			if e.Type != typ || e.History.ID != "1" {
+				t.Fatalf("expected %s event on call 1, got %s on %s", typ, e.Type, e.History.ID)
+			}
+			if typ == history.EventMessage && (e.Message == nil || e.Message.Direction != "recv") {
+				t.Errorf("unexpected message event %+v", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %s event", typ)
+		}
+	}
+	select {
+	case e := <-sub.C:
+		t.Errorf("unexpected extra event %+v", e)
+	default:
+	}
+}
@@ -0,0 +1,114 @@
+package history
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type EventType string
+
+const (
+	EventCallOpened EventType = "call_opened"
+	EventMessage    EventType = "message"
+	EventCallClosed EventType = "call_closed"
+	// EventsDropped tells a live subscriber it lost events and should resync from the history
+	EventsDropped EventType = "events_dropped"
+)
+
+// Event notifies subscribers of a change in the history.
+// For message events, History holds the call without its messages and Message the new one.
+type Event struct {
+	Type    EventType `json:"type"`
+	History History   `json:"history"`
+	Message *Message  `json:"message,omitempty"`
+}
+
+// MatchEvent reports whether e concerns a call matching the query filters.
+// A message event matches the payload filter when the new message does.
+func (q Query) MatchEvent(e Event) bool {
+	h := e.History
+	if e.Message != nil {
+		h.Messages = []Message{*e.Message}
+	}
+	return q.Match(h)
+}
+
+// Observable is implemented by registries able to notify changes as they happen.
+type Observable interface {
+	// Subscribe registers a subscriber receiving the events matching q.
+	// The subscription must be closed once done.
+	Subscribe(q Query, buffer int) *Subscription
+}
+
+// Subscription receives events on C until Close is called.
+type Subscription struct {
+	C <-chan Event
+
+	c       chan Event
+	query   Query
+	hub     *Hub
+	dropped atomic.Uint64
+}
+
+// Close unregisters the subscription and closes C.
+func (s *Subscription) Close() {
+	s.hub.unsubscribe(s)
+}
+
+// Dropped returns the number of events lost because the subscriber was too slow.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Hub dispatches events to subscriptions. Publishing never blocks: a subscriber whose
+// buffer is full loses the event rather than slowing down the recorded calls.
+//
+// The zero value is ready to use.
+type Hub struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+func (h *Hub) Subscribe(q Query, buffer int) *Subscription {
+	c := make(chan Event, buffer)
+	s := &Subscription{C: c, c: c, query: q, hub: h}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = map[*Subscription]struct{}{}
+	}
+	h.subs[s] = struct{}{}
+	return s
+}
+
+func (h *Hub) unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.c)
+	}
+}
+
+// HasSubscribers lets publishers skip building events nobody listens to.
+func (h *Hub) HasSubscribers() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subs) > 0
+}
+
+func (h *Hub) Publish(e Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subs {
+		if !s.query.MatchEvent(e) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
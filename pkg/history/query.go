@@ -0,0 +1,141 @@
+package history
+
+import (
+	"encoding/base64"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReflectionMethodPrefix is the prefix shared by every gRPC server reflection call (v1 and v1alpha).
+const ReflectionMethodPrefix = "/grpc.reflection."
+
+// Query describes which histories to return and how to paginate them.
+// Zero values mean "no constraint" for every field.
+type Query struct {
+	// Method matches the full method exactly (e.g. "/example.Greeter/SayHello")
+	Method string
+	// MethodPrefix matches full methods starting with the given prefix
+	MethodPrefix string
+	// MethodRegex matches full methods against a regular expression
+	MethodRegex *regexp.Regexp
+
+	State     State
+	GrpcCode  *int32
+	Proxified *bool
+
+	// Since and Until bound the call start time (inclusive)
+	Since time.Time
+	Until time.Time
+
+	Session string
+	Tag     string
+
+	// PayloadContains matches calls having at least one message whose payload contains the substring
+	PayloadContains string
+
+	// ExcludeReflection drops grpc.reflection.* calls
+	ExcludeReflection bool
+
+	// Limit is the maximum number of histories returned, 0 means unlimited
+	Limit int
+	// Cursor is the NextCursor returned by a previous page
+	Cursor string
+}
+
+// Page is one page of a Query result.
+type Page struct {
+	Histories []History `json:"histories"`
+	// NextCursor is empty when there is no more result
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Match reports whether h satisfies every filter of the query. Pagination fields are ignored.
+func (q Query) Match(h History) bool {
+	if q.Method != "" && h.FullMethod != q.Method {
+		return false
+	}
+	if q.MethodPrefix != "" && !strings.HasPrefix(h.FullMethod, q.MethodPrefix) {
+		return false
+	}
+	if q.MethodRegex != nil && !q.MethodRegex.MatchString(h.FullMethod) {
+		return false
+	}
+	if q.ExcludeReflection && strings.HasPrefix(h.FullMethod, ReflectionMethodPrefix) {
+		return false
+	}
+	if q.State != "" && h.State != q.State {
+		return false
+	}
+	if q.GrpcCode != nil && (h.State != StateClosed || h.GrpcCode != *q.GrpcCode) {
+		return false
+	}
+	if q.Proxified != nil && h.Proxified != *q.Proxified {
+		return false
+	}
+	if !q.Since.IsZero() && h.StartTime.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && h.StartTime.After(q.Until) {
+		return false
+	}
+	if q.Session != "" && h.Session != q.Session {
+		return false
+	}
+	if q.Tag != "" && !containsString(h.Tags, q.Tag) {
+		return false
+	}
+	if q.PayloadContains != "" {
+		found := false
+		for _, m := range h.Messages {
+			if strings.Contains(m.PayloadString, q.PayloadContains) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeCursor builds an opaque cursor pointing right after h.
+// The start time is kept alongside the ID so that the position survives the deletion of h.
+func encodeCursor(h History) string {
+	raw := strconv.FormatInt(h.StartTime.UnixNano(), 10) + ":" + h.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeCursor extracts the start time and ID of the history a cursor points after.
+func decodeCursor(cursor string) (time.Time, string, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return time.Time{}, "", false
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return time.Unix(0, n), id, true
+}
+
+// ValidCursor reports whether cursor has been produced by a previous page.
+func ValidCursor(cursor string) bool {
+	_, _, ok := decodeCursor(cursor)
+	return ok
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,379 @@
+package history
+
+import (
+	"container/list"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Config bounds the memory used by a DefaultRegistry. Zero values mean unlimited.
+type Config struct {
+	// MaxEntries is the maximum number of calls kept, the oldest ones are evicted first
+	MaxEntries int
+	// MaxBytes is the approximate maximum size of all kept calls, the oldest ones are evicted first
+	MaxBytes int64
+	// MaxPayloadBytes caps the size of each message payload, larger payloads are truncated
+	MaxPayloadBytes int
+	// MaxAge is the retention of calls, counted from their start time.
+	// Expired calls are evicted on the next write.
+	MaxAge time.Duration
+}
+
+// DefaultRegistry is an in-memory history store.
+//
+// Calls are kept in a list ordered by start time and indexed by ID, so that saving,
+// reading and deleting a call don't depend on the number of stored calls.
+// Once the Config bounds are exceeded, the list behaves as a ring buffer: the oldest
+// calls are evicted to make room for the new ones.
+//
+// The zero value is an unbounded registry ready to use.
+type DefaultRegistry struct {
+	cfg Config
+
+	mu      sync.RWMutex
+	entries *list.List // of *entry, oldest first
+	index   map[string]*list.Element
+	size    int64
+	evicted uint64
+
+	hub Hub
+}
+
+type entry struct {
+	history History
+	size    int64
+}
+
+// snapshot returns a copy of the call that stays valid while messages keep being appended.
+func (e *entry) snapshot() History {
+	h := e.history
+	h.Messages = slices.Clone(h.Messages)
+	return h
+}
+
+// NewDefaultRegistry creates an in-memory registry bounded by cfg.
+func NewDefaultRegistry(cfg Config) *DefaultRegistry {
+	return &DefaultRegistry{cfg: cfg}
+}
+
+func (r *DefaultRegistry) init() {
+	if r.entries == nil {
+		r.entries = list.New()
+		r.index = map[string]*list.Element{}
+	}
+}
+
+func (r *DefaultRegistry) SaveHistory(h History) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.save(h)
+}
+
+// CreateHistory saves h unless its ID is already taken, atomically.
+func (r *DefaultRegistry) CreateHistory(h History) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.index[h.ID]; ok {
+		return false
+	}
+	r.save(h)
+	return true
+}
+
+func (r *DefaultRegistry) save(h History) {
+	// The registry owns its messages: AppendMessage must never write into a caller slice
+	h.Messages = r.truncateMessages(slices.Clone(h.Messages))
+	r.init()
+
+	var e *entry
+	previous := State("")
+	if el, ok := r.index[h.ID]; ok {
+		e = el.Value.(*entry)
+		previous = e.history.State
+		r.size -= e.size
+		e.history = h
+		e.size = historySize(h)
+		r.size += e.size
+	} else {
+		e = &entry{history: h, size: historySize(h)}
+		r.index[h.ID] = r.insertSorted(e)
+		r.size += e.size
+	}
+
+	// Only state transitions are notified, rewriting a closed call is silent
+	if h.State != previous && r.hub.HasSubscribers() {
+		switch h.State {
+		case StateOpen:
+			r.hub.Publish(Event{Type: EventCallOpened, History: e.snapshot()})
+		case StateClosed:
+			r.hub.Publish(Event{Type: EventCallClosed, History: e.snapshot()})
+		}
+	}
+	r.evict()
+}
+
+func (r *DefaultRegistry) AppendMessage(id string, m Message) {
+	if r.cfg.MaxPayloadBytes > 0 {
+		m = TruncateMessage(m, r.cfg.MaxPayloadBytes)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	el, ok := r.index[id]
+	if !ok {
+		return
+	}
+	e := el.Value.(*entry)
+	e.history.Messages = append(e.history.Messages, m)
+	size := messageSize(m)
+	e.size += size
+	r.size += size
+
+	if r.hub.HasSubscribers() {
+		header := e.history
+		header.Messages = nil
+		r.hub.Publish(Event{Type: EventMessage, History: header, Message: &m})
+	}
+	r.evict()
+}
+
+// UpdateHistory applies update to the stored call id. update reports whether it changed the call.
+func (r *DefaultRegistry) UpdateHistory(id string, update func(h *History) bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	el, ok := r.index[id]
+	if !ok {
+		return false
+	}
+	if !r.update(el.Value.(*entry), update) {
+		return false
+	}
+	r.evict()
+	return true
+}
+
+// UpdateHistories applies update to every stored call and returns the number of changed calls.
+func (r *DefaultRegistry) UpdateHistories(update func(h *History) bool) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+
+	n := 0
+	for el := r.entries.Front(); el != nil; el = el.Next() {
+		if r.update(el.Value.(*entry), update) {
+			n++
+		}
+	}
+	r.evict()
+	return n
+}
+
+func (r *DefaultRegistry) update(e *entry, update func(h *History) bool) bool {
+	if !update(&e.history) {
+		return false
+	}
+	e.history.Messages = r.truncateMessages(e.history.Messages)
+	r.size -= e.size
+	e.size = historySize(e.history)
+	r.size += e.size
+	return true
+}
+
+// Subscribe notifies calls opening, closing and receiving messages as they happen.
+func (r *DefaultRegistry) Subscribe(q Query, buffer int) *Subscription {
+	return r.hub.Subscribe(q, buffer)
+}
+
+// insertSorted inserts e keeping the list ordered by start time.
+// Calls are almost always saved in order, so the walk usually stops at the back.
+func (r *DefaultRegistry) insertSorted(e *entry) *list.Element {
+	for el := r.entries.Back(); el != nil; el = el.Prev() {
+		if !el.Value.(*entry).history.StartTime.After(e.history.StartTime) {
+			return r.entries.InsertAfter(e, el)
+		}
+	}
+	return r.entries.PushFront(e)
+}
+
+// evict drops the oldest calls until the registry fits in its bounds.
+func (r *DefaultRegistry) evict() {
+	var expiry time.Time
+	if r.cfg.MaxAge > 0 {
+		expiry = time.Now().Add(-r.cfg.MaxAge)
+	}
+	for r.entries.Len() > 0 &&
+		((r.cfg.MaxEntries > 0 && r.entries.Len() > r.cfg.MaxEntries) ||
+			(r.cfg.MaxBytes > 0 && r.size > r.cfg.MaxBytes) ||
+			(!expiry.IsZero() && r.entries.Front().Value.(*entry).history.StartTime.Before(expiry))) {
+		r.remove(r.entries.Front())
+		r.evicted++
+	}
+}
+
+func (r *DefaultRegistry) remove(el *list.Element) {
+	e := r.entries.Remove(el).(*entry)
+	delete(r.index, e.history.ID)
+	r.size -= e.size
+}
+
+func (r *DefaultRegistry) GetHistories() []History {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.entries == nil {
+		return []History{}
+	}
+	histories := make([]History, 0, r.entries.Len())
+	for el := r.entries.Front(); el != nil; el = el.Next() {
+		histories = append(histories, el.Value.(*entry).snapshot())
+	}
+	return histories
+}
+
+func (r *DefaultRegistry) GetHistory(id string) (History, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	el, ok := r.index[id]
+	if !ok {
+		return History{}, false
+	}
+	return el.Value.(*entry).snapshot(), true
+}
+
+func (r *DefaultRegistry) Query(q Query) Page {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	page := Page{Histories: []History{}}
+	if r.entries == nil {
+		return page
+	}
+	for el := r.cursorElement(q.Cursor); el != nil; el = el.Next() {
+		e := el.Value.(*entry)
+		if !q.Match(e.history) {
+			continue
+		}
+		if q.Limit > 0 && len(page.Histories) == q.Limit {
+			page.NextCursor = encodeCursor(page.Histories[len(page.Histories)-1])
+			break
+		}
+		page.Histories = append(page.Histories, e.snapshot())
+	}
+	return page
+}
+
+// cursorElement returns the first element following the cursor.
+func (r *DefaultRegistry) cursorElement(cursor string) *list.Element {
+	if cursor == "" {
+		return r.entries.Front()
+	}
+	after, id, ok := decodeCursor(cursor)
+	if !ok {
+		return nil
+	}
+	if el, ok := r.index[id]; ok {
+		return el.Next()
+	}
+	// The pointed call is gone (deleted or evicted), resume from its start time
+	for el := r.entries.Front(); el != nil; el = el.Next() {
+		if el.Value.(*entry).history.StartTime.After(after) {
+			return el
+		}
+	}
+	return nil
+}
+
+func (r *DefaultRegistry) DeleteHistory(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	el, ok := r.index[id]
+	if !ok {
+		return false
+	}
+	r.remove(el)
+	return true
+}
+
+func (r *DefaultRegistry) Clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = nil
+	r.index = nil
+	r.size = 0
+	r.init()
+}
+
+// Stats describes the current occupancy of the registry.
+type Stats struct {
+	Entries int    `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+	Evicted uint64 `json:"evicted"`
+	Config
+}
+
+func (r *DefaultRegistry) Stats() Stats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	s := Stats{Bytes: r.size, Evicted: r.evicted, Config: r.cfg}
+	if r.entries != nil {
+		s.Entries = r.entries.Len()
+	}
+	return s
+}
+
+// truncateMessages applies the payload cap in place.
+func (r *DefaultRegistry) truncateMessages(messages []Message) []Message {
+	if r.cfg.MaxPayloadBytes <= 0 {
+		return messages
+	}
+	for i := range messages {
+		messages[i] = TruncateMessage(messages[i], r.cfg.MaxPayloadBytes)
+	}
+	return messages
+}
+
+// TruncateMessage cuts the payload of m to at most limit bytes and flags it as truncated.
+func TruncateMessage(m Message, limit int) Message {
+	if m.Truncated || len(m.PayloadString) <= limit {
+		return m
+	}
+	cut := limit
+	// Don't split a multi-byte character
+	for cut > 0 && !utf8.RuneStart(m.PayloadString[cut]) {
+		cut--
+	}
+	m.PayloadSize = len(m.PayloadString)
+	m.PayloadString = m.PayloadString[:cut]
+	m.Payload = nil
+	m.RawPayload = nil
+	m.Guessed = false
+	m.Truncated = true
+	return m
+}
+
+// entryOverhead is the approximate fixed cost of a call or a message in memory
+const entryOverhead = 256
+
+// historySize approximates the memory used by h. The decoded payload is assumed
+// to weigh as much as its string representation.
+func historySize(h History) int64 {
+	size := int64(entryOverhead + len(h.ID) + len(h.FullMethod) + len(h.GrpcMessage) + len(h.Session))
+	for _, t := range h.Tags {
+		size += int64(len(t))
+	}
+	for _, m := range h.Messages {
+		size += messageSize(m)
+	}
+	return size
+}
+
+func messageSize(m Message) int64 {
+	return entryOverhead + 2*int64(len(m.PayloadString)) + int64(len(m.RawPayload))
+}
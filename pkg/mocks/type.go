@@ -8,4 +8,20 @@ type MockConfig struct {
 	ErrorString  string                 `json:"errorString"`
 	Headers      map[string]string      `json:"headers"`
 	DelayMs      int                    `json:"delayMs"`
+	// Shadow also sends the call to the proxy backend and records how both answers differ
+	Shadow *ShadowConfig `json:"shadow,omitempty"`
+}
+
+// Sides of a shadowed call
+const (
+	ServeMock     = "mock"
+	ServeUpstream = "upstream"
+)
+
+// ShadowConfig configures the shadow mode of a mock. Only unary methods can be shadowed.
+type ShadowConfig struct {
+	// Serve is the side answering the client, ServeMock (default) or ServeUpstream
+	Serve string `json:"serve"`
+	// IgnoreFields are response fields left out of the comparison ("items.updatedAt")
+	IgnoreFields []string `json:"ignoreFields"`
 }
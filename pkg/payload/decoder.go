@@ -0,0 +1,189 @@
+package payload
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/drift"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/redact"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	DirectionRecv = "recv"
+	DirectionSend = "send"
+)
+
+// MethodResolver finds the descriptor of a method by its full name ("/pkg.Service/Method").
+// reflection.DescriptorRegistry implements it.
+type MethodResolver interface {
+	GetMethodDescriptor(fullName string) (protoreflect.MethodDescriptor, bool)
+}
+
+// Decoder turns the messages exchanged on a stream into their history representation.
+// Raw frames are decoded with the descriptors known at the time, and the ones that can't be
+// keep their bytes so that they can be decoded again once the descriptors are uploaded.
+// When payloads are redacted, those bytes are not published until they are decoded, the
+// redaction rules needing the descriptors.
+type Decoder struct {
+	methods  MethodResolver
+	redactor *redact.Redactor
+}
+
+// NewDecoder returns a Decoder resolving methods with methods and redacting payloads with redactor (optional).
+func NewDecoder(methods MethodResolver, redactor *redact.Redactor) *Decoder {
+	return &Decoder{methods: methods, redactor: redactor}
+}
+
+// Decode fills the payload fields of a history message. method is the descriptor of the
+// called method, nil when unknown.
+func (d *Decoder) Decode(method protoreflect.MethodDescriptor, direction string, payload any) history.Message {
+	msg := history.Message{Direction: direction}
+
+	switch m := payload.(type) {
+	case proto.Message:
+		m = d.redactor.Message(m)
+		b, err := protojson.Marshal(m)
+		if err != nil {
+			msg.PayloadString = "<invalid proto>"
+			break
+		}
+		msg.PayloadString = string(b)
+		msg.Recognized = true
+		msg.RawPayload, _ = proto.Marshal(m)
+
+		if _, ok := m.(*dynamicpb.Message); ok {
+			msg.Payload = unmarshalObject(b)
+		} else {
+			msg.Payload = m
+		}
+	case []byte:
+		if method != nil {
+			err := d.decodeRaw(method, &msg, m)
+			if err == nil {
+				break
+			}
+			// The registered descriptor doesn't match the message
+			msg.Drift = []string{fmt.Sprintf("undecodable as %s: %v", messageDescriptor(method, direction).FullName(), err)}
+		}
+		// Kept in memory to decode it later, once the matching descriptors are known,
+		// the redaction rules are applied then
+		msg.RawPayload = m
+		if d.redactor.RedactsPayloads() {
+			// Without descriptor, the field rules can't tell which parts to hide
+			break
+		}
+		msg.PayloadString = base64.StdEncoding.EncodeToString(m)
+		if fields, err := DecodeRaw(m, d.redactor.String); err == nil {
+			msg.Payload = fields
+			msg.Guessed = true
+		}
+	default:
+		if b, err := json.Marshal(m); err == nil {
+			msg.PayloadString = d.redactor.String(string(b))
+			msg.Payload = m
+			msg.Recognized = true
+		} else {
+			msg.PayloadString = "<invalid json>"
+		}
+	}
+	return msg
+}
+
+// Redecode decodes again the unrecognized messages of h with the current descriptors.
+// It reports whether at least one message has been decoded.
+func (d *Decoder) Redecode(h *history.History) bool {
+	var method protoreflect.MethodDescriptor
+	changed := false
+	for i := range h.Messages {
+		m := &h.Messages[i]
+		if m.Recognized || m.RawPayload == nil {
+			continue
+		}
+		if method == nil {
+			md, ok := d.methods.GetMethodDescriptor(h.FullMethod)
+			if !ok {
+				return false
+			}
+			method = md
+		}
+		if d.decodeRaw(method, m, m.RawPayload) == nil {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// decodeRaw decodes a raw frame into msg with the input or output type of method.
+// The raw bytes are kept unless redaction changed the message, the redacted bytes are kept then.
+// The parts of the message unknown to the descriptor are listed in msg.Drift.
+func (d *Decoder) decodeRaw(method protoreflect.MethodDescriptor, msg *history.Message, raw []byte) error {
+	dyn := dynamicpb.NewMessage(messageDescriptor(method, msg.Direction))
+	if err := proto.Unmarshal(raw, dyn); err != nil {
+		return err
+	}
+	issues := drift.Inspect(dyn)
+	redacted := d.redactor.Message(dyn)
+	if redacted != proto.Message(dyn) && !proto.Equal(redacted, dyn) {
+		var err error
+		if raw, err = proto.Marshal(redacted); err != nil {
+			return err
+		}
+	}
+	b, err := protojson.Marshal(redacted)
+	if err != nil {
+		return err
+	}
+	msg.PayloadString = string(b)
+	msg.Payload = unmarshalObject(b)
+	msg.RawPayload = raw
+	msg.Recognized = true
+	msg.Guessed = false
+	msg.Drift = issues
+	return nil
+}
+
+// Encode returns the wire bytes of a message recorded on fullMethod. Messages recorded without
+// their bytes, like the ones loaded from a history file, are encoded again from their JSON payload.
+func (d *Decoder) Encode(fullMethod string, m history.Message) ([]byte, error) {
+	if m.RawPayload != nil {
+		return m.RawPayload, nil
+	}
+	if m.Truncated {
+		return nil, errors.New("payload truncated")
+	}
+	if !m.Recognized {
+		return nil, errors.New("payload not recognized")
+	}
+	method, ok := d.methods.GetMethodDescriptor(fullMethod)
+	if !ok {
+		return nil, fmt.Errorf("method %s not found", fullMethod)
+	}
+	dyn := dynamicpb.NewMessage(messageDescriptor(method, m.Direction))
+	if err := protojson.Unmarshal([]byte(m.PayloadString), dyn); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(dyn)
+}
+
+// messageDescriptor returns the type of the messages received (request) or sent (response) by method.
+func messageDescriptor(method protoreflect.MethodDescriptor, direction string) protoreflect.MessageDescriptor {
+	if direction == DirectionRecv {
+		return method.Input()
+	}
+	return method.Output()
+}
+
+func unmarshalObject(b []byte) any {
+	var obj map[string]any
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return nil
+	}
+	return obj
+}
@@ -0,0 +1,101 @@
+package payload_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/payload"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/redact"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/reflection"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const greeterProto = `syntax = "proto3"; package example;
+message HelloRequest { string name = 1; }
+message HelloReply { string message = 1; }
+service Greeter { rpc SayHello(HelloRequest) returns (HelloReply); }`
+
+func TestDecoder_RedecodeAfterRegister(t *testing.T) {
+	// Descriptors of the sender, unknown to the decoder registry
+	sender := reflection.NewDefaultDescriptorRegistry()
+	if err := sender.RegisterProtoFile("greeter.proto", greeterProto); err != nil {
+		t.Fatalf("register proto failed: %v", err)
+	}
+	md, _ := sender.GetMessageDescriptor("example.HelloRequest")
+	req := dynamicpb.NewMessage(md)
+	if err := protojson.Unmarshal([]byte(`{"name":"Alice"}`), req); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	raw, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+
+	dr := reflection.NewDefaultDescriptorRegistry()
+	decoder := payload.NewDecoder(dr, nil)
+
+	msg := decoder.Decode(nil, payload.DirectionRecv, raw)
+	if msg.Recognized || msg.RawPayload == nil {
+		t.Fatalf("expected an unrecognized message keeping its bytes, got %+v", msg)
+	}
+
+	h := history.History{FullMethod: "/example.Greeter/SayHello", Messages: []history.Message{msg}}
+	if decoder.Redecode(&h) {
+		t.Fatal("nothing can be decoded before the proto is registered")
+	}
+
+	if err := dr.RegisterProtoFile("greeter.proto", greeterProto); err != nil {
+		t.Fatalf("register proto failed: %v", err)
+	}
+	if !decoder.Redecode(&h) {
+		t.Fatal("expected the message to be decoded")
+	}
+	got := h.Messages[0]
+	if !got.Recognized || string(got.RawPayload) != string(raw) {
+		t.Errorf("expected a recognized message keeping its bytes, got %+v", got)
+	}
+	if obj, ok := got.Payload.(map[string]any); !ok || obj["name"] != "Alice" {
+		t.Errorf("unexpected payload: %s", got.PayloadString)
+	}
+}
+
+func TestDecoder_RedecodeWithDefaultRules(t *testing.T) {
+	const loginProto = `syntax = "proto3"; package example;
+message LoginRequest { string user = 1; string password = 2 [debug_redact = true]; }
+service Auth { rpc Login(LoginRequest) returns (LoginRequest); }`
+	raw := []byte{0x0a, 0x05, 'a', 'l', 'i', 'c', 'e', 0x12, 0x06, 's', 'e', 'c', 'r', 'e', 't'}
+
+	redactor, err := redact.New(redact.DefaultRules())
+	if err != nil {
+		t.Fatalf("new redactor failed: %v", err)
+	}
+	dr := reflection.NewDefaultDescriptorRegistry()
+	decoder := payload.NewDecoder(dr, redactor)
+
+	msg := decoder.Decode(nil, payload.DirectionRecv, raw)
+	if msg.Recognized || msg.RawPayload == nil {
+		t.Fatalf("expected an unrecognized message keeping its bytes, got %+v", msg)
+	}
+	if msg.PayloadString != "" || msg.Payload != nil {
+		t.Errorf("nothing must be published before the rules can apply, got %q %+v", msg.PayloadString, msg.Payload)
+	}
+
+	if err := dr.RegisterProtoFile("login.proto", loginProto); err != nil {
+		t.Fatalf("register proto failed: %v", err)
+	}
+	h := history.History{FullMethod: "/example.Auth/Login", Messages: []history.Message{msg}}
+	if !decoder.Redecode(&h) {
+		t.Fatal("expected the message to be decoded")
+	}
+	got := h.Messages[0]
+	obj, _ := got.Payload.(map[string]any)
+	if !got.Recognized || obj["user"] != "alice" || obj["password"] != redact.Placeholder {
+		t.Errorf("expected a decoded and redacted message, got %s", got.PayloadString)
+	}
+	if strings.Contains(string(got.RawPayload), "secret") {
+		t.Errorf("the kept bytes must be redacted once decoded, got %q", got.RawPayload)
+	}
+}
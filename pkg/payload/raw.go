@@ -0,0 +1,151 @@
+package payload
+
+import (
+	"encoding/base64"
+	"errors"
+	"unicode"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// maxRawDepth bounds the nesting of guessed sub-messages
+const maxRawDepth = 32
+
+// Guesses made on length-delimited values
+const (
+	GuessMessage = "message"
+	GuessString  = "string"
+	GuessPacked  = "packed"
+	GuessBytes   = "bytes"
+)
+
+// RawField is a field decoded without schema, like `protoc --decode_raw` does.
+//
+// Value holds the varint or fixed value, the string, or the base64 of the bytes.
+// Length-delimited values are ambiguous on the wire: Guess tells how they were interpreted.
+type RawField struct {
+	Number   int32      `json:"number"`
+	WireType string     `json:"wire_type"` // "varint", "fixed64", "bytes", "fixed32" or "group"
+	Guess    string     `json:"guess,omitempty"`
+	Value    any        `json:"value,omitempty"`
+	Message  []RawField `json:"message,omitempty"`
+	Packed   []uint64   `json:"packed,omitempty"`
+}
+
+var errInvalidWire = errors.New("invalid protobuf wire format")
+
+// DecodeRaw decodes b without schema, returning its fields in wire order.
+// Strings are passed to redact (optional) before being exposed.
+func DecodeRaw(b []byte, redact func(string) string) ([]RawField, error) {
+	return decodeRaw(b, redact, 0)
+}
+
+func decodeRaw(b []byte, redact func(string) string, depth int) ([]RawField, error) {
+	fields := []RawField{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 || !num.IsValid() {
+			return nil, errInvalidWire
+		}
+		b = b[n:]
+		f := RawField{Number: int32(num)}
+
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, errInvalidWire
+			}
+			f.WireType, f.Value = "varint", v
+			b = b[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return nil, errInvalidWire
+			}
+			f.WireType, f.Value = "fixed64", v
+			b = b[n:]
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			if n < 0 {
+				return nil, errInvalidWire
+			}
+			f.WireType, f.Value = "fixed32", v
+			b = b[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, errInvalidWire
+			}
+			f.WireType = "bytes"
+			guessBytes(&f, v, redact, depth)
+			b = b[n:]
+		case protowire.StartGroupType:
+			v, n := protowire.ConsumeGroup(num, b)
+			if n < 0 || depth >= maxRawDepth {
+				return nil, errInvalidWire
+			}
+			sub, err := decodeRaw(v, redact, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			f.WireType, f.Message = "group", sub
+			b = b[n:]
+		default:
+			return nil, errInvalidWire
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// guessBytes interprets a length-delimited value, trying in order a sub-message,
+// a printable string, packed varints and finally plain bytes.
+func guessBytes(f *RawField, v []byte, redact func(string) string, depth int) {
+	if len(v) > 0 && depth < maxRawDepth {
+		if sub, err := decodeRaw(v, redact, depth+1); err == nil {
+			f.Guess, f.Message = GuessMessage, sub
+			return
+		}
+	}
+	if isPrintable(v) {
+		s := string(v)
+		if redact != nil {
+			s = redact(s)
+		}
+		f.Guess, f.Value = GuessString, s
+		return
+	}
+	if packed, ok := decodePacked(v); ok {
+		f.Guess, f.Packed = GuessPacked, packed
+		return
+	}
+	f.Guess, f.Value = GuessBytes, base64.StdEncoding.EncodeToString(v)
+}
+
+func isPrintable(v []byte) bool {
+	if !utf8.Valid(v) {
+		return false
+	}
+	for _, r := range string(v) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func decodePacked(v []byte) ([]uint64, bool) {
+	var res []uint64
+	for len(v) > 0 {
+		x, n := protowire.ConsumeVarint(v)
+		if n < 0 || (n > 1 && x < 1<<(7*(n-1))) {
+			// Truncated, or not minimally encoded: unlikely to be written by an encoder
+			return nil, false
+		}
+		res = append(res, x)
+		v = v[n:]
+	}
+	return res, len(res) > 0
+}
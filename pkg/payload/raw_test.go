@@ -0,0 +1,77 @@
+package payload_test
+
+import (
+	"testing"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/payload"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/redact"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestDecodeRaw(t *testing.T) {
+	var nested []byte
+	nested = protowire.AppendTag(nested, 1, protowire.VarintType)
+	nested = protowire.AppendVarint(nested, 150)
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, "hello world")
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendBytes(b, nested)
+	b = protowire.AppendTag(b, 3, protowire.Fixed32Type)
+	b = protowire.AppendFixed32(b, 7)
+	b = protowire.AppendTag(b, 4, protowire.BytesType)
+	b = protowire.AppendBytes(b, []byte{0x01, 0x96, 0x01, 0x03})
+
+	fields, err := payload.DecodeRaw(b, nil)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if len(fields) != 4 {
+		t.Fatalf("expected 4 fields, got %+v", fields)
+	}
+	if f := fields[0]; f.Guess != payload.GuessString || f.Value != "hello world" {
+		t.Errorf("field 1 should be a string, got %+v", f)
+	}
+	if f := fields[1]; f.Guess != payload.GuessMessage || len(f.Message) != 1 || f.Message[0].Value != uint64(150) {
+		t.Errorf("field 2 should be a message, got %+v", f)
+	}
+	if f := fields[2]; f.WireType != "fixed32" || f.Value != uint32(7) {
+		t.Errorf("field 3 should be a fixed32, got %+v", f)
+	}
+	if f := fields[3]; f.Guess != payload.GuessPacked || len(f.Packed) != 3 || f.Packed[1] != 150 {
+		t.Errorf("field 4 should be packed varints, got %+v", f)
+	}
+
+	if _, err := payload.DecodeRaw([]byte{0x0a, 0x05, 'a'}, nil); err == nil {
+		t.Error("expected an error on a truncated payload")
+	}
+}
+
+func TestDecoder_GuessUnknownMethod(t *testing.T) {
+	decoder := payload.NewDecoder(nil, nil)
+	msg := decoder.Decode(nil, payload.DirectionRecv, []byte{0x08, 0x2a})
+	if msg.Recognized || !msg.Guessed {
+		t.Fatalf("expected a guessed message, got %+v", msg)
+	}
+	fields, ok := msg.Payload.([]payload.RawField)
+	if !ok || len(fields) != 1 || fields[0].Number != 1 || fields[0].Value != uint64(42) {
+		t.Errorf("unexpected guess %+v", msg.Payload)
+	}
+}
+
+func TestDecoder_RedactedUnknownMethod(t *testing.T) {
+	redactor, err := redact.New(redact.Rules{FieldPaths: []string{"password"}})
+	if err != nil {
+		t.Fatalf("new redactor failed: %v", err)
+	}
+	decoder := payload.NewDecoder(nil, redactor)
+	// Field 1 holds the string "secret"
+	msg := decoder.Decode(nil, payload.DirectionRecv, []byte{0x0a, 0x06, 's', 'e', 'c', 'r', 'e', 't'})
+	if msg.PayloadString != "" || msg.RawPayload == nil {
+		t.Errorf("expected the bytes to be kept unpublished, got %q %x", msg.PayloadString, msg.RawPayload)
+	}
+	if msg.Payload != nil || msg.Guessed {
+		t.Errorf("expected no guessed payload, got %+v", msg.Payload)
+	}
+}
@@ -0,0 +1,221 @@
+// Package protodir keeps a descriptor registry in sync with the .proto files of local directories.
+package protodir
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/reflection"
+)
+
+// stagingBatch is the batch the changed files are staged in, apart from the uploads
+const stagingBatch = "proto_dir"
+
+// Watcher loads the .proto files found under its directories and compiles them again when they change.
+// Files are registered by their path relative to the first import path holding them, or else to
+// their directory. Changes are detected by polling.
+type Watcher struct {
+	registry reflection.DescriptorRegistry
+	dirs     []string
+	// ImportPaths are the import roots of the files, like the -I option of protoc.
+	// They must be set before Load.
+	ImportPaths []string
+	// OnReload is called after each successful compilation of changed files
+	OnReload func()
+
+	// files holds the content last loaded, by import path
+	files map[string]string
+	// registered holds the files the watcher compiled successfully, the only ones it unregisters
+	registered map[string]bool
+	// failed holds the files discarded by the last failed compilation, staged again with the next change
+	failed map[string]bool
+}
+
+// New returns a watcher of dirs, the first directory wins when several hold the same import path.
+func New(registry reflection.DescriptorRegistry, dirs []string) *Watcher {
+	return &Watcher{registry: registry, dirs: dirs, files: map[string]string{}, registered: map[string]bool{}}
+}
+
+// Load ingests and compiles the .proto files of the directories, then calls OnReload.
+// A compilation error is returned, the files are then compiled again with the next change.
+func (w *Watcher) Load() error {
+	changed, err := w.Sync()
+	if changed && w.OnReload != nil {
+		w.OnReload()
+	}
+	return err
+}
+
+// Run polls the directories every interval until ctx is done. Compilation errors are logged,
+// the last successfully compiled schema stays registered meanwhile.
+func (w *Watcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := w.Sync()
+			if err != nil {
+				log.Printf("warning: proto directories: %v", err)
+			} else if changed && w.OnReload != nil {
+				w.OnReload()
+			}
+		}
+	}
+}
+
+// Sync applies the changes of the directories since the previous call: changed and new files are
+// ingested and compiled, removed ones are unregistered along with the files importing them.
+// A removed file still imported by files registered otherwise, uploaded for instance, stays registered.
+// It reports whether anything changed.
+func (w *Watcher) Sync() (bool, error) {
+	current, err := w.scan()
+	if err != nil {
+		return false, err
+	}
+
+	var removed []string
+	for path := range w.files {
+		if _, ok := current[path]; !ok {
+			removed = append(removed, path)
+		}
+	}
+	sort.Strings(removed)
+	for _, path := range removed {
+		delete(w.files, path)
+		if !w.registered[path] {
+			// Never compiled, or already removed as dependent of a previous file
+			continue
+		}
+		delete(w.registered, path)
+		paths, err := w.unregister(path)
+		if err != nil {
+			log.Printf("warning: proto removed from directory stays registered: %v", err)
+			continue
+		}
+		// Dependents still in the directory are staged again below, and until their import is back
+		for _, p := range paths {
+			delete(w.files, p)
+			delete(w.registered, p)
+		}
+		log.Printf("proto removed from directory: %s", strings.Join(paths, ", "))
+	}
+
+	var changed []string
+	for path, content := range current {
+		if previous, ok := w.files[path]; !ok || previous != content {
+			changed = append(changed, path)
+		}
+	}
+	if len(changed) == 0 {
+		return len(removed) > 0, nil
+	}
+	sort.Strings(changed)
+	log.Printf("proto changed in directory: %s", strings.Join(changed, ", "))
+
+	// A failed compilation discards all its files, the unchanged ones are staged again
+	staged := map[string]bool{}
+	for _, path := range changed {
+		w.files[path] = current[path]
+		staged[path] = true
+	}
+	for path := range w.failed {
+		if _, ok := current[path]; ok {
+			staged[path] = true
+		}
+	}
+	for path := range staged {
+		w.registry.StageProtoFile(stagingBatch, path, current[path])
+	}
+	if _, err := w.registry.CompileBatch(stagingBatch); err != nil {
+		w.failed = staged
+		return false, err
+	}
+	for path := range staged {
+		w.registered[path] = true
+	}
+	w.failed = nil
+	return true, nil
+}
+
+// unregister removes path along with the files importing it, provided the watcher registered them all.
+func (w *Watcher) unregister(path string) ([]string, error) {
+	paths, err := w.registry.UnregisterFile(path, false)
+	var dependentsErr *reflection.DependentsError
+	if !errors.As(err, &dependentsErr) {
+		return paths, err
+	}
+	for _, dependent := range dependentsErr.Dependents {
+		if !w.registered[dependent] {
+			return nil, err
+		}
+	}
+	return w.registry.UnregisterFile(path, true)
+}
+
+// scan reads the .proto files of the directories by import path.
+func (w *Watcher) scan() (map[string]string, error) {
+	roots := make([]string, 0, len(w.ImportPaths))
+	for _, root := range w.ImportPaths {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, abs)
+	}
+	files := map[string]string{}
+	for _, dir := range w.dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !strings.HasSuffix(d.Name(), ".proto") {
+				return nil
+			}
+			importPath, err := resolveImportPath(roots, dir, path)
+			if err != nil {
+				return err
+			}
+			if _, exists := files[importPath]; exists {
+				return nil
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			files[importPath] = string(content)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// resolveImportPath returns the path of file relative to the first of roots holding it, or else to dir.
+func resolveImportPath(roots []string, dir, file string) (string, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	for _, root := range roots {
+		if rel, err := filepath.Rel(root, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.ToSlash(rel), nil
+		}
+	}
+	rel, err := filepath.Rel(dir, file)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
@@ -0,0 +1,162 @@
+package protodir_test
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/protodir"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/reflection"
+)
+
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "api/common.proto", `syntax = "proto3"; package common; message User { string name = 1; }`)
+	writeFile(t, dir, "api/svc.proto", `syntax = "proto3"; package svc; import "api/common.proto";
+service Users { rpc Get(common.User) returns (common.User); }`)
+	writeFile(t, dir, "README.md", "not a proto")
+
+	registry := reflection.NewDefaultDescriptorRegistry()
+	w := protodir.New(registry, []string{dir})
+	if err := w.Load(); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if _, ok := registry.GetMethodDescriptor("/svc.Users/Get"); !ok {
+		t.Fatal("/svc.Users/Get must be registered")
+	}
+
+	if changed, err := w.Sync(); changed || err != nil {
+		t.Errorf("expected no change, got %v, %v", changed, err)
+	}
+
+	writeFile(t, dir, "api/common.proto", `syntax = "proto3"; package common; message User { string name = 1; string email = 2; }`)
+	if changed, err := w.Sync(); !changed || err != nil {
+		t.Fatalf("expected a change, got %v, %v", changed, err)
+	}
+	md, _ := registry.GetMessageDescriptor("common.User")
+	if md.Fields().ByName("email") == nil {
+		t.Error("expected the changed User message")
+	}
+
+	// A broken file keeps the last good schema
+	writeFile(t, dir, "api/common.proto", `syntax = "proto3"; package common; message User {`)
+	if _, err := w.Sync(); err == nil {
+		t.Error("expected a compile error")
+	}
+	if md, ok := registry.GetMessageDescriptor("common.User"); !ok || md.Fields().ByName("email") == nil {
+		t.Error("the last good schema must stay registered")
+	}
+
+	// Removed files are unregistered with the files importing them
+	writeFile(t, dir, "api/common.proto", `syntax = "proto3"; package common; message User { string name = 1; }`)
+	if err := os.Remove(filepath.Join(dir, "api/svc.proto")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if changed, err := w.Sync(); !changed || err != nil {
+		t.Fatalf("expected a change, got %v, %v", changed, err)
+	}
+	if _, ok := registry.GetMethodDescriptor("/svc.Users/Get"); ok {
+		t.Error("/svc.Users/Get must be unregistered")
+	}
+	if _, ok := registry.GetMessageDescriptor("common.User"); !ok {
+		t.Error("common.User must stay registered")
+	}
+
+	// Files discarded by a failed compilation are compiled again with the fix
+	writeFile(t, dir, "api/dep.proto", `syntax = "proto3"; package dep; message Dep {`)
+	writeFile(t, dir, "api/user.proto", `syntax = "proto3"; package user; import "api/dep.proto"; message U { dep.Dep d = 1; }`)
+	if _, err := w.Sync(); err == nil {
+		t.Error("expected a compile error")
+	}
+	writeFile(t, dir, "api/dep.proto", `syntax = "proto3"; package dep; message Dep {}`)
+	if changed, err := w.Sync(); !changed || err != nil {
+		t.Fatalf("expected a change, got %v, %v", changed, err)
+	}
+	if _, ok := registry.GetMessageDescriptor("user.U"); !ok {
+		t.Error("user.U must be registered once its import is fixed")
+	}
+
+	// Dependents of a removed file are registered again once it's restored
+	if err := os.Remove(filepath.Join(dir, "api/dep.proto")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := w.Sync(); err == nil {
+		t.Error("expected a compile error for the files importing the removed one")
+	}
+	if _, ok := registry.GetMessageDescriptor("user.U"); ok {
+		t.Error("user.U must be unregistered with its import")
+	}
+	writeFile(t, dir, "api/dep.proto", `syntax = "proto3"; package dep; message Dep {}`)
+	if changed, err := w.Sync(); !changed || err != nil {
+		t.Fatalf("expected a change, got %v, %v", changed, err)
+	}
+	if _, ok := registry.GetMessageDescriptor("user.U"); !ok {
+		t.Error("user.U must be registered again once its import is restored")
+	}
+}
+
+func TestWatcher_ImportPaths(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "shared/common.proto", `syntax = "proto3"; package common; message User {}`)
+	writeFile(t, root, "api/svc.proto", `syntax = "proto3"; package svc; import "shared/common.proto";
+service Users { rpc Get(common.User) returns (common.User); }`)
+
+	registry := reflection.NewDefaultDescriptorRegistry()
+	w := protodir.New(registry, []string{filepath.Join(root, "api"), filepath.Join(root, "shared")})
+	w.ImportPaths = []string{root}
+	if err := w.Load(); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	var paths []string
+	for _, fd := range registry.GetFileDescriptors() {
+		if !reflection.IsBuiltinFile(fd) {
+			paths = append(paths, fd.Path())
+		}
+	}
+	sort.Strings(paths)
+	if strings.Join(paths, ",") != "api/svc.proto,shared/common.proto" {
+		t.Errorf("expected the files registered by their path under the import root, got %v", paths)
+	}
+}
+
+// Test that removing a file doesn't unregister the files uploaded otherwise which import it
+func TestWatcher_RemoveImportedByUpload(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "common.proto", `syntax = "proto3"; package common; message User {}`)
+
+	registry := reflection.NewDefaultDescriptorRegistry()
+	w := protodir.New(registry, []string{dir})
+	if err := w.Load(); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if err := registry.RegisterProtoFile("team.proto", `syntax = "proto3"; package team; import "common.proto";
+message Team { repeated common.User members = 1; }`); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "common.proto")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := w.Sync(); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if _, ok := registry.GetMessageDescriptor("team.Team"); !ok {
+		t.Error("the uploaded file must stay registered")
+	}
+	if _, ok := registry.GetMessageDescriptor("common.User"); !ok {
+		t.Error("the removed file must stay registered while uploaded files import it")
+	}
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// CallResult is the outcome of a call made by Proxy.Call.
+type CallResult struct {
+	Header    metadata.MD
+	Trailer   metadata.MD
+	Responses [][]byte
+	Status    *status.Status
+}
+
+// Call sends the raw requests on fullMethod with md, half-closes, and collects every response
+// until the upstream ends the call. Failures of the call itself are reported in the result status.
+func (p *Proxy) Call(ctx context.Context, fullMethod string, md metadata.MD, requests [][]byte) CallResult {
+	ctx = metadata.NewOutgoingContext(ctx, ForwardableMetadata(md))
+	desc := &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}
+
+	var res CallResult
+	stream, err := p.conn.NewStream(ctx, desc, fullMethod)
+	if err != nil {
+		res.Status = status.Convert(err)
+		return res
+	}
+	for _, req := range requests {
+		if err := stream.SendMsg(req); err != nil {
+			// The upstream ended the call, its status is read below
+			break
+		}
+	}
+	_ = stream.CloseSend()
+
+	res.Header, _ = stream.Header()
+	for {
+		var msg []byte
+		err := stream.RecvMsg(&msg)
+		if errors.Is(err, io.EOF) {
+			res.Status = status.New(codes.OK, "")
+			break
+		}
+		if err != nil {
+			res.Status = status.Convert(err)
+			break
+		}
+		res.Responses = append(res.Responses, msg)
+	}
+	res.Trailer = stream.Trailer()
+	return res
+}
+
+// Close releases the connection to the upstream.
+func (p *Proxy) Close() error {
+	if c, ok := p.conn.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -3,12 +3,14 @@ package proxy
 import (
 	"fmt"
 	"io"
+	"strings"
 
 	_ "google.golang.org/grpc/encoding/proto"
 	"google.golang.org/grpc/grpclog"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 )
 
 // Proxy forwards gRPC calls to an upstream backend server when no mock is configured.
@@ -31,12 +33,25 @@ func New(target string, opts ...grpc.DialOption) (*Proxy, error) {
 	return &Proxy{conn: conn}, nil
 }
 
+// UpstreamMetadataRecorder is implemented by server streams interested in the metadata
+// sent back by the upstream. Handle calls it before forwarding headers and trailers to the client.
+type UpstreamMetadataRecorder interface {
+	RecordUpstreamHeader(metadata.MD)
+	RecordUpstreamTrailer(metadata.MD)
+}
+
 // Handle inspects the first message to decide between unary or streaming proxying.
 func (p *Proxy) Handle(_ interface{}, serverStream grpc.ServerStream) error {
 	fullMethod, _ := grpc.MethodFromServerStream(serverStream)
 
+	ctx := serverStream.Context()
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		ctx = metadata.NewOutgoingContext(ctx, ForwardableMetadata(md))
+	}
+	recorder, _ := serverStream.(UpstreamMetadataRecorder)
+
 	desc := &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}
-	targetStream, err := p.conn.NewStream(serverStream.Context(), desc, fullMethod, grpc.WaitForReady(true))
+	targetStream, err := p.conn.NewStream(ctx, desc, fullMethod, grpc.WaitForReady(true))
 	if err != nil {
 		return fmt.Errorf("proxy new stream: %w", err)
 	}
@@ -59,6 +74,8 @@ func (p *Proxy) Handle(_ interface{}, serverStream grpc.ServerStream) error {
 					if grpclog.V(2) {
 						grpclog.Infof("[proxy] EOF from client")
 					}
+					// Propagate the half-close so that client-streaming upstreams can answer
+					_ = targetStream.CloseSend()
 				}
 				errCh <- err
 				return
@@ -83,9 +100,27 @@ func (p *Proxy) Handle(_ interface{}, serverStream grpc.ServerStream) error {
 
 	// Target -> client
 	go func() {
+		// Blocks until the upstream answers, headers must reach the client before any message
+		if header, err := targetStream.Header(); err == nil {
+			header = ForwardableMetadata(header)
+			if recorder != nil {
+				recorder.RecordUpstreamHeader(header)
+			}
+			if len(header) > 0 {
+				if err := serverStream.SendHeader(header); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}
 		for {
 			var msg []byte
 			if err := targetStream.RecvMsg(&msg); err != nil {
+				trailer := ForwardableMetadata(targetStream.Trailer())
+				if recorder != nil {
+					recorder.RecordUpstreamTrailer(trailer)
+				}
+				serverStream.SetTrailer(trailer)
 				if err != io.EOF {
 					if grpclog.V(2) {
 						grpclog.Infof("[proxy] Error while recv message from target %v", err)
@@ -121,6 +156,26 @@ func (p *Proxy) Handle(_ interface{}, serverStream grpc.ServerStream) error {
 	if firstErr != nil && firstErr != io.EOF {
 		return firstErr
 	}
-	<-errCh
+	// The client is done, the upstream status (possibly an error) is the call outcome
+	if secondErr := <-errCh; secondErr != nil && secondErr != io.EOF {
+		return secondErr
+	}
 	return nil
 }
+
+// ForwardableMetadata returns a copy of md without the pseudo and reserved headers
+// managed by the gRPC transport itself.
+func ForwardableMetadata(md metadata.MD) metadata.MD {
+	res := metadata.MD{}
+	for k, v := range md {
+		if strings.HasPrefix(k, ":") || strings.HasPrefix(k, "grpc-") {
+			continue
+		}
+		switch k {
+		case "content-type", "user-agent", "te", "host":
+			continue
+		}
+		res[k] = append([]string(nil), v...)
+	}
+	return res
+}
@@ -0,0 +1,110 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// serveProxy starts upstream and a proxy in front of it, and returns a client of the proxy.
+func serveProxy(t *testing.T, upstream grpc.StreamHandler) *grpc.ClientConn {
+	t.Helper()
+	codec := proxy.NewDefaultMultiplexCodec()
+	listen := func(srv *grpc.Server) string {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		go func() { _ = srv.Serve(lis) }()
+		t.Cleanup(srv.Stop)
+		return lis.Addr().String()
+	}
+
+	upstreamAddr := listen(grpc.NewServer(grpc.ForceServerCodecV2(codec), grpc.UnknownServiceHandler(upstream)))
+	p, err := proxy.New(upstreamAddr)
+	if err != nil {
+		t.Fatalf("proxy: %v", err)
+	}
+	proxyAddr := listen(grpc.NewServer(grpc.ForceServerCodecV2(codec), grpc.UnknownServiceHandler(p.Handle)))
+
+	conn, err := grpc.NewClient(proxyAddr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodecV2(codec)),
+	)
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestHandle_ForwardsMetadataAndStatus(t *testing.T) {
+	conn := serveProxy(t, func(_ any, stream grpc.ServerStream) error {
+		var req []byte
+		if err := stream.RecvMsg(&req); err != nil {
+			return err
+		}
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		if got := md.Get("x-request"); len(got) != 1 || got[0] != "r" {
+			return status.Errorf(codes.InvalidArgument, "metadata not forwarded: %v", md)
+		}
+		return status.Error(codes.FailedPrecondition, "boom")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-request", "r")
+	var resp []byte
+	err := conn.Invoke(ctx, "/example.Greeter/SayHello", []byte{}, &resp)
+	if st := status.Convert(err); st.Code() != codes.FailedPrecondition || st.Message() != "boom" {
+		t.Errorf("expected the upstream status, got %v", err)
+	}
+}
+
+func TestHandle_ForwardsHalfClose(t *testing.T) {
+	// Client streaming upstream, answering once the client is done
+	conn := serveProxy(t, func(_ any, stream grpc.ServerStream) error {
+		count := 0
+		for {
+			var req []byte
+			if err := stream.RecvMsg(&req); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			count++
+		}
+		return stream.SendMsg([]byte{0x08, byte(count)})
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true}, "/example.Counter/Count")
+	if err != nil {
+		t.Fatalf("new stream: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := stream.SendMsg([]byte{}); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("close send: %v", err)
+	}
+	var resp []byte
+	if err := stream.RecvMsg(&resp); err != nil {
+		t.Fatalf("expected the upstream answer after the half-close, got %v", err)
+	}
+	if len(resp) != 2 || resp[1] != 3 {
+		t.Errorf("unexpected answer %x", resp)
+	}
+}
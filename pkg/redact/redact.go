@@ -0,0 +1,253 @@
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Placeholder replaces redacted string values.
+const Placeholder = "[REDACTED]"
+
+// Rules describes the sensitive data hidden from the history.
+type Rules struct {
+	// MetadataKeys lists metadata keys (case insensitive) whose values are redacted
+	MetadataKeys []string `json:"metadataKeys"`
+	// FieldPaths lists proto fields to redact, either by full name ("example.User.email")
+	// or by path of field names from the message root ("user.email")
+	FieldPaths []string `json:"fieldPaths"`
+	// DebugRedact redacts the fields carrying the [debug_redact = true] option
+	DebugRedact bool `json:"debugRedact"`
+	// Patterns are regular expressions whose matches are redacted in every string value
+	Patterns []string `json:"patterns"`
+}
+
+// DefaultRules hides credentials commonly carried by metadata and honours debug_redact.
+func DefaultRules() Rules {
+	return Rules{
+		MetadataKeys: []string{"authorization", "cookie", "set-cookie", "proxy-authorization", "x-api-key"},
+		DebugRedact:  true,
+	}
+}
+
+// Redactor applies Rules to messages, metadata and strings.
+// A nil Redactor redacts nothing.
+type Redactor struct {
+	mu           sync.RWMutex
+	rules        Rules
+	metadataKeys map[string]struct{}
+	fieldPaths   map[string]struct{}
+	patterns     []*regexp.Regexp
+}
+
+// New returns a Redactor applying rules.
+func New(rules Rules) (*Redactor, error) {
+	r := &Redactor{}
+	if err := r.SetRules(rules); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SetRules validates and atomically replaces the rules.
+func (r *Redactor) SetRules(rules Rules) error {
+	patterns := make([]*regexp.Regexp, 0, len(rules.Patterns))
+	for _, p := range rules.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+		patterns = append(patterns, re)
+	}
+	metadataKeys := map[string]struct{}{}
+	for _, k := range rules.MetadataKeys {
+		metadataKeys[strings.ToLower(k)] = struct{}{}
+	}
+	fieldPaths := map[string]struct{}{}
+	for _, p := range rules.FieldPaths {
+		fieldPaths[p] = struct{}{}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rules = rules
+	r.metadataKeys = metadataKeys
+	r.fieldPaths = fieldPaths
+	r.patterns = patterns
+	return nil
+}
+
+// Rules returns the rules currently applied.
+func (r *Redactor) Rules() Rules {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.rules
+}
+
+// RedactsPayloads reports whether the rules may hide parts of the payloads. Without the descriptor
+// of a message they can't be applied, so its raw bytes must not be kept.
+func (r *Redactor) RedactsPayloads() bool {
+	if r == nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.rules.FieldPaths) > 0 || len(r.rules.Patterns) > 0 || r.rules.DebugRedact
+}
+
+// String redacts the pattern matches in s.
+func (r *Redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.redactString(s)
+}
+
+func (r *Redactor) redactString(s string) string {
+	for _, re := range r.patterns {
+		s = re.ReplaceAllString(s, Placeholder)
+	}
+	return s
+}
+
+// Metadata returns a copy of md with the values of sensitive keys and the pattern matches redacted.
+func (r *Redactor) Metadata(md map[string][]string) map[string][]string {
+	if r == nil || md == nil {
+		return md
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	res := make(map[string][]string, len(md))
+	for k, values := range md {
+		redacted := make([]string, len(values))
+		_, sensitive := r.metadataKeys[strings.ToLower(k)]
+		for i, v := range values {
+			if sensitive {
+				redacted[i] = Placeholder
+			} else {
+				redacted[i] = r.redactString(v)
+			}
+		}
+		res[k] = redacted
+	}
+	return res
+}
+
+// Message returns m with sensitive fields redacted. m itself is left untouched:
+// when something has to be redacted, a redacted clone is returned.
+func (r *Redactor) Message(m proto.Message) proto.Message {
+	if r == nil || m == nil {
+		return m
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.fieldPaths) == 0 && len(r.patterns) == 0 && !r.rules.DebugRedact {
+		return m
+	}
+	clone := proto.Clone(m)
+	r.redactMessage(clone.ProtoReflect(), "")
+	return clone
+}
+
+// RedactInPlace redacts m directly, for messages owned by the caller.
+func (r *Redactor) RedactInPlace(m protoreflect.Message) {
+	if r == nil || m == nil {
+		return
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.redactMessage(m, "")
+}
+
+func (r *Redactor) redactMessage(m protoreflect.Message, path string) {
+	type field struct {
+		fd    protoreflect.FieldDescriptor
+		value protoreflect.Value
+		path  string
+	}
+	// Fields are collected first: the message must not be modified while ranging over it
+	var fields []field
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		fields = append(fields, field{fd: fd, value: v, path: joinPath(path, string(fd.Name()))})
+		return true
+	})
+
+	for _, f := range fields {
+		if r.isSensitive(f.fd, f.path) {
+			redactField(m, f.fd)
+			continue
+		}
+		switch {
+		case f.fd.IsMap():
+			valueDesc := f.fd.MapValue()
+			f.value.Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+				switch {
+				case valueDesc.Message() != nil:
+					r.redactMessage(v.Message(), f.path)
+				case valueDesc.Kind() == protoreflect.StringKind:
+					f.value.Map().Set(k, protoreflect.ValueOfString(r.redactString(v.String())))
+				}
+				return true
+			})
+		case f.fd.IsList():
+			list := f.value.List()
+			for i := 0; i < list.Len(); i++ {
+				switch {
+				case f.fd.Message() != nil:
+					r.redactMessage(list.Get(i).Message(), f.path)
+				case f.fd.Kind() == protoreflect.StringKind:
+					list.Set(i, protoreflect.ValueOfString(r.redactString(list.Get(i).String())))
+				}
+			}
+		case f.fd.Message() != nil:
+			r.redactMessage(f.value.Message(), f.path)
+		case f.fd.Kind() == protoreflect.StringKind:
+			m.Set(f.fd, protoreflect.ValueOfString(r.redactString(f.value.String())))
+		}
+	}
+}
+
+func (r *Redactor) isSensitive(fd protoreflect.FieldDescriptor, path string) bool {
+	if _, ok := r.fieldPaths[string(fd.FullName())]; ok {
+		return true
+	}
+	if _, ok := r.fieldPaths[path]; ok {
+		return true
+	}
+	if r.rules.DebugRedact {
+		if opts, ok := fd.Options().(*descriptorpb.FieldOptions); ok && opts.GetDebugRedact() {
+			return true
+		}
+	}
+	return false
+}
+
+// redactField replaces string values by the placeholder and clears any other kind of value.
+func redactField(m protoreflect.Message, fd protoreflect.FieldDescriptor) {
+	switch {
+	case fd.IsList() && fd.Kind() == protoreflect.StringKind:
+		list := m.Mutable(fd).List()
+		for i := 0; i < list.Len(); i++ {
+			list.Set(i, protoreflect.ValueOfString(Placeholder))
+		}
+	case !fd.IsList() && !fd.IsMap() && fd.Kind() == protoreflect.StringKind:
+		m.Set(fd, protoreflect.ValueOfString(Placeholder))
+	default:
+		m.Clear(fd)
+	}
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
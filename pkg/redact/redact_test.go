@@ -0,0 +1,131 @@
+package redact_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/redact"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/reflection"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const userProto = `syntax = "proto3"; package example;
+message Card { string number = 1; int32 cvv = 2; }
+message User {
+  string name = 1;
+  string email = 2;
+  string token = 3 [debug_redact = true];
+  Card card = 4;
+  repeated string notes = 5;
+}`
+
+func newUser(t *testing.T, json string) *dynamicpb.Message {
+	t.Helper()
+	dr := reflection.NewDefaultDescriptorRegistry()
+	if err := dr.RegisterProtoFile("user.proto", userProto); err != nil {
+		t.Fatalf("register proto failed: %v", err)
+	}
+	md, ok := dr.GetMessageDescriptor("example.User")
+	if !ok {
+		t.Fatal("example.User not registered")
+	}
+	m := dynamicpb.NewMessage(md)
+	if err := protojson.Unmarshal([]byte(json), m); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	return m
+}
+
+func TestRedactor_Message(t *testing.T) {
+	r, err := redact.New(redact.Rules{
+		FieldPaths:  []string{"example.User.email", "card.cvv"},
+		DebugRedact: true,
+		Patterns:    []string{`\b\d{4}-\d{4}-\d{4}-\d{4}\b`},
+	})
+	if err != nil {
+		t.Fatalf("new redactor: %v", err)
+	}
+
+	original := newUser(t, `{"name":"Alice","email":"alice@example.com","token":"secret","card":{"number":"4242-4242-4242-4242","cvv":123},"notes":["paid with 4242-4242-4242-4242"]}`)
+	redacted := r.Message(original)
+
+	b, err := protojson.Marshal(redacted)
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	var got struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+		Token string `json:"token"`
+		Card  struct {
+			Number string `json:"number"`
+			Cvv    *int   `json:"cvv"`
+		} `json:"card"`
+		Notes []string `json:"notes"`
+	}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+
+	if got.Name != "Alice" {
+		t.Errorf("name must be kept, got %q", got.Name)
+	}
+	if got.Email != redact.Placeholder {
+		t.Errorf("email redacted by full name, got %q", got.Email)
+	}
+	if got.Token != redact.Placeholder {
+		t.Errorf("token redacted by debug_redact, got %q", got.Token)
+	}
+	if got.Card.Cvv != nil {
+		t.Errorf("cvv redacted by path must be cleared, got %v", *got.Card.Cvv)
+	}
+	if got.Card.Number != redact.Placeholder {
+		t.Errorf("card number redacted by pattern, got %q", got.Card.Number)
+	}
+	if len(got.Notes) != 1 || got.Notes[0] != "paid with "+redact.Placeholder {
+		t.Errorf("pattern applied in repeated fields, got %v", got.Notes)
+	}
+
+	// The original message is sent on the wire, it must be left untouched
+	if email := original.Get(original.Descriptor().Fields().ByName("email")).String(); email != "alice@example.com" {
+		t.Errorf("original message modified: email=%q", email)
+	}
+}
+
+func TestRedactor_Metadata(t *testing.T) {
+	r, err := redact.New(redact.Rules{
+		MetadataKeys: []string{"Authorization"},
+		Patterns:     []string{`[\w.]+@[\w.]+`},
+	})
+	if err != nil {
+		t.Fatalf("new redactor: %v", err)
+	}
+	md := r.Metadata(map[string][]string{
+		"authorization": {"Bearer abc"},
+		"x-user":        {"user alice@example.com"},
+		"x-trace":       {"123"},
+	})
+	if md["authorization"][0] != redact.Placeholder {
+		t.Errorf("authorization not redacted: %v", md["authorization"])
+	}
+	if md["x-user"][0] != "user "+redact.Placeholder {
+		t.Errorf("pattern not applied: %v", md["x-user"])
+	}
+	if md["x-trace"][0] != "123" {
+		t.Errorf("unexpected redaction: %v", md["x-trace"])
+	}
+}
+
+func TestRedactor_InvalidPattern(t *testing.T) {
+	if _, err := redact.New(redact.Rules{Patterns: []string{"("}}); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+}
+
+func TestRedactor_Nil(t *testing.T) {
+	var r *redact.Redactor
+	if r.String("secret") != "secret" {
+		t.Error("nil redactor must be a no-op")
+	}
+}
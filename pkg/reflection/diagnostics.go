@@ -0,0 +1,92 @@
+package reflection
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bufbuild/protocompile/reporter"
+)
+
+// Severity of a Diagnostic
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Diagnostic is an error or a warning of the compiler, such as an unused import.
+// Line and Column are 1-based, and zero when the compiler gave no position.
+type Diagnostic struct {
+	Severity string `json:"severity"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Message  string `json:"message"`
+	// Snippet is the source line the diagnostic points to
+	Snippet string `json:"snippet,omitempty"`
+}
+
+func (d Diagnostic) String() string {
+	if d.File == "" {
+		return d.Message
+	}
+	if d.Line == 0 {
+		return d.File + ": " + d.Message
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, d.Message)
+}
+
+// CompileError is returned when the ingested files don't compile. It lists every diagnostic of the
+// compilation, warnings included.
+type CompileError struct {
+	Diagnostics []Diagnostic
+}
+
+func (e *CompileError) Error() string {
+	var msgs []string
+	for _, d := range e.Diagnostics {
+		if d.Severity == SeverityError {
+			msgs = append(msgs, d.String())
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// diagnosticsReporter collects the diagnostics of a compilation, without stopping at the first error.
+type diagnosticsReporter struct {
+	sources     map[string]string
+	diagnostics []Diagnostic
+}
+
+func (r *diagnosticsReporter) Error(err reporter.ErrorWithPos) error {
+	r.add(SeverityError, err)
+	return nil
+}
+
+func (r *diagnosticsReporter) Warning(err reporter.ErrorWithPos) {
+	r.add(SeverityWarning, err)
+}
+
+func (r *diagnosticsReporter) add(severity string, err reporter.ErrorWithPos) {
+	pos := err.GetPosition()
+	d := Diagnostic{
+		Severity: severity,
+		File:     pos.Filename,
+		Line:     pos.Line,
+		Column:   pos.Col,
+		Message:  err.Unwrap().Error(),
+	}
+	if lines := strings.Split(r.sources[pos.Filename], "\n"); pos.Line > 0 && pos.Line <= len(lines) {
+		d.Snippet = strings.TrimRight(lines[pos.Line-1], "\r")
+	}
+	r.diagnostics = append(r.diagnostics, d)
+}
+
+func (r *diagnosticsReporter) warnings() []Diagnostic {
+	warnings := []Diagnostic{}
+	for _, d := range r.diagnostics {
+		if d.Severity == SeverityWarning {
+			warnings = append(warnings, d)
+		}
+	}
+	return warnings
+}
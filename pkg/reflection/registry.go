@@ -2,14 +2,21 @@ package reflection
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/bufbuild/protocompile"
 	"github.com/bufbuild/protocompile/linker"
+	"github.com/bufbuild/protocompile/reporter"
+	"google.golang.org/protobuf/reflect/protodesc"
 	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
 )
 
 // This service transforms raw .proto definitions into fully linked FileDescriptor objects
@@ -22,17 +29,20 @@ import (
 // Usage patterns:
 //   • Quick load & register: ingest, compile, and register a single file in one call.
 //   • Batch processing: ingest multiple files first, then compile & register them all together.
-//   • Manual control: invoke load, compile, and register steps separately as needed.
 
 // For only one file :
 //   • RegisterProtoFile(name, src)
 //     Ingest, compile immediately, and register resulting descriptors.
 
 // Process multiple files :
-//   - IngestProtoFile(name, src)
-//     Store raw .proto source in memory for deferred compilation.
-//   - CompileAndRegister() error
-//     Compile all previously ingested sources in one go and register their descriptors.
+//   - StageProtoFile(batch, name, src)
+//     Stage raw .proto source in memory for deferred compilation.
+//   - CompileBatch(batch) ([]Diagnostic, error)
+//     Compile all previously staged sources in one go and register their descriptors.
+
+// Staged files are grouped in named batches, the default one being used by CompileAndRegister, so that
+// several clients can stage files at the same time. A batch compiles all or nothing: on failure its
+// files are discarded and the registered schema is left untouched.
 type DescriptorRegistry interface {
 	// GetMessageDescriptor returns the MessageDescriptor for a given fully-qualified name
 	GetMessageDescriptor(fullName string) (protoreflect.MessageDescriptor, bool)
@@ -43,170 +53,629 @@ type DescriptorRegistry interface {
 	// RegisterProtoFile ingests and compiles a single .proto file, registering its descriptors
 	RegisterProtoFile(filename, content string) error
 
-	// IngestProtoFile stores the raw .proto content without compiling
-	IngestProtoFile(filename, content string)
+	// StageProtoFile stages the raw .proto content in the named batch without compiling, replacing
+	// a staged file of the same name
+	StageProtoFile(batch, filename, content string)
 
-	// CompileAndRegister compiles all ingested proto files and registers their descriptors
+	// StagedFiles lists the staged files by batch name, then staging order
+	StagedFiles() []StagedFile
+
+	// DiscardStaged removes a staged file of batch, or the whole batch when filename is empty,
+	// and returns the discarded paths. ErrNotStaged is returned when nothing matches.
+	DiscardStaged(batch, filename string) ([]string, error)
+
+	// CompileAndRegister compiles the files of the default batch and registers their descriptors
 	CompileAndRegister() error
 
-	// Compile compiles all ingested proto files into linker.Files
-	Compile() (linker.Files, error)
+	// CompileBatch compiles the files staged in batch along with the registered sources, and registers
+	// them all or nothing. The batch is emptied either way. It returns the warnings of the compiler,
+	// or an error wrapping a *CompileError.
+	CompileBatch(batch string) ([]Diagnostic, error)
+
+	// UnregisterFile removes a registered file and returns the removed paths. The files importing it,
+	// directly or not, are removed along with it when cascade is set, otherwise a *DependentsError lists them.
+	UnregisterFile(filename string, cascade bool) ([]string, error)
 
-	// RegisterFiles adds the given FileDescriptors into the registry
-	RegisterFiles(fds linker.Files)
+	// PendingFiles lists the paths staged in any batch
+	PendingFiles() []string
+
+	// RegisterDescriptorSet registers already compiled files, as produced by protoc --descriptor_set_out
+	// or buf build, and returns their paths. Imports missing from the set are resolved among the
+	// registered files.
+	RegisterDescriptorSet(set *descriptorpb.FileDescriptorSet) ([]string, error)
 }
 
-type defaultDescriptorRegistry struct {
-	// raw .proto sources keyed by filename
-	protoFiles     map[string]string
-	protoFileNames []string
-	protoFilesMu   sync.RWMutex
+var (
+	// ErrFileNotFound is returned when unregistering a file which isn't registered
+	ErrFileNotFound = errors.New("file not registered")
+	// ErrBuiltinFile is returned when unregistering a well-known file
+	ErrBuiltinFile = errors.New("built-in files can't be unregistered")
+	// ErrNotStaged is returned when discarding a file or a batch which isn't staged
+	ErrNotStaged = errors.New("file not staged")
+)
 
-	// all FileDescriptors available for reflection
-	allFileDescriptors []protoreflect.FileDescriptor
-	allFileDescMu      sync.RWMutex
+// DefaultBatch is the staging batch of RegisterProtoFile and CompileAndRegister
+const DefaultBatch = "default"
+
+// StagedFile is a file waiting for the compilation of its batch.
+type StagedFile struct {
+	Batch    string
+	Filename string
+	Content  string
+}
+
+// stagedBatch holds the files of a staging batch, in staging order.
+type stagedBatch struct {
+	files map[string]string
+	names []string
+}
+
+func (b *stagedBatch) clone() *stagedBatch {
+	c := &stagedBatch{files: make(map[string]string, len(b.files)), names: append([]string(nil), b.names...)}
+	for name, content := range b.files {
+		c.files[name] = content
+	}
+	return c
+}
+
+// DependentsError is returned when unregistering a file still imported by other files.
+type DependentsError struct {
+	Filename   string
+	Dependents []string
+}
+
+func (e *DependentsError) Error() string {
+	return fmt.Sprintf("%s is imported by %s", e.Filename, strings.Join(e.Dependents, ", "))
+}
 
+// descriptorIndex is an immutable view of the registered files. It is rebuilt and swapped
+// as a whole on every change, so that readers never see a partially updated registry.
+type descriptorIndex struct {
+	// all FileDescriptors available for reflection
+	files []protoreflect.FileDescriptor
 	// mapping of message fullnames to their descriptors
-	messageDescriptorRegistry   map[string]protoreflect.MessageDescriptor
-	messageDescriptorRegistryMu sync.RWMutex
+	messages map[string]protoreflect.MessageDescriptor
+	// mapping of full method names (/package.Service/Method) to their descriptors
+	methods map[string]protoreflect.MethodDescriptor
+}
+
+func newDescriptorIndex(files []protoreflect.FileDescriptor) *descriptorIndex {
+	idx := &descriptorIndex{
+		files:    files,
+		messages: map[string]protoreflect.MessageDescriptor{},
+		methods:  map[string]protoreflect.MethodDescriptor{},
+	}
+	for _, fd := range files {
+		idx.addMessages(fd.Messages())
+		for i := 0; i < fd.Services().Len(); i++ {
+			svc := fd.Services().Get(i)
+			for j := 0; j < svc.Methods().Len(); j++ {
+				method := svc.Methods().Get(j)
+				idx.methods[fmt.Sprintf("/%s/%s", svc.FullName(), method.Name())] = method
+			}
+		}
+	}
+	return idx
+}
+
+// addMessages indexes messages and their nested messages, the first registered wins.
+func (idx *descriptorIndex) addMessages(messages protoreflect.MessageDescriptors) {
+	for i := 0; i < messages.Len(); i++ {
+		md := messages.Get(i)
+		if _, exists := idx.messages[string(md.FullName())]; !exists {
+			idx.messages[string(md.FullName())] = md
+		}
+		idx.addMessages(md.Messages())
+	}
+}
 
-	methodDescriptorRegistry   map[string]protoreflect.MethodDescriptor
-	methodDescriptorRegistryMu sync.RWMutex
+// IsBuiltinFile reports whether fd is a well-known file preloaded from the Go protobuf registry.
+func IsBuiltinFile(fd protoreflect.FileDescriptor) bool {
+	builtin, err := protoregistry.GlobalFiles.FindFileByPath(fd.Path())
+	return err == nil && builtin == fd
+}
+
+type defaultDescriptorRegistry struct {
+	// raw .proto sources of the registered files keyed by filename
+	protoFiles     map[string]string
+	protoFileNames []string
+	// staged batches by name
+	staged       map[string]*stagedBatch
+	protoFilesMu sync.RWMutex
+
+	// writeMu serializes the changes of index and of the registered sources
+	writeMu sync.Mutex
+	index   atomic.Pointer[descriptorIndex]
 }
 
 // NewDefaultDescriptorRegistry creates a registry preloaded with all standard Protobuf descriptors
 func NewDefaultDescriptorRegistry() DescriptorRegistry {
-	d := defaultDescriptorRegistry{}
+	d := defaultDescriptorRegistry{protoFiles: map[string]string{}, staged: map[string]*stagedBatch{}}
 	// Load built-in well-known types from the global registry
+	var files []protoreflect.FileDescriptor
 	protoregistry.GlobalFiles.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
-		d.allFileDescMu.Lock()
-		d.allFileDescriptors = append(d.allFileDescriptors, fd)
-		d.allFileDescMu.Unlock()
+		files = append(files, fd)
 		return true
 	})
+	d.index.Store(newDescriptorIndex(files))
 	return &d
 }
 
-// IngestProtoFile stores the filename and content in memory without compiling
-func (s *defaultDescriptorRegistry) IngestProtoFile(filename, content string) {
+// StageProtoFile stages the filename and content in batch without compiling.
+// The content of an already staged file is replaced.
+func (s *defaultDescriptorRegistry) StageProtoFile(batch, filename, content string) {
+	s.protoFilesMu.Lock()
+	defer s.protoFilesMu.Unlock()
+
+	b, ok := s.staged[batch]
+	if !ok {
+		b = &stagedBatch{files: map[string]string{}}
+		s.staged[batch] = b
+	}
+	if _, exists := b.files[filename]; !exists {
+		b.names = append(b.names, filename)
+	}
+	b.files[filename] = content
+}
+
+// StagedFiles lists the staged files by batch name, then staging order
+func (s *defaultDescriptorRegistry) StagedFiles() []StagedFile {
+	s.protoFilesMu.RLock()
+	defer s.protoFilesMu.RUnlock()
+	batches := make([]string, 0, len(s.staged))
+	for name := range s.staged {
+		batches = append(batches, name)
+	}
+	sort.Strings(batches)
+	var files []StagedFile
+	for _, batch := range batches {
+		b := s.staged[batch]
+		for _, name := range b.names {
+			files = append(files, StagedFile{Batch: batch, Filename: name, Content: b.files[name]})
+		}
+	}
+	return files
+}
+
+// DiscardStaged removes a staged file of batch, or the whole batch when filename is empty
+func (s *defaultDescriptorRegistry) DiscardStaged(batch, filename string) ([]string, error) {
 	s.protoFilesMu.Lock()
 	defer s.protoFilesMu.Unlock()
 
-	if s.protoFiles == nil {
-		s.protoFiles = map[string]string{}
+	b, ok := s.staged[batch]
+	if !ok {
+		return nil, ErrNotStaged
+	}
+	if filename == "" {
+		delete(s.staged, batch)
+		return b.names, nil
 	}
+	if _, ok := b.files[filename]; !ok {
+		return nil, ErrNotStaged
+	}
+	s.unstage(batch, &stagedBatch{files: map[string]string{filename: b.files[filename]}, names: []string{filename}})
+	return []string{filename}, nil
+}
 
-	if s.protoFileNames == nil {
-		s.protoFileNames = []string{}
+// unstage removes the files of done from batch, unless they were staged again with another content
+// meanwhile. protoFilesMu must be held.
+func (s *defaultDescriptorRegistry) unstage(batch string, done *stagedBatch) {
+	b, ok := s.staged[batch]
+	if !ok {
+		return
 	}
-	if _, exists := s.protoFiles[filename]; !exists {
-		s.protoFiles[filename] = content
-		s.protoFileNames = append(s.protoFileNames, filename)
+	names := b.names[:0]
+	for _, name := range b.names {
+		if content, ok := done.files[name]; ok && b.files[name] == content {
+			delete(b.files, name)
+		} else {
+			names = append(names, name)
+		}
+	}
+	b.names = names
+	if len(b.names) == 0 {
+		delete(s.staged, batch)
 	}
 }
 
 // RegisterProtoFile ingests the file and immediately compiles and registers its descriptors
 func (s *defaultDescriptorRegistry) RegisterProtoFile(filename, content string) error {
-	s.IngestProtoFile(filename, content)
-	fds, err := s.Compile()
+	s.StageProtoFile(DefaultBatch, filename, content)
+	return s.CompileAndRegister()
+}
+
+// CompileAndRegister compiles the default batch and registers the resulting descriptors
+func (s *defaultDescriptorRegistry) CompileAndRegister() error {
+	_, err := s.CompileBatch(DefaultBatch)
+	return err
+}
+
+// CompileBatch compiles the registered sources with the files of batch, all or nothing. The files of the
+// batch become registered sources on success, and are discarded on failure.
+func (s *defaultDescriptorRegistry) CompileBatch(batch string) ([]Diagnostic, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	staged := s.snapshot(batch)
+
+	warnings, err := s.compileAndCommit(staged)
+
+	s.protoFilesMu.Lock()
+	s.unstage(batch, staged)
+	s.protoFilesMu.Unlock()
 	if err != nil {
-		return fmt.Errorf("compile error: %w", err)
+		if len(staged.names) > 0 {
+			log.Printf("staged files discarded: %s", strings.Join(staged.names, ", "))
+		}
+		return nil, fmt.Errorf("compile error: %w", err)
 	}
-	s.RegisterFiles(fds)
-	return nil
+	return warnings, nil
 }
 
-// CompileAndRegister compiles all ingested proto files and registers the resulting descriptors
-func (s *defaultDescriptorRegistry) CompileAndRegister() error {
-	fds, err := s.Compile()
+// compileAndCommit compiles the registered sources with staged, then registers the descriptors and
+// keeps the staged sources. Nothing changes on failure. writeMu must be held.
+func (s *defaultDescriptorRegistry) compileAndCommit(staged *stagedBatch) ([]Diagnostic, error) {
+	sources, names := s.sources(staged)
+	fds, warnings, err := s.compile(sources, names, s.index.Load().files)
 	if err != nil {
-		return fmt.Errorf("compile error: %w", err)
+		return nil, err
 	}
-	s.RegisterFiles(fds)
-	return nil
+	files := make([]protoreflect.FileDescriptor, len(fds))
+	for i, fd := range fds {
+		files[i] = fd
+	}
+	s.register(files)
+
+	s.protoFilesMu.Lock()
+	s.keepSources(staged)
+	s.protoFilesMu.Unlock()
+	return warnings, nil
 }
 
-// Compile transforms all ingested .proto sources into linked FileDescriptors
-func (s *defaultDescriptorRegistry) Compile() (linker.Files, error) {
+// snapshot returns a copy of the files of batch, empty when it doesn't exist.
+func (s *defaultDescriptorRegistry) snapshot(batch string) *stagedBatch {
+	s.protoFilesMu.RLock()
+	defer s.protoFilesMu.RUnlock()
+	if b, ok := s.staged[batch]; ok {
+		return b.clone()
+	}
+	return &stagedBatch{files: map[string]string{}}
+}
+
+// keepSources makes the files of staged registered sources. protoFilesMu must be held.
+func (s *defaultDescriptorRegistry) keepSources(staged *stagedBatch) {
+	for _, name := range staged.names {
+		if _, exists := s.protoFiles[name]; !exists {
+			s.protoFileNames = append(s.protoFileNames, name)
+		}
+		s.protoFiles[name] = staged.files[name]
+	}
+}
+
+// sources returns the registered sources overridden by staged, and their names in registration then staging order.
+func (s *defaultDescriptorRegistry) sources(staged *stagedBatch) (map[string]string, []string) {
+	s.protoFilesMu.RLock()
+	defer s.protoFilesMu.RUnlock()
+	sources := make(map[string]string, len(s.protoFiles)+len(staged.files))
+	for name, content := range s.protoFiles {
+		sources[name] = content
+	}
+	names := append([]string(nil), s.protoFileNames...)
+	for _, name := range staged.names {
+		if _, exists := sources[name]; !exists {
+			names = append(names, name)
+		}
+		sources[name] = staged.files[name]
+	}
+	return sources, names
+}
+
+// compile returns the linked files and the warnings, or a *CompileError holding every diagnostic.
+// Imports without source are linked to files, the last one of a path winning.
+func (s *defaultDescriptorRegistry) compile(sources map[string]string, names []string, files []protoreflect.FileDescriptor) (linker.Files, []Diagnostic, error) {
 	base := &protocompile.SourceResolver{
 		ImportPaths: []string{"."},
-		Accessor:    protocompile.SourceAccessorFromMap(s.protoFiles),
+		Accessor:    protocompile.SourceAccessorFromMap(sources),
+	}
+	// Imports without source, registered from a descriptor set for instance, are linked as registered
+	registered := map[string]protoreflect.FileDescriptor{}
+	for _, fd := range files {
+		if _, ok := sources[fd.Path()]; !ok && !IsBuiltinFile(fd) {
+			registered[fd.Path()] = fd
+		}
 	}
-	resolver := protocompile.WithStandardImports(base)
+	resolver := protocompile.WithStandardImports(protocompile.CompositeResolver{
+		base,
+		protocompile.ResolverFunc(func(path string) (protocompile.SearchResult, error) {
+			if fd, ok := registered[path]; ok {
+				return protocompile.SearchResult{Desc: fd}, nil
+			}
+			return protocompile.SearchResult{}, protoregistry.NotFound
+		}),
+	})
 
-	compiler := protocompile.Compiler{Resolver: resolver}
-	return compiler.Compile(context.Background(), s.protoFileNames...)
+	rep := &diagnosticsReporter{sources: sources}
+	compiler := protocompile.Compiler{Resolver: resolver, Reporter: rep}
+	fds, err := compiler.Compile(context.Background(), names...)
+	if err != nil {
+		if !errors.Is(err, reporter.ErrInvalidSource) {
+			// Failures without position, such as a missing import, are not reported
+			rep.diagnostics = append(rep.diagnostics, Diagnostic{Severity: SeverityError, Message: err.Error()})
+		}
+		return nil, nil, &CompileError{Diagnostics: rep.diagnostics}
+	}
+	return fds, rep.warnings(), nil
 }
 
-// RegisterFiles adds new descriptors and extracts message schemas, skipping duplicates
-func (s *defaultDescriptorRegistry) RegisterFiles(fds linker.Files) {
-	s.allFileDescMu.Lock()
-	defer s.allFileDescMu.Unlock()
+// register adds or replaces fds in the index. writeMu must be held.
+func (s *defaultDescriptorRegistry) register(fds []protoreflect.FileDescriptor) {
+	files := append([]protoreflect.FileDescriptor(nil), s.index.Load().files...)
+	positions := make(map[string]int, len(files))
+	for i, fd := range files {
+		positions[fd.Path()] = i
+	}
 	for _, fd := range fds {
-		alreadyRegistered := false
-		for _, existing := range s.allFileDescriptors {
-			if existing.Path() == fd.Path() {
-				alreadyRegistered = true
-				break
-			}
+		if i, exists := positions[fd.Path()]; exists {
+			files[i] = fd
+			log.Printf("file descriptor replaced: %s", fd.Path())
+		} else {
+			positions[fd.Path()] = len(files)
+			files = append(files, fd)
+			log.Printf("file descriptor registered: %s", fd.Path())
 		}
-		if alreadyRegistered {
-			continue
+	}
+	s.index.Store(newDescriptorIndex(files))
+}
+
+// RegisterDescriptorSet builds the files of set, in dependency order, and registers them.
+// They replace the ingested sources of the same path, and the sources importing them are
+// compiled again to be linked to the new descriptors. Nothing is registered when any fails.
+func (s *defaultDescriptorRegistry) RegisterDescriptorSet(set *descriptorpb.FileDescriptorSet) ([]string, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	protos, err := sortFileProtos(set.GetFile())
+	if err != nil {
+		return nil, err
+	}
+
+	// Files of the set take precedence over the registered ones of the same path
+	inSet := make(map[string]bool, len(protos))
+	for _, fdp := range protos {
+		inSet[fdp.GetName()] = true
+	}
+	idx := s.index.Load()
+	resolver := &protoregistry.Files{}
+	for _, fd := range idx.files {
+		if !inSet[fd.Path()] {
+			// Conflicting files are left out, the set will fail to build if it needed them
+			_ = resolver.RegisterFile(fd)
+		}
+	}
+
+	fds := make([]protoreflect.FileDescriptor, 0, len(protos))
+	paths := make([]string, 0, len(protos))
+	for _, fdp := range protos {
+		fd, err := protodesc.NewFile(fdp, resolver)
+		if err != nil {
+			return nil, fmt.Errorf("build %s: %w", fdp.GetName(), err)
 		}
-		s.allFileDescriptors = append(s.allFileDescriptors, fd)
+		if err := resolver.RegisterFile(fd); err != nil {
+			return nil, fmt.Errorf("register %s: %w", fdp.GetName(), err)
+		}
+		fds = append(fds, fd)
+		paths = append(paths, fd.Path())
+	}
+
+	// The sources left are compiled against the set before anything is registered
+	sources, names := s.sources(&stagedBatch{})
+	kept := names[:0]
+	for _, name := range names {
+		if inSet[name] {
+			delete(sources, name)
+		} else {
+			kept = append(kept, name)
+		}
+	}
+	recompile := false
+	for _, fd := range idx.files {
+		if _, ingested := sources[fd.Path()]; ingested && importsAny(fd, inSet) {
+			recompile = true
+			break
+		}
+	}
+	files := fds
+	if recompile {
+		compiled, _, err := s.compile(sources, kept, append(append([]protoreflect.FileDescriptor(nil), idx.files...), fds...))
+		if err != nil {
+			return nil, fmt.Errorf("files importing the descriptor set fail to compile: %w", err)
+		}
+		for _, fd := range compiled {
+			files = append(files, fd)
+		}
+	}
+	s.register(files)
+
+	s.protoFilesMu.Lock()
+	names = s.protoFileNames[:0]
+	for _, name := range s.protoFileNames {
+		if inSet[name] {
+			delete(s.protoFiles, name)
+		} else {
+			names = append(names, name)
+		}
+	}
+	s.protoFileNames = names
+	s.protoFilesMu.Unlock()
+	return paths, nil
+}
 
-		s.messageDescriptorRegistryMu.Lock()
-		if s.messageDescriptorRegistry == nil {
-			s.messageDescriptorRegistry = map[string]protoreflect.MessageDescriptor{}
+// sortFileProtos orders the files of a set so that each comes after the files it imports.
+func sortFileProtos(protos []*descriptorpb.FileDescriptorProto) ([]*descriptorpb.FileDescriptorProto, error) {
+	byName := make(map[string]*descriptorpb.FileDescriptorProto, len(protos))
+	for _, fdp := range protos {
+		if fdp.GetName() == "" {
+			return nil, errors.New("descriptor set holds a file without name")
+		}
+		if _, exists := byName[fdp.GetName()]; exists {
+			return nil, fmt.Errorf("descriptor set holds %s twice", fdp.GetName())
 		}
+		byName[fdp.GetName()] = fdp
+	}
 
-		for i := 0; i < fd.Messages().Len(); i++ {
-			md := fd.Messages().Get(i)
-			if _, exists := s.messageDescriptorRegistry[string(md.FullName())]; !exists {
-				s.messageDescriptorRegistry[string(md.FullName())] = md
-				log.Printf("message descriptor registered: %s", md.FullName())
+	sorted := make([]*descriptorpb.FileDescriptorProto, 0, len(protos))
+	state := map[string]int{} // 1: visiting, 2: done
+	var visit func(name string) error
+	visit = func(name string) error {
+		fdp, ok := byName[name]
+		if !ok || state[name] == 2 {
+			return nil
+		}
+		if state[name] == 1 {
+			return fmt.Errorf("import cycle through %s", name)
+		}
+		state[name] = 1
+		for _, dep := range fdp.GetDependency() {
+			if err := visit(dep); err != nil {
+				return err
 			}
 		}
-		s.messageDescriptorRegistryMu.Unlock()
+		state[name] = 2
+		sorted = append(sorted, fdp)
+		return nil
+	}
+	for _, fdp := range protos {
+		if err := visit(fdp.GetName()); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// importsAny reports whether fd directly imports one of paths.
+func importsAny(fd protoreflect.FileDescriptor, paths map[string]bool) bool {
+	for i := 0; i < fd.Imports().Len(); i++ {
+		if paths[fd.Imports().Get(i).Path()] {
+			return true
+		}
+	}
+	return false
+}
 
-		s.methodDescriptorRegistryMu.Lock()
-		if s.methodDescriptorRegistry == nil {
-			s.methodDescriptorRegistry = map[string]protoreflect.MethodDescriptor{}
+// PendingFiles lists the paths staged in any batch, by batch name then staging order
+func (s *defaultDescriptorRegistry) PendingFiles() []string {
+	seen := map[string]bool{}
+	var pending []string
+	for _, f := range s.StagedFiles() {
+		if !seen[f.Filename] {
+			seen[f.Filename] = true
+			pending = append(pending, f.Filename)
 		}
+	}
+	return pending
+}
 
-		for i := 0; i < fd.Services().Len(); i++ {
-			svc := fd.Services().Get(i)
-			for j := 0; j < svc.Methods().Len(); j++ {
-				method := svc.Methods().Get(j)
-				fullMethodName := fmt.Sprintf("/%s/%s", svc.FullName(), method.Name())
-				s.methodDescriptorRegistry[fullMethodName] = method
-				log.Printf("method descriptor registered: %s", fullMethodName)
+// UnregisterFile removes a file, and with cascade the files depending on it, from both the
+// sources and the registered descriptors.
+func (s *defaultDescriptorRegistry) UnregisterFile(filename string, cascade bool) ([]string, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	idx := s.index.Load()
+	registered := false
+	for _, fd := range idx.files {
+		if fd.Path() == filename {
+			registered = true
+			break
+		}
+	}
+	s.protoFilesMu.RLock()
+	_, ingested := s.protoFiles[filename]
+	s.protoFilesMu.RUnlock()
+	if !registered && !ingested {
+		return nil, ErrFileNotFound
+	}
+	for _, fd := range idx.files {
+		if fd.Path() == filename && IsBuiltinFile(fd) && !ingested {
+			return nil, ErrBuiltinFile
+		}
+	}
+
+	dependents := dependentFiles(idx.files, filename)
+	if len(dependents) > 0 && !cascade {
+		return nil, &DependentsError{Filename: filename, Dependents: dependents}
+	}
+	removed := append([]string{filename}, dependents...)
+	drop := make(map[string]bool, len(removed))
+	for _, path := range removed {
+		drop[path] = true
+	}
+
+	s.protoFilesMu.Lock()
+	names := s.protoFileNames[:0]
+	for _, name := range s.protoFileNames {
+		if drop[name] {
+			delete(s.protoFiles, name)
+		} else {
+			names = append(names, name)
+		}
+	}
+	s.protoFileNames = names
+	s.protoFilesMu.Unlock()
+
+	files := make([]protoreflect.FileDescriptor, 0, len(idx.files))
+	for _, fd := range idx.files {
+		if !drop[fd.Path()] {
+			files = append(files, fd)
+		}
+	}
+	s.index.Store(newDescriptorIndex(files))
+	log.Printf("file descriptors unregistered: %s", strings.Join(removed, ", "))
+	return removed, nil
+}
+
+// dependentFiles returns the paths of the files importing filename, directly or not, sorted.
+func dependentFiles(files []protoreflect.FileDescriptor, filename string) []string {
+	found := map[string]bool{filename: true}
+	for changed := true; changed; {
+		changed = false
+		for _, fd := range files {
+			if found[fd.Path()] {
+				continue
+			}
+			imports := fd.Imports()
+			for i := 0; i < imports.Len(); i++ {
+				if found[imports.Get(i).Path()] {
+					found[fd.Path()] = true
+					changed = true
+					break
+				}
 			}
 		}
-		s.methodDescriptorRegistryMu.Unlock()
 	}
+	delete(found, filename)
+	dependents := make([]string, 0, len(found))
+	for path := range found {
+		dependents = append(dependents, path)
+	}
+	sort.Strings(dependents)
+	return dependents
 }
 
 func (s *defaultDescriptorRegistry) GetFileDescriptors() []protoreflect.FileDescriptor {
-	s.allFileDescMu.RLock()
-	defer s.allFileDescMu.RUnlock()
-	descriptorsCopy := make([]protoreflect.FileDescriptor, len(s.allFileDescriptors))
-	copy(descriptorsCopy, s.allFileDescriptors)
+	files := s.index.Load().files
+	descriptorsCopy := make([]protoreflect.FileDescriptor, len(files))
+	copy(descriptorsCopy, files)
 	return descriptorsCopy
 }
 
 // GetMessageDescriptor retrieves a message descriptor by full name
 func (s *defaultDescriptorRegistry) GetMessageDescriptor(fullName string) (protoreflect.MessageDescriptor, bool) {
-	s.messageDescriptorRegistryMu.RLock()
-	defer s.messageDescriptorRegistryMu.RUnlock()
-	md, ok := s.messageDescriptorRegistry[fullName]
+	md, ok := s.index.Load().messages[fullName]
 	return md, ok
 }
 
-// GetMessageDescriptor retrieves a message descriptor by full name
+// GetMethodDescriptor retrieves a method descriptor by full method name (/package.Service/Method)
 func (s *defaultDescriptorRegistry) GetMethodDescriptor(fullName string) (protoreflect.MethodDescriptor, bool) {
-	s.methodDescriptorRegistryMu.RLock()
-	defer s.methodDescriptorRegistryMu.RUnlock()
-	md, ok := s.methodDescriptorRegistry[fullName]
+	md, ok := s.index.Load().methods[fullName]
 	return md, ok
 }
@@ -2,6 +2,7 @@ package reflection_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"testing"
@@ -11,6 +12,7 @@ import (
 	"google.golang.org/grpc/metadata"
 	reflectionv1 "google.golang.org/grpc/reflection/grpc_reflection_v1"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
 	"google.golang.org/protobuf/types/descriptorpb"
 )
 
@@ -111,8 +113,8 @@ message FooReq {
 `
 
 	// Ingest in wrong order
-	registry.IngestProtoFile("service/foo.proto", serviceProto)
-	registry.IngestProtoFile("common.proto", commonProto)
+	registry.StageProtoFile(reflection.DefaultBatch, "service/foo.proto", serviceProto)
+	registry.StageProtoFile(reflection.DefaultBatch, "common.proto", commonProto)
 
 	// Compile and register all
 	if err := registry.CompileAndRegister(); err != nil {
@@ -237,3 +239,266 @@ message M1Req {}`
 		t.Errorf("service Svc not found in descriptor: %v", fdp.GetService())
 	}
 }
+
+// Test that uploading a file again replaces it, along with the files importing it
+func TestRegisterProtoFile_Replace(t *testing.T) {
+	registry := reflection.NewDefaultDescriptorRegistry()
+
+	common := `syntax = "proto3"; package common; message User { string name = 1; }`
+	svc := `syntax = "proto3"; package svc; import "common.proto";
+service Users { rpc Get(common.User) returns (common.User); }`
+	registry.StageProtoFile(reflection.DefaultBatch, "common.proto", common)
+	registry.StageProtoFile(reflection.DefaultBatch, "svc.proto", svc)
+	if err := registry.CompileAndRegister(); err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+
+	updated := `syntax = "proto3"; package common; message User { string name = 1; string email = 2; }`
+	if err := registry.RegisterProtoFile("common.proto", updated); err != nil {
+		t.Fatalf("replace failed: %v", err)
+	}
+
+	md, ok := registry.GetMessageDescriptor("common.User")
+	if !ok || md.Fields().ByName("email") == nil {
+		t.Fatalf("expected the replaced User message with an email field")
+	}
+	method, ok := registry.GetMethodDescriptor("/svc.Users/Get")
+	if !ok || method.Input().Fields().ByName("email") == nil {
+		t.Errorf("expected the dependent file to be linked to the new User message")
+	}
+	count := 0
+	for _, fd := range registry.GetFileDescriptors() {
+		if fd.Path() == "common.proto" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("expected common.proto registered once, got %d", count)
+	}
+}
+
+// Test unregistering a file with and without its dependents
+func TestUnregisterFile(t *testing.T) {
+	registry := reflection.NewDefaultDescriptorRegistry()
+	registry.StageProtoFile(reflection.DefaultBatch, "common.proto", `syntax = "proto3"; package common; message User {}`)
+	registry.StageProtoFile(reflection.DefaultBatch, "svc.proto", `syntax = "proto3"; package svc; import "common.proto";
+service Users { rpc Get(common.User) returns (common.User); }`)
+	registry.StageProtoFile(reflection.DefaultBatch, "other.proto", `syntax = "proto3"; package other; message Other {}`)
+	if err := registry.CompileAndRegister(); err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+
+	_, err := registry.UnregisterFile("common.proto", false)
+	var dependentsErr *reflection.DependentsError
+	if !errors.As(err, &dependentsErr) || len(dependentsErr.Dependents) != 1 || dependentsErr.Dependents[0] != "svc.proto" {
+		t.Fatalf("expected svc.proto reported as dependent, got %v", err)
+	}
+	if _, ok := registry.GetMessageDescriptor("common.User"); !ok {
+		t.Fatalf("a refused unregistration must keep the file")
+	}
+
+	removed, err := registry.UnregisterFile("common.proto", true)
+	if err != nil || len(removed) != 2 {
+		t.Fatalf("expected common.proto and svc.proto removed, got %v, %v", removed, err)
+	}
+	if _, ok := registry.GetMessageDescriptor("common.User"); ok {
+		t.Error("common.User must be unregistered")
+	}
+	if _, ok := registry.GetMethodDescriptor("/svc.Users/Get"); ok {
+		t.Error("/svc.Users/Get must be unregistered")
+	}
+	if _, ok := registry.GetMessageDescriptor("other.Other"); !ok {
+		t.Error("other.Other must stay registered")
+	}
+	// Removed sources aren't compiled anymore
+	if err := registry.CompileAndRegister(); err != nil {
+		t.Errorf("compile after unregister failed: %v", err)
+	}
+
+	if _, err := registry.UnregisterFile("common.proto", false); !errors.Is(err, reflection.ErrFileNotFound) {
+		t.Errorf("expected ErrFileNotFound, got %v", err)
+	}
+	if _, err := registry.UnregisterFile("google/protobuf/empty.proto", false); !errors.Is(err, reflection.ErrBuiltinFile) {
+		t.Errorf("expected ErrBuiltinFile, got %v", err)
+	}
+}
+
+// Test registering compiled descriptors, and compiling sources against them
+func TestRegisterDescriptorSet(t *testing.T) {
+	// Build the descriptors the way protoc would, from another registry
+	compiler := reflection.NewDefaultDescriptorRegistry()
+	compiler.StageProtoFile(reflection.DefaultBatch, "api/common.proto", `syntax = "proto3"; package common; import "google/protobuf/timestamp.proto";
+message User { string name = 1; google.protobuf.Timestamp created = 2; }`)
+	compiler.StageProtoFile(reflection.DefaultBatch, "api/svc.proto", `syntax = "proto3"; package svc; import "api/common.proto";
+service Users { rpc Get(common.User) returns (common.User); }`)
+	if err := compiler.CompileAndRegister(); err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+	// Dependents first: the registry has to sort them
+	set := &descriptorpb.FileDescriptorSet{}
+	fds := compiler.GetFileDescriptors()
+	for i := len(fds) - 1; i >= 0; i-- {
+		if !reflection.IsBuiltinFile(fds[i]) {
+			set.File = append(set.File, protodesc.ToFileDescriptorProto(fds[i]))
+		}
+	}
+
+	registry := reflection.NewDefaultDescriptorRegistry()
+	paths, err := registry.RegisterDescriptorSet(set)
+	if err != nil {
+		t.Fatalf("register descriptor set failed: %v", err)
+	}
+	if len(paths) != 2 || paths[0] != "api/common.proto" {
+		t.Errorf("unexpected registered paths %v", paths)
+	}
+	if _, ok := registry.GetMethodDescriptor("/svc.Users/Get"); !ok {
+		t.Fatal("/svc.Users/Get must be registered")
+	}
+
+	// Sources may import the registered descriptors
+	if err := registry.RegisterProtoFile("extra.proto", `syntax = "proto3"; package extra; import "api/common.proto";
+message Team { repeated common.User members = 1; }`); err != nil {
+		t.Fatalf("compile against the descriptor set failed: %v", err)
+	}
+	if _, ok := registry.GetMessageDescriptor("extra.Team"); !ok {
+		t.Error("extra.Team must be registered")
+	}
+
+	// Imports missing from the set and unknown to the registry
+	_, err = reflection.NewDefaultDescriptorRegistry().RegisterDescriptorSet(&descriptorpb.FileDescriptorSet{File: set.File[:1]})
+	if err == nil {
+		t.Error("expected an error for a missing import")
+	}
+}
+
+// Test that a descriptor set breaking the sources importing it is not registered
+func TestRegisterDescriptorSet_ImportersFailToCompile(t *testing.T) {
+	registry := reflection.NewDefaultDescriptorRegistry()
+	if err := registry.RegisterProtoFile("common.proto", `syntax = "proto3"; package common; message User {}`); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if err := registry.RegisterProtoFile("team.proto", `syntax = "proto3"; package team; import "common.proto";
+message Team { repeated common.User members = 1; }`); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+
+	setOf := func(content string) *descriptorpb.FileDescriptorSet {
+		compiler := reflection.NewDefaultDescriptorRegistry()
+		if err := compiler.RegisterProtoFile("common.proto", content); err != nil {
+			t.Fatalf("compile failed: %v", err)
+		}
+		for _, fd := range compiler.GetFileDescriptors() {
+			if fd.Path() == "common.proto" {
+				return &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{protodesc.ToFileDescriptorProto(fd)}}
+			}
+		}
+		t.Fatal("common.proto not compiled")
+		return nil
+	}
+
+	// team.proto needs common.User, missing from the set
+	if _, err := registry.RegisterDescriptorSet(setOf(`syntax = "proto3"; package common; message Account {}`)); err == nil {
+		t.Fatal("expected the importing files to fail to compile")
+	}
+	if _, ok := registry.GetMessageDescriptor("common.Account"); ok {
+		t.Error("the descriptor set must not be registered")
+	}
+	if _, ok := registry.GetMessageDescriptor("common.User"); !ok {
+		t.Error("the replaced source must be kept")
+	}
+	if _, err := registry.UnregisterFile("common.proto", false); err == nil {
+		t.Error("team.proto must still import common.proto")
+	}
+
+	if _, err := registry.RegisterDescriptorSet(setOf(`syntax = "proto3"; package common; message User { string name = 1; }`)); err != nil {
+		t.Fatalf("register descriptor set failed: %v", err)
+	}
+	team, _ := registry.GetMessageDescriptor("team.Team")
+	user, _ := registry.GetMessageDescriptor("common.User")
+	if team == nil || team.Fields().Get(0).Message() != user {
+		t.Error("team.proto must be linked to the registered descriptor set")
+	}
+}
+
+// Test that every error is reported with its position, warnings included
+func TestCompileDiagnostics(t *testing.T) {
+	registry := reflection.NewDefaultDescriptorRegistry()
+	registry.StageProtoFile(reflection.DefaultBatch, "a.proto", "syntax = \"proto3\";\nimport \"google/protobuf/timestamp.proto\";\nmessage A {\n  Unknown x = 1;\n  Other y = 2;\n}\n")
+	_, err := registry.CompileBatch(reflection.DefaultBatch)
+	var compileErr *reflection.CompileError
+	if !errors.As(err, &compileErr) {
+		t.Fatalf("expected a *CompileError, got %v", err)
+	}
+	var errs []reflection.Diagnostic
+	for _, d := range compileErr.Diagnostics {
+		if d.Severity == reflection.SeverityError {
+			errs = append(errs, d)
+		}
+	}
+	if len(errs) != 2 {
+		t.Fatalf("expected both unknown types, got %+v", compileErr.Diagnostics)
+	}
+	if d := errs[0]; d.File != "a.proto" || d.Line != 4 || d.Column != 3 || d.Snippet != "  Unknown x = 1;" {
+		t.Errorf("unexpected diagnostic %+v", d)
+	}
+
+	registry.StageProtoFile(reflection.DefaultBatch, "a.proto", "syntax = \"proto3\";\nimport \"google/protobuf/timestamp.proto\";\nmessage A {}\n")
+	warnings, err := registry.CompileBatch(reflection.DefaultBatch)
+	if err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+	if len(warnings) != 1 || warnings[0].Severity != reflection.SeverityWarning || warnings[0].Line != 2 {
+		t.Errorf("expected the unused import warning, got %+v", warnings)
+	}
+}
+
+// Test that batches compile all or nothing, without touching each other
+func TestCompileBatch(t *testing.T) {
+	registry := reflection.NewDefaultDescriptorRegistry()
+	if err := registry.RegisterProtoFile("common.proto", `syntax = "proto3"; package common; message User {}`); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+
+	registry.StageProtoFile("a", "common.proto", `syntax = "proto3"; package common; message Account {}`)
+	registry.StageProtoFile("a", "broken.proto", `syntax = "proto3"; package broken; message B {`)
+	registry.StageProtoFile("b", "svc.proto", `syntax = "proto3"; package svc; import "common.proto";
+service Users { rpc Get(common.User) returns (common.User); }`)
+	if staged := registry.StagedFiles(); len(staged) != 3 || staged[0].Batch != "a" || staged[2].Filename != "svc.proto" {
+		t.Fatalf("unexpected staged files %+v", staged)
+	}
+
+	if _, err := registry.CompileBatch("a"); err == nil {
+		t.Fatal("expected a compile error")
+	}
+	if _, ok := registry.GetMessageDescriptor("common.User"); !ok {
+		t.Error("the registered schema must be left untouched")
+	}
+	if pending := registry.PendingFiles(); len(pending) != 1 || pending[0] != "svc.proto" {
+		t.Errorf("expected batch a rolled back and batch b staged, got %v", pending)
+	}
+
+	if _, err := registry.CompileBatch("b"); err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+	if _, ok := registry.GetMethodDescriptor("/svc.Users/Get"); !ok {
+		t.Error("/svc.Users/Get must be registered")
+	}
+	if pending := registry.PendingFiles(); len(pending) != 0 {
+		t.Errorf("expected nothing staged, got %v", pending)
+	}
+
+	registry.StageProtoFile(reflection.DefaultBatch, "x.proto", `syntax = "proto3"; package x;`)
+	registry.StageProtoFile(reflection.DefaultBatch, "y.proto", `syntax = "proto3"; package y;`)
+	if discarded, err := registry.DiscardStaged(reflection.DefaultBatch, "x.proto"); err != nil || len(discarded) != 1 {
+		t.Errorf("expected x.proto discarded, got %v, %v", discarded, err)
+	}
+	if _, err := registry.DiscardStaged(reflection.DefaultBatch, "x.proto"); !errors.Is(err, reflection.ErrNotStaged) {
+		t.Errorf("expected ErrNotStaged, got %v", err)
+	}
+	if discarded, err := registry.DiscardStaged(reflection.DefaultBatch, ""); err != nil || len(discarded) != 1 || discarded[0] != "y.proto" {
+		t.Errorf("expected y.proto discarded with the batch, got %v, %v", discarded, err)
+	}
+	if _, err := registry.DiscardStaged(reflection.DefaultBatch, ""); !errors.Is(err, reflection.ErrNotStaged) {
+		t.Errorf("expected ErrNotStaged, got %v", err)
+	}
+}
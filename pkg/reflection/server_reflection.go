@@ -0,0 +1,263 @@
+package reflection
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// reflectionResolver answers the reflection requests of both v1 and v1alpha, from the local descriptors
+// first and then from the upstream, if any.
+type reflectionResolver struct {
+	fdg      FileDescriptorsGetter
+	upstream UpstreamReflection
+}
+
+// listServices returns the local services, completed with the upstream ones.
+func (r *reflectionResolver) listServices(ctx context.Context) []string {
+	seen := map[string]struct{}{}
+	var names []string
+	add := func(name string) {
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+	for _, fd := range r.fdg.GetFileDescriptors() {
+		for i := 0; i < fd.Services().Len(); i++ {
+			add(string(fd.Services().Get(i).FullName()))
+		}
+	}
+	for _, name := range upstreamServices(ctx, r.upstream) {
+		add(name)
+	}
+	return names
+}
+
+// fileByFilename returns the file of the given path followed by its transitive imports not in sent yet.
+func (r *reflectionResolver) fileByFilename(ctx context.Context, sent map[string]bool, filename string) ([][]byte, error) {
+	if fd := r.localFile(filename); fd != nil {
+		return r.encodeFiles(fd, sent)
+	}
+	return r.fromUpstream(ctx, sent, "file not found", func(ctx context.Context, u UpstreamReflection) ([][]byte, error) {
+		return u.FileByFilename(ctx, filename)
+	})
+}
+
+// fileContainingSymbol returns the file declaring a service, method, message, field, oneof, enum,
+// enum value or extension, followed by its transitive imports not in sent yet.
+func (r *reflectionResolver) fileContainingSymbol(ctx context.Context, sent map[string]bool, symbol string) ([][]byte, error) {
+	for _, fd := range r.fdg.GetFileDescriptors() {
+		if findDescriptor(fd, protoreflect.FullName(symbol)) != nil {
+			return r.encodeFiles(fd, sent)
+		}
+	}
+	return r.fromUpstream(ctx, sent, "symbol not found", func(ctx context.Context, u UpstreamReflection) ([][]byte, error) {
+		return u.FileContainingSymbol(ctx, symbol)
+	})
+}
+
+// fileContainingExtension returns the file declaring the extension number of containingType, followed
+// by its transitive imports not in sent yet.
+func (r *reflectionResolver) fileContainingExtension(ctx context.Context, sent map[string]bool, containingType string, number int32) ([][]byte, error) {
+	for _, fd := range r.fdg.GetFileDescriptors() {
+		for _, xd := range fileExtensions(fd) {
+			if string(xd.ContainingMessage().FullName()) == containingType && int32(xd.Number()) == number {
+				return r.encodeFiles(fd, sent)
+			}
+		}
+	}
+	return r.fromUpstream(ctx, sent, "extension not found", func(ctx context.Context, u UpstreamReflection) ([][]byte, error) {
+		return u.FileContainingExtension(ctx, containingType, number)
+	})
+}
+
+// allExtensionNumbersOfType returns the numbers of the extensions of a message, sorted.
+func (r *reflectionResolver) allExtensionNumbersOfType(ctx context.Context, typeName string) ([]int32, error) {
+	name := protoreflect.FullName(typeName)
+	files := r.fdg.GetFileDescriptors()
+	known := false
+	for _, fd := range files {
+		if _, ok := findDescriptor(fd, name).(protoreflect.MessageDescriptor); ok {
+			known = true
+			break
+		}
+	}
+	if !known {
+		if r.upstream == nil {
+			return nil, status.Error(codes.NotFound, "type not found")
+		}
+		ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+		defer cancel()
+		numbers, err := r.upstream.AllExtensionNumbersOfType(ctx, typeName)
+		if err != nil {
+			if status.Code(err) != codes.NotFound {
+				log.Printf("warning: upstream reflection: %v", err)
+			}
+			return nil, status.Error(codes.NotFound, "type not found")
+		}
+		return numbers, nil
+	}
+
+	numbers := []int32{}
+	seen := map[int32]bool{}
+	for _, fd := range files {
+		for _, xd := range fileExtensions(fd) {
+			n := int32(xd.Number())
+			if xd.ContainingMessage().FullName() == name && !seen[n] {
+				seen[n] = true
+				numbers = append(numbers, n)
+			}
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers, nil
+}
+
+func (r *reflectionResolver) localFile(path string) protoreflect.FileDescriptor {
+	for _, fd := range r.fdg.GetFileDescriptors() {
+		if fd.Path() == path {
+			return fd
+		}
+	}
+	return nil
+}
+
+// encodeFiles serializes fd, then its transitive imports the client did not receive yet on this stream.
+// fd itself is always sent, as the answer to the request.
+func (r *reflectionResolver) encodeFiles(fd protoreflect.FileDescriptor, sent map[string]bool) ([][]byte, error) {
+	var files [][]byte
+	queue := []protoreflect.FileDescriptor{fd}
+	for i := 0; i < len(queue); i++ {
+		f := queue[i]
+		if i > 0 && sent[f.Path()] {
+			continue
+		}
+		sent[f.Path()] = true
+		b, err := proto.Marshal(protodesc.ToFileDescriptorProto(f))
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "marshal %s: %v", f.Path(), err)
+		}
+		files = append(files, b)
+
+		for j := 0; j < f.Imports().Len(); j++ {
+			dep := f.Imports().Get(j).FileDescriptor
+			if dep.IsPlaceholder() {
+				// Unresolved at compilation, the client asks for it by name otherwise
+				if dep = r.localFile(dep.Path()); dep == nil {
+					continue
+				}
+			}
+			if !sent[dep.Path()] {
+				queue = append(queue, dep)
+			}
+		}
+	}
+	return files, nil
+}
+
+// fromUpstream forwards a request not answered locally to the upstream. The files it answers, besides
+// the first one, are skipped when the client already received them on this stream.
+func (r *reflectionResolver) fromUpstream(ctx context.Context, sent map[string]bool, notFound string, fetch func(context.Context, UpstreamReflection) ([][]byte, error)) ([][]byte, error) {
+	upstreamFiles, ok := upstreamFiles(ctx, r.upstream, fetch)
+	if !ok {
+		return nil, status.Error(codes.NotFound, notFound)
+	}
+	var files [][]byte
+	for i, b := range upstreamFiles {
+		fdp := &descriptorpb.FileDescriptorProto{}
+		if err := proto.Unmarshal(b, fdp); err != nil {
+			return nil, status.Errorf(codes.Internal, "invalid upstream file descriptor: %v", err)
+		}
+		if i > 0 && sent[fdp.GetName()] {
+			continue
+		}
+		sent[fdp.GetName()] = true
+		files = append(files, b)
+	}
+	return files, nil
+}
+
+// findDescriptor returns the descriptor of fd named name, nil when fd doesn't declare it.
+func findDescriptor(fd protoreflect.FileDescriptor, name protoreflect.FullName) protoreflect.Descriptor {
+	if pkg := fd.Package(); pkg != "" && !strings.HasPrefix(string(name), string(pkg)+".") {
+		return nil
+	}
+	for i := 0; i < fd.Services().Len(); i++ {
+		svc := fd.Services().Get(i)
+		if svc.FullName() == name {
+			return svc
+		}
+		if name.Parent() == svc.FullName() {
+			if m := svc.Methods().ByName(name.Name()); m != nil {
+				return m
+			}
+		}
+	}
+	return findNestedDescriptor(fd.Messages(), fd.Enums(), fd.Extensions(), name)
+}
+
+func findNestedDescriptor(messages protoreflect.MessageDescriptors, enums protoreflect.EnumDescriptors, extensions protoreflect.ExtensionDescriptors, name protoreflect.FullName) protoreflect.Descriptor {
+	for i := 0; i < enums.Len(); i++ {
+		ed := enums.Get(i)
+		if ed.FullName() == name {
+			return ed
+		}
+		// Enum values are scoped next to their enum, not within it
+		if ed.FullName().Parent() == name.Parent() {
+			if v := ed.Values().ByName(name.Name()); v != nil {
+				return v
+			}
+		}
+	}
+	for i := 0; i < extensions.Len(); i++ {
+		if xd := extensions.Get(i); xd.FullName() == name {
+			return xd
+		}
+	}
+	for i := 0; i < messages.Len(); i++ {
+		md := messages.Get(i)
+		if md.FullName() == name {
+			return md
+		}
+		if !strings.HasPrefix(string(name), string(md.FullName())+".") {
+			continue
+		}
+		if name.Parent() == md.FullName() {
+			if f := md.Fields().ByName(name.Name()); f != nil {
+				return f
+			}
+			if o := md.Oneofs().ByName(name.Name()); o != nil {
+				return o
+			}
+		}
+		if d := findNestedDescriptor(md.Messages(), md.Enums(), md.Extensions(), name); d != nil {
+			return d
+		}
+	}
+	return nil
+}
+
+// fileExtensions returns the extensions declared by fd, nested ones included.
+func fileExtensions(fd protoreflect.FileDescriptor) []protoreflect.ExtensionDescriptor {
+	var exts []protoreflect.ExtensionDescriptor
+	var walk func(messages protoreflect.MessageDescriptors, extensions protoreflect.ExtensionDescriptors)
+	walk = func(messages protoreflect.MessageDescriptors, extensions protoreflect.ExtensionDescriptors) {
+		for i := 0; i < extensions.Len(); i++ {
+			exts = append(exts, extensions.Get(i))
+		}
+		for i := 0; i < messages.Len(); i++ {
+			walk(messages.Get(i).Messages(), messages.Get(i).Extensions())
+		}
+	}
+	walk(fd.Messages(), fd.Extensions())
+	return exts
+}
@@ -0,0 +1,141 @@
+package reflection_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/reflection"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	reflectionv1 "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Test symbols of every kind, extensions and the dependencies sent once per stream
+func TestServerReflection_Symbols(t *testing.T) {
+	registry := reflection.NewDefaultDescriptorRegistry()
+	registry.StageProtoFile(reflection.DefaultBatch, "api/base.proto", `syntax = "proto2"; package base;
+message Base { extensions 100 to 200; }`)
+	registry.StageProtoFile(reflection.DefaultBatch, "api/common.proto", `syntax = "proto2"; package common; import "api/base.proto";
+message User {
+  message Address { optional string city = 1; }
+  enum Role { ROLE_UNSPECIFIED = 0; ADMIN = 1; }
+  optional string name = 1;
+  oneof contact { string email = 2; string phone = 3; }
+  extend base.Base { optional string nickname = 101; }
+}
+extend base.Base { optional int32 level = 100; }`)
+	registry.StageProtoFile(reflection.DefaultBatch, "api/svc.proto", `syntax = "proto2"; package svc; import "api/common.proto";
+service Users { rpc Get(common.User) returns (common.User); }`)
+	if err := registry.CompileAndRegister(); err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := grpc.NewServer()
+	reflectionv1.RegisterServerReflectionServer(srv, reflection.NewServerReflectionV1(registry))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := reflectionv1.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		t.Fatalf("reflection stream: %v", err)
+	}
+	ask := func(req *reflectionv1.ServerReflectionRequest) *reflectionv1.ServerReflectionResponse {
+		t.Helper()
+		if err := stream.Send(req); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("recv: %v", err)
+		}
+		return resp
+	}
+	fileNames := func(resp *reflectionv1.ServerReflectionResponse) []string {
+		t.Helper()
+		if e := resp.GetErrorResponse(); e != nil {
+			t.Fatalf("unexpected error %d: %s", e.GetErrorCode(), e.GetErrorMessage())
+		}
+		var names []string
+		for _, b := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			fdp := &descriptorpb.FileDescriptorProto{}
+			if err := proto.Unmarshal(b, fdp); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			names = append(names, fdp.GetName())
+		}
+		return names
+	}
+	symbol := func(name string) *reflectionv1.ServerReflectionRequest {
+		return &reflectionv1.ServerReflectionRequest{
+			MessageRequest: &reflectionv1.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: name},
+		}
+	}
+
+	// The first answer holds the file and all its imports
+	names := fileNames(ask(symbol("svc.Users.Get")))
+	if len(names) != 3 || names[0] != "api/svc.proto" || names[1] != "api/common.proto" || names[2] != "api/base.proto" {
+		t.Errorf("expected api/svc.proto with its dependencies, got %v", names)
+	}
+	// Then the files already sent are not repeated, but the requested one
+	for _, s := range []string{
+		"common.User",
+		"common.User.Address",
+		"common.User.Address.city",
+		"common.User.Role",
+		"common.User.ADMIN",
+		"common.User.name",
+		"common.User.contact",
+		"common.User.nickname",
+		"common.level",
+	} {
+		if names := fileNames(ask(symbol(s))); len(names) != 1 || names[0] != "api/common.proto" {
+			t.Errorf("%s: expected api/common.proto alone, got %v", s, names)
+		}
+	}
+	for _, s := range []string{"common.Unknown", "common.User.Unknown", "svc.Users.Unknown"} {
+		if code := ask(symbol(s)).GetErrorResponse().GetErrorCode(); code != int32(codes.NotFound) {
+			t.Errorf("%s: expected NotFound, got %d", s, code)
+		}
+	}
+
+	resp := ask(&reflectionv1.ServerReflectionRequest{
+		MessageRequest: &reflectionv1.ServerReflectionRequest_FileContainingExtension{
+			FileContainingExtension: &reflectionv1.ExtensionRequest{ContainingType: "base.Base", ExtensionNumber: 101},
+		},
+	})
+	if names := fileNames(resp); len(names) != 1 || names[0] != "api/common.proto" {
+		t.Errorf("expected api/common.proto for the extension, got %v", names)
+	}
+
+	resp = ask(&reflectionv1.ServerReflectionRequest{
+		MessageRequest: &reflectionv1.ServerReflectionRequest_AllExtensionNumbersOfType{AllExtensionNumbersOfType: "base.Base"},
+	})
+	numbers := resp.GetAllExtensionNumbersResponse()
+	if numbers.GetBaseTypeName() != "base.Base" || len(numbers.GetExtensionNumber()) != 2 ||
+		numbers.GetExtensionNumber()[0] != 100 || numbers.GetExtensionNumber()[1] != 101 {
+		t.Errorf("expected extensions 100 and 101 of base.Base, got %v", resp)
+	}
+
+	resp = ask(&reflectionv1.ServerReflectionRequest{
+		MessageRequest: &reflectionv1.ServerReflectionRequest_AllExtensionNumbersOfType{AllExtensionNumbersOfType: "base.Unknown"},
+	})
+	if code := resp.GetErrorResponse().GetErrorCode(); code != int32(codes.NotFound) {
+		t.Errorf("expected NotFound for an unknown type, got %d", code)
+	}
+}
@@ -5,8 +5,7 @@ import (
 
 	"google.golang.org/grpc/codes"
 	reflectionv1 "google.golang.org/grpc/reflection/grpc_reflection_v1"
-	"google.golang.org/protobuf/proto"
-	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
@@ -17,17 +16,21 @@ type FileDescriptorsGetter interface {
 type ServerReflectionV1 struct {
 	// ServerReflectionServer handles gRPC reflection requests
 	reflectionv1.ServerReflectionServer
-	fdg FileDescriptorsGetter
+	resolver *reflectionResolver
 }
 
-func NewServerReflectionV1(fdg FileDescriptorsGetter) *ServerReflectionV1 {
-	return &ServerReflectionV1{fdg: fdg}
+func NewServerReflectionV1(fdg FileDescriptorsGetter, opts ...ServerReflectionOption) *ServerReflectionV1 {
+	o := newServerReflectionOptions(opts)
+	return &ServerReflectionV1{resolver: &reflectionResolver{fdg: fdg, upstream: o.upstream}}
 }
 
-// ServerReflectionInfo handles the bi-directional reflection stream, routing each request to helpers
+// ServerReflectionInfo handles the bi-directional reflection stream, routing each request to helpers.
+// The files already sent on the stream are not sent again as dependencies.
 func (s *ServerReflectionV1) ServerReflectionInfo(
 	stream reflectionv1.ServerReflection_ServerReflectionInfoServer,
 ) error {
+	ctx := stream.Context()
+	sent := map[string]bool{}
 	for {
 		req, err := stream.Recv()
 		if err == io.EOF {
@@ -36,120 +39,81 @@ func (s *ServerReflectionV1) ServerReflectionInfo(
 			return err
 		}
 
-		host := req.GetHost()
-		orig := req
-
+		var resp *reflectionv1.ServerReflectionResponse
 		switch r := req.GetMessageRequest().(type) {
 		case *reflectionv1.ServerReflectionRequest_ListServices:
-			resp := s.buildListServicesResponse(host, orig)
-			if err := stream.Send(resp); err != nil {
-				return err
-			}
+			resp = s.buildListServicesResponse(req, s.resolver.listServices(ctx))
 
 		case *reflectionv1.ServerReflectionRequest_FileByFilename:
-			resp := s.buildFileByFilenameResponse(host, orig, r.FileByFilename)
-			if err := stream.Send(resp); err != nil {
-				return err
-			}
+			files, err := s.resolver.fileByFilename(ctx, sent, r.FileByFilename)
+			resp = s.buildFileDescriptorResponse(req, files, err)
 
 		case *reflectionv1.ServerReflectionRequest_FileContainingSymbol:
-			resp := s.buildFileContainingSymbolResponse(host, orig, r.FileContainingSymbol)
-			if err := stream.Send(resp); err != nil {
-				return err
-			}
+			files, err := s.resolver.fileContainingSymbol(ctx, sent, r.FileContainingSymbol)
+			resp = s.buildFileDescriptorResponse(req, files, err)
+
+		case *reflectionv1.ServerReflectionRequest_FileContainingExtension:
+			ext := r.FileContainingExtension
+			files, err := s.resolver.fileContainingExtension(ctx, sent, ext.GetContainingType(), ext.GetExtensionNumber())
+			resp = s.buildFileDescriptorResponse(req, files, err)
+
+		case *reflectionv1.ServerReflectionRequest_AllExtensionNumbersOfType:
+			numbers, err := s.resolver.allExtensionNumbersOfType(ctx, r.AllExtensionNumbersOfType)
+			resp = s.buildExtensionNumbersResponse(req, r.AllExtensionNumbersOfType, numbers, err)
 
 		default:
 			// unsupported reflection method
-			if err := stream.Send(s.errorResponse(host, orig, codes.Unimplemented, "request type not supported")); err != nil {
-				return err
-			}
+			resp = s.errorResponse(req, status.Error(codes.Unimplemented, "request type not supported"))
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
 		}
 	}
 }
 
-// buildListServicesResponse constructs a response listing all registered services
-func (s *ServerReflectionV1) buildListServicesResponse(host string, orig *reflectionv1.ServerReflectionRequest) *reflectionv1.ServerReflectionResponse {
-	seen := map[string]struct{}{}
+// buildListServicesResponse constructs a response listing the given services
+func (s *ServerReflectionV1) buildListServicesResponse(orig *reflectionv1.ServerReflectionRequest, names []string) *reflectionv1.ServerReflectionResponse {
 	svcResp := &reflectionv1.ListServiceResponse{}
-
-	for _, fd := range s.fdg.GetFileDescriptors() {
-		for i := 0; i < fd.Services().Len(); i++ {
-			name := string(fd.Services().Get(i).FullName())
-			if _, ok := seen[name]; !ok {
-				seen[name] = struct{}{}
-				svcResp.Service = append(svcResp.Service, &reflectionv1.ServiceResponse{Name: name})
-			}
-		}
+	for _, name := range names {
+		svcResp.Service = append(svcResp.Service, &reflectionv1.ServiceResponse{Name: name})
 	}
-
 	return &reflectionv1.ServerReflectionResponse{
-		ValidHost:       host,
+		ValidHost:       orig.GetHost(),
 		OriginalRequest: orig,
 		MessageResponse: &reflectionv1.ServerReflectionResponse_ListServicesResponse{ListServicesResponse: svcResp},
 	}
 }
 
-// buildFileByFilenameResponse finds and returns the FileDescriptorProto bytes for a given filename
-func (s *ServerReflectionV1) buildFileByFilenameResponse(host string, orig *reflectionv1.ServerReflectionRequest, filename string) *reflectionv1.ServerReflectionResponse {
-	fdpBytes, found := s.lookupFileDescriptorProtoBytes(func(fd protoreflect.FileDescriptor) bool {
-		return fd.Path() == filename
-	})
-
-	if !found {
-		return s.errorResponse(host, orig, codes.NotFound, "file not found")
+// buildFileDescriptorResponse constructs a response holding the FileDescriptorProto bytes, or the lookup error
+func (s *ServerReflectionV1) buildFileDescriptorResponse(orig *reflectionv1.ServerReflectionRequest, files [][]byte, err error) *reflectionv1.ServerReflectionResponse {
+	if err != nil {
+		return s.errorResponse(orig, err)
 	}
 	return &reflectionv1.ServerReflectionResponse{
-		ValidHost:       host,
+		ValidHost:       orig.GetHost(),
 		OriginalRequest: orig,
-		MessageResponse: &reflectionv1.ServerReflectionResponse_FileDescriptorResponse{FileDescriptorResponse: &reflectionv1.FileDescriptorResponse{FileDescriptorProto: [][]byte{fdpBytes}}},
+		MessageResponse: &reflectionv1.ServerReflectionResponse_FileDescriptorResponse{FileDescriptorResponse: &reflectionv1.FileDescriptorResponse{FileDescriptorProto: files}},
 	}
 }
 
-// buildFileContainingSymbolResponse returns the FileDescriptorProto bytes containing a given service or message symbol
-func (s *ServerReflectionV1) buildFileContainingSymbolResponse(host string, orig *reflectionv1.ServerReflectionRequest, symbol string) *reflectionv1.ServerReflectionResponse {
-	fdpBytes, found := s.lookupFileDescriptorProtoBytes(func(fd protoreflect.FileDescriptor) bool {
-		// search services
-		for i := range fd.Services().Len() {
-			if string(fd.Services().Get(i).FullName()) == symbol {
-				return true
-			}
-		}
-		// search messages
-		for i := range fd.Messages().Len() {
-			if string(fd.Messages().Get(i).FullName()) == symbol {
-				return true
-			}
-		}
-		return false
-	})
-
-	if !found {
-		return s.errorResponse(host, orig, codes.NotFound, "symbol not found")
+// buildExtensionNumbersResponse constructs a response holding the extension numbers of a type, or the lookup error
+func (s *ServerReflectionV1) buildExtensionNumbersResponse(orig *reflectionv1.ServerReflectionRequest, typeName string, numbers []int32, err error) *reflectionv1.ServerReflectionResponse {
+	if err != nil {
+		return s.errorResponse(orig, err)
 	}
 	return &reflectionv1.ServerReflectionResponse{
-		ValidHost:       host,
+		ValidHost:       orig.GetHost(),
 		OriginalRequest: orig,
-		MessageResponse: &reflectionv1.ServerReflectionResponse_FileDescriptorResponse{FileDescriptorResponse: &reflectionv1.FileDescriptorResponse{FileDescriptorProto: [][]byte{fdpBytes}}},
-	}
-}
-
-// lookupFileDescriptorProtoBytes searches allFileDescriptors using match and returns the marshaled FileDescriptorProto bytes
-func (s *ServerReflectionV1) lookupFileDescriptorProtoBytes(match func(protoreflect.FileDescriptor) bool) ([]byte, bool) {
-	for _, fd := range s.fdg.GetFileDescriptors() {
-		if match(fd) {
-			fdp := protodesc.ToFileDescriptorProto(fd)
-			b, _ := proto.Marshal(fdp)
-			return b, true
-		}
+		MessageResponse: &reflectionv1.ServerReflectionResponse_AllExtensionNumbersResponse{AllExtensionNumbersResponse: &reflectionv1.ExtensionNumberResponse{BaseTypeName: typeName, ExtensionNumber: numbers}},
 	}
-	return nil, false
 }
 
-// errorResponse constructs a standard reflection error response with the given code and message
-func (s *ServerReflectionV1) errorResponse(host string, orig *reflectionv1.ServerReflectionRequest, code codes.Code, msg string) *reflectionv1.ServerReflectionResponse {
+// errorResponse constructs a standard reflection error response from the status of err
+func (s *ServerReflectionV1) errorResponse(orig *reflectionv1.ServerReflectionRequest, err error) *reflectionv1.ServerReflectionResponse {
+	st := status.Convert(err)
 	return &reflectionv1.ServerReflectionResponse{
-		ValidHost:       host,
+		ValidHost:       orig.GetHost(),
 		OriginalRequest: orig,
-		MessageResponse: &reflectionv1.ServerReflectionResponse_ErrorResponse{ErrorResponse: &reflectionv1.ErrorResponse{ErrorCode: int32(code), ErrorMessage: msg}},
+		MessageResponse: &reflectionv1.ServerReflectionResponse_ErrorResponse{ErrorResponse: &reflectionv1.ErrorResponse{ErrorCode: int32(st.Code()), ErrorMessage: st.Message()}},
 	}
 }
@@ -5,25 +5,26 @@ import (
 
 	"google.golang.org/grpc/codes"
 	reflectionv1alpha "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
-	"google.golang.org/protobuf/proto"
-	"google.golang.org/protobuf/reflect/protodesc"
-	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/grpc/status"
 )
 
 type ServerReflectionV1Alpha struct {
 	reflectionv1alpha.ServerReflectionServer
-	fdg FileDescriptorsGetter
+	resolver *reflectionResolver
 }
 
-func NewServerReflectionV1Alpha(fdg FileDescriptorsGetter) *ServerReflectionV1Alpha {
-	return &ServerReflectionV1Alpha{
-		fdg: fdg,
-	}
+func NewServerReflectionV1Alpha(fdg FileDescriptorsGetter, opts ...ServerReflectionOption) *ServerReflectionV1Alpha {
+	o := newServerReflectionOptions(opts)
+	return &ServerReflectionV1Alpha{resolver: &reflectionResolver{fdg: fdg, upstream: o.upstream}}
 }
 
+// ServerReflectionInfo handles the bi-directional reflection stream, routing each request to helpers.
+// The files already sent on the stream are not sent again as dependencies.
 func (s *ServerReflectionV1Alpha) ServerReflectionInfo(
 	stream reflectionv1alpha.ServerReflection_ServerReflectionInfoServer,
 ) error {
+	ctx := stream.Context()
+	sent := map[string]bool{}
 	for {
 		req, err := stream.Recv()
 		if err == io.EOF {
@@ -32,112 +33,80 @@ func (s *ServerReflectionV1Alpha) ServerReflectionInfo(
 			return err
 		}
 
-		host := req.GetHost()
-		orig := req
-
+		var resp *reflectionv1alpha.ServerReflectionResponse
 		switch r := req.GetMessageRequest().(type) {
 		case *reflectionv1alpha.ServerReflectionRequest_ListServices:
-			resp := s.buildListServicesResponse(host, orig)
-			if err := stream.Send(resp); err != nil {
-				return err
-			}
+			resp = s.buildListServicesResponse(req, s.resolver.listServices(ctx))
 
 		case *reflectionv1alpha.ServerReflectionRequest_FileByFilename:
-			resp := s.buildFileByFilenameResponse(host, orig, r.FileByFilename)
-			if err := stream.Send(resp); err != nil {
-				return err
-			}
+			files, err := s.resolver.fileByFilename(ctx, sent, r.FileByFilename)
+			resp = s.buildFileDescriptorResponse(req, files, err)
 
 		case *reflectionv1alpha.ServerReflectionRequest_FileContainingSymbol:
-			resp := s.buildFileContainingSymbolResponse(host, orig, r.FileContainingSymbol)
-			if err := stream.Send(resp); err != nil {
-				return err
-			}
+			files, err := s.resolver.fileContainingSymbol(ctx, sent, r.FileContainingSymbol)
+			resp = s.buildFileDescriptorResponse(req, files, err)
+
+		case *reflectionv1alpha.ServerReflectionRequest_FileContainingExtension:
+			ext := r.FileContainingExtension
+			files, err := s.resolver.fileContainingExtension(ctx, sent, ext.GetContainingType(), ext.GetExtensionNumber())
+			resp = s.buildFileDescriptorResponse(req, files, err)
+
+		case *reflectionv1alpha.ServerReflectionRequest_AllExtensionNumbersOfType:
+			numbers, err := s.resolver.allExtensionNumbersOfType(ctx, r.AllExtensionNumbersOfType)
+			resp = s.buildExtensionNumbersResponse(req, r.AllExtensionNumbersOfType, numbers, err)
 
 		default:
-			if err := stream.Send(s.errorResponse(host, orig, codes.Unimplemented, "request type not supported")); err != nil {
-				return err
-			}
+			resp = s.errorResponse(req, status.Error(codes.Unimplemented, "request type not supported"))
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
 		}
 	}
 }
 
-func (s *ServerReflectionV1Alpha) buildListServicesResponse(host string, orig *reflectionv1alpha.ServerReflectionRequest) *reflectionv1alpha.ServerReflectionResponse {
-	seen := map[string]struct{}{}
+// buildListServicesResponse constructs a response listing the given services
+func (s *ServerReflectionV1Alpha) buildListServicesResponse(orig *reflectionv1alpha.ServerReflectionRequest, names []string) *reflectionv1alpha.ServerReflectionResponse {
 	svcResp := &reflectionv1alpha.ListServiceResponse{}
-
-	for _, fd := range s.fdg.GetFileDescriptors() {
-		for i := 0; i < fd.Services().Len(); i++ {
-			name := string(fd.Services().Get(i).FullName())
-			if _, ok := seen[name]; !ok {
-				seen[name] = struct{}{}
-				svcResp.Service = append(svcResp.Service, &reflectionv1alpha.ServiceResponse{Name: name})
-			}
-		}
+	for _, name := range names {
+		svcResp.Service = append(svcResp.Service, &reflectionv1alpha.ServiceResponse{Name: name})
 	}
-
 	return &reflectionv1alpha.ServerReflectionResponse{
-		ValidHost:       host,
+		ValidHost:       orig.GetHost(),
 		OriginalRequest: orig,
 		MessageResponse: &reflectionv1alpha.ServerReflectionResponse_ListServicesResponse{ListServicesResponse: svcResp},
 	}
 }
 
-func (s *ServerReflectionV1Alpha) buildFileByFilenameResponse(host string, orig *reflectionv1alpha.ServerReflectionRequest, filename string) *reflectionv1alpha.ServerReflectionResponse {
-	fdpBytes, found := s.lookupFileDescriptorProtoBytes(func(fd protoreflect.FileDescriptor) bool {
-		return fd.Path() == filename
-	})
-
-	if !found {
-		return s.errorResponse(host, orig, codes.NotFound, "file not found")
+// buildFileDescriptorResponse constructs a response holding the FileDescriptorProto bytes, or the lookup error
+func (s *ServerReflectionV1Alpha) buildFileDescriptorResponse(orig *reflectionv1alpha.ServerReflectionRequest, files [][]byte, err error) *reflectionv1alpha.ServerReflectionResponse {
+	if err != nil {
+		return s.errorResponse(orig, err)
 	}
 	return &reflectionv1alpha.ServerReflectionResponse{
-		ValidHost:       host,
+		ValidHost:       orig.GetHost(),
 		OriginalRequest: orig,
-		MessageResponse: &reflectionv1alpha.ServerReflectionResponse_FileDescriptorResponse{FileDescriptorResponse: &reflectionv1alpha.FileDescriptorResponse{FileDescriptorProto: [][]byte{fdpBytes}}},
+		MessageResponse: &reflectionv1alpha.ServerReflectionResponse_FileDescriptorResponse{FileDescriptorResponse: &reflectionv1alpha.FileDescriptorResponse{FileDescriptorProto: files}},
 	}
 }
 
-func (s *ServerReflectionV1Alpha) buildFileContainingSymbolResponse(host string, orig *reflectionv1alpha.ServerReflectionRequest, symbol string) *reflectionv1alpha.ServerReflectionResponse {
-	fdpBytes, found := s.lookupFileDescriptorProtoBytes(func(fd protoreflect.FileDescriptor) bool {
-		for i := range fd.Services().Len() {
-			if string(fd.Services().Get(i).FullName()) == symbol {
-				return true
-			}
-		}
-		for i := range fd.Messages().Len() {
-			if string(fd.Messages().Get(i).FullName()) == symbol {
-				return true
-			}
-		}
-		return false
-	})
-
-	if !found {
-		return s.errorResponse(host, orig, codes.NotFound, "symbol not found")
+// buildExtensionNumbersResponse constructs a response holding the extension numbers of a type, or the lookup error
+func (s *ServerReflectionV1Alpha) buildExtensionNumbersResponse(orig *reflectionv1alpha.ServerReflectionRequest, typeName string, numbers []int32, err error) *reflectionv1alpha.ServerReflectionResponse {
+	if err != nil {
+		return s.errorResponse(orig, err)
 	}
 	return &reflectionv1alpha.ServerReflectionResponse{
-		ValidHost:       host,
+		ValidHost:       orig.GetHost(),
 		OriginalRequest: orig,
-		MessageResponse: &reflectionv1alpha.ServerReflectionResponse_FileDescriptorResponse{FileDescriptorResponse: &reflectionv1alpha.FileDescriptorResponse{FileDescriptorProto: [][]byte{fdpBytes}}},
-	}
-}
-
-func (s *ServerReflectionV1Alpha) lookupFileDescriptorProtoBytes(match func(protoreflect.FileDescriptor) bool) ([]byte, bool) {
-	for _, fd := range s.fdg.GetFileDescriptors() {
-		if match(fd) {
-			fdp := protodesc.ToFileDescriptorProto(fd)
-			b, _ := proto.Marshal(fdp)
-			return b, true
-		}
+		MessageResponse: &reflectionv1alpha.ServerReflectionResponse_AllExtensionNumbersResponse{AllExtensionNumbersResponse: &reflectionv1alpha.ExtensionNumberResponse{BaseTypeName: typeName, ExtensionNumber: numbers}},
 	}
-	return nil, false
 }
 
-func (s *ServerReflectionV1Alpha) errorResponse(host string, orig *reflectionv1alpha.ServerReflectionRequest, code codes.Code, msg string) *reflectionv1alpha.ServerReflectionResponse {
+// errorResponse constructs a standard reflection error response from the status of err
+func (s *ServerReflectionV1Alpha) errorResponse(orig *reflectionv1alpha.ServerReflectionRequest, err error) *reflectionv1alpha.ServerReflectionResponse {
+	st := status.Convert(err)
 	return &reflectionv1alpha.ServerReflectionResponse{
-		ValidHost:       host,
+		ValidHost:       orig.GetHost(),
 		OriginalRequest: orig,
-		MessageResponse: &reflectionv1alpha.ServerReflectionResponse_ErrorResponse{ErrorResponse: &reflectionv1alpha.ErrorResponse{ErrorCode: int32(code), ErrorMessage: msg}},
+		MessageResponse: &reflectionv1alpha.ServerReflectionResponse_ErrorResponse{ErrorResponse: &reflectionv1alpha.ErrorResponse{ErrorCode: int32(st.Code()), ErrorMessage: st.Message()}},
 	}
 }
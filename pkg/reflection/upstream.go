@@ -0,0 +1,347 @@
+package reflection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	reflectionv1 "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// v1alpha messages share the v1 wire format, so both versions are queried with the v1 types
+const (
+	reflectionV1Method      = "/grpc.reflection.v1.ServerReflection/ServerReflectionInfo"
+	reflectionV1AlphaMethod = "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo"
+)
+
+// ImportUpstream registers the descriptors served by the reflection service of the server at target,
+// and returns the registered paths. Files defined locally, registered or staged, are kept unless
+// replace is set: the imported files importing them are linked to the local ones.
+func ImportUpstream(ctx context.Context, registry DescriptorRegistry, target string, replace bool) ([]string, error) {
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	set, err := FetchUpstreamDescriptors(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(set.GetFile()) == 0 {
+		return nil, errors.New("upstream reflection exposes no service")
+	}
+	if !replace {
+		set = withoutLocalFiles(registry, set)
+	}
+	return registry.RegisterDescriptorSet(set)
+}
+
+// withoutLocalFiles returns the files of set which are neither registered nor staged in registry.
+func withoutLocalFiles(registry DescriptorRegistry, set *descriptorpb.FileDescriptorSet) *descriptorpb.FileDescriptorSet {
+	local := map[string]bool{}
+	for _, fd := range registry.GetFileDescriptors() {
+		if !IsBuiltinFile(fd) {
+			local[fd.Path()] = true
+		}
+	}
+	for _, path := range registry.PendingFiles() {
+		local[path] = true
+	}
+	kept := &descriptorpb.FileDescriptorSet{}
+	var skipped []string
+	for _, fdp := range set.GetFile() {
+		if local[fdp.GetName()] {
+			skipped = append(skipped, fdp.GetName())
+		} else {
+			kept.File = append(kept.File, fdp)
+		}
+	}
+	if len(skipped) > 0 {
+		log.Printf("upstream files skipped, defined locally: %s", strings.Join(skipped, ", "))
+	}
+	return kept
+}
+
+// FetchUpstreamDescriptors downloads, through the reflection service of conn, the files of every
+// service it exposes along with their imports. Reflection v1 is tried first, then v1alpha.
+// Well-known files are left out, they are known locally.
+func FetchUpstreamDescriptors(ctx context.Context, conn grpc.ClientConnInterface) (*descriptorpb.FileDescriptorSet, error) {
+	set, err := fetchDescriptors(ctx, conn, reflectionV1Method)
+	if status.Code(err) == codes.Unimplemented {
+		set, err = fetchDescriptors(ctx, conn, reflectionV1AlphaMethod)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("upstream reflection: %w", err)
+	}
+	return set, nil
+}
+
+func fetchDescriptors(ctx context.Context, conn grpc.ClientConnInterface, method string) (*descriptorpb.FileDescriptorSet, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}, method, grpc.WaitForReady(true))
+	if err != nil {
+		return nil, err
+	}
+	c := &reflectionClient{stream: stream}
+	defer c.stream.CloseSend()
+
+	resp, err := c.roundTrip(&reflectionv1.ServerReflectionRequest{
+		MessageRequest: &reflectionv1.ServerReflectionRequest_ListServices{ListServices: "*"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]*descriptorpb.FileDescriptorProto{}
+	var order []string
+	add := func(resp *reflectionv1.ServerReflectionResponse) error {
+		for _, b := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			fdp := &descriptorpb.FileDescriptorProto{}
+			if err := proto.Unmarshal(b, fdp); err != nil {
+				return fmt.Errorf("invalid file descriptor: %w", err)
+			}
+			if _, exists := files[fdp.GetName()]; !exists {
+				files[fdp.GetName()] = fdp
+				order = append(order, fdp.GetName())
+			}
+		}
+		return nil
+	}
+
+	for _, svc := range resp.GetListServicesResponse().GetService() {
+		if strings.HasPrefix(svc.GetName(), "grpc.reflection.") {
+			continue
+		}
+		resp, err := c.roundTrip(&reflectionv1.ServerReflectionRequest{
+			MessageRequest: &reflectionv1.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: svc.GetName()},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("file of %s: %w", svc.GetName(), err)
+		}
+		if err := add(resp); err != nil {
+			return nil, err
+		}
+	}
+
+	// Servers may send a file without its imports, they are fetched one by one
+	for i := 0; i < len(order); i++ {
+		for _, dep := range files[order[i]].GetDependency() {
+			if _, exists := files[dep]; exists || isBuiltinPath(dep) {
+				continue
+			}
+			resp, err := c.roundTrip(&reflectionv1.ServerReflectionRequest{
+				MessageRequest: &reflectionv1.ServerReflectionRequest_FileByFilename{FileByFilename: dep},
+			})
+			if err != nil {
+				return nil, fmt.Errorf("file %s: %w", dep, err)
+			}
+			if err := add(resp); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	for _, name := range order {
+		if !isBuiltinPath(name) {
+			set.File = append(set.File, files[name])
+		}
+	}
+	return set, nil
+}
+
+func isBuiltinPath(path string) bool {
+	_, err := protoregistry.GlobalFiles.FindFileByPath(path)
+	return err == nil
+}
+
+// UpstreamReflection answers, from the reflection service of an upstream, the reflection requests
+// the local descriptors can't.
+type UpstreamReflection interface {
+	ListServices(ctx context.Context) ([]string, error)
+	// FileByFilename, FileContainingSymbol and FileContainingExtension return serialized FileDescriptorProtos
+	FileByFilename(ctx context.Context, filename string) ([][]byte, error)
+	FileContainingSymbol(ctx context.Context, symbol string) ([][]byte, error)
+	FileContainingExtension(ctx context.Context, containingType string, number int32) ([][]byte, error)
+	AllExtensionNumbersOfType(ctx context.Context, typeName string) ([]int32, error)
+}
+
+// upstreamTimeout bounds each request forwarded to the upstream reflection
+const upstreamTimeout = 10 * time.Second
+
+// ServerReflectionOption configures NewServerReflectionV1 and NewServerReflectionV1Alpha.
+type ServerReflectionOption func(*serverReflectionOptions)
+
+type serverReflectionOptions struct {
+	upstream UpstreamReflection
+}
+
+func newServerReflectionOptions(opts []ServerReflectionOption) serverReflectionOptions {
+	o := serverReflectionOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithUpstream merges the services of upstream with the local ones, and asks it for the files and
+// symbols not found locally. Local definitions win on conflicts.
+func WithUpstream(upstream UpstreamReflection) ServerReflectionOption {
+	return func(o *serverReflectionOptions) {
+		o.upstream = upstream
+	}
+}
+
+// upstreamServices returns the services of the upstream, nil when there is none or it fails.
+func upstreamServices(ctx context.Context, upstream UpstreamReflection) []string {
+	if upstream == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+	names, err := upstream.ListServices(ctx)
+	if err != nil {
+		log.Printf("warning: list upstream services: %v", err)
+		return nil
+	}
+	return names
+}
+
+// upstreamFiles forwards to the upstream a request not answered locally, and reports whether it answered.
+func upstreamFiles(ctx context.Context, upstream UpstreamReflection, fetch func(context.Context, UpstreamReflection) ([][]byte, error)) ([][]byte, bool) {
+	if upstream == nil {
+		return nil, false
+	}
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+	files, err := fetch(ctx, upstream)
+	if err != nil {
+		if status.Code(err) != codes.NotFound {
+			log.Printf("warning: upstream reflection: %v", err)
+		}
+		return nil, false
+	}
+	return files, true
+}
+
+// UpstreamClient queries the reflection service of an upstream, one stream per request.
+// Reflection v1 is used unless the upstream only implements v1alpha.
+type UpstreamClient struct {
+	conn *grpc.ClientConn
+	// v1alpha is set once the upstream answered Unimplemented to v1
+	v1alpha atomic.Bool
+}
+
+// NewUpstreamClient returns a client of the reflection service of target. The connection is lazy.
+func NewUpstreamClient(target string) (*UpstreamClient, error) {
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	return &UpstreamClient{conn: conn}, nil
+}
+
+func (u *UpstreamClient) Close() error {
+	return u.conn.Close()
+}
+
+func (u *UpstreamClient) do(ctx context.Context, req *reflectionv1.ServerReflectionRequest) (*reflectionv1.ServerReflectionResponse, error) {
+	if !u.v1alpha.Load() {
+		resp, err := u.roundTrip(ctx, reflectionV1Method, req)
+		if status.Code(err) != codes.Unimplemented {
+			return resp, err
+		}
+		u.v1alpha.Store(true)
+	}
+	return u.roundTrip(ctx, reflectionV1AlphaMethod, req)
+}
+
+func (u *UpstreamClient) roundTrip(ctx context.Context, method string, req *reflectionv1.ServerReflectionRequest) (*reflectionv1.ServerReflectionResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := u.conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}, method)
+	if err != nil {
+		return nil, err
+	}
+	c := &reflectionClient{stream: stream}
+	defer c.stream.CloseSend()
+	return c.roundTrip(req)
+}
+
+func (u *UpstreamClient) ListServices(ctx context.Context) ([]string, error) {
+	resp, err := u.do(ctx, &reflectionv1.ServerReflectionRequest{
+		MessageRequest: &reflectionv1.ServerReflectionRequest_ListServices{ListServices: "*"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, svc := range resp.GetListServicesResponse().GetService() {
+		names = append(names, svc.GetName())
+	}
+	return names, nil
+}
+
+func (u *UpstreamClient) FileByFilename(ctx context.Context, filename string) ([][]byte, error) {
+	resp, err := u.do(ctx, &reflectionv1.ServerReflectionRequest{
+		MessageRequest: &reflectionv1.ServerReflectionRequest_FileByFilename{FileByFilename: filename},
+	})
+	return resp.GetFileDescriptorResponse().GetFileDescriptorProto(), err
+}
+
+func (u *UpstreamClient) FileContainingSymbol(ctx context.Context, symbol string) ([][]byte, error) {
+	resp, err := u.do(ctx, &reflectionv1.ServerReflectionRequest{
+		MessageRequest: &reflectionv1.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: symbol},
+	})
+	return resp.GetFileDescriptorResponse().GetFileDescriptorProto(), err
+}
+
+func (u *UpstreamClient) FileContainingExtension(ctx context.Context, containingType string, number int32) ([][]byte, error) {
+	resp, err := u.do(ctx, &reflectionv1.ServerReflectionRequest{
+		MessageRequest: &reflectionv1.ServerReflectionRequest_FileContainingExtension{
+			FileContainingExtension: &reflectionv1.ExtensionRequest{ContainingType: containingType, ExtensionNumber: number},
+		},
+	})
+	return resp.GetFileDescriptorResponse().GetFileDescriptorProto(), err
+}
+
+func (u *UpstreamClient) AllExtensionNumbersOfType(ctx context.Context, typeName string) ([]int32, error) {
+	resp, err := u.do(ctx, &reflectionv1.ServerReflectionRequest{
+		MessageRequest: &reflectionv1.ServerReflectionRequest_AllExtensionNumbersOfType{AllExtensionNumbersOfType: typeName},
+	})
+	return resp.GetAllExtensionNumbersResponse().GetExtensionNumber(), err
+}
+
+// reflectionClient sends reflection requests one at a time on a stream.
+type reflectionClient struct {
+	stream grpc.ClientStream
+}
+
+func (c *reflectionClient) roundTrip(req *reflectionv1.ServerReflectionRequest) (*reflectionv1.ServerReflectionResponse, error) {
+	// A failed send means the server ended the stream, its status is read by RecvMsg
+	if err := c.stream.SendMsg(req); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	resp := &reflectionv1.ServerReflectionResponse{}
+	if err := c.stream.RecvMsg(resp); err != nil {
+		return nil, err
+	}
+	if e := resp.GetErrorResponse(); e != nil {
+		return nil, status.Error(codes.Code(e.GetErrorCode()), e.GetErrorMessage())
+	}
+	return resp, nil
+}
@@ -0,0 +1,186 @@
+package reflection_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/reflection"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	reflectionv1 "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	reflectionv1alpha "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Test importing the descriptors of an upstream exposing reflection v1alpha only
+func TestImportUpstream(t *testing.T) {
+	upstream := reflection.NewDefaultDescriptorRegistry()
+	upstream.StageProtoFile(reflection.DefaultBatch, "api/common.proto", `syntax = "proto3"; package common; import "google/protobuf/timestamp.proto";
+message User { string name = 1; google.protobuf.Timestamp created = 2; }`)
+	upstream.StageProtoFile(reflection.DefaultBatch, "api/svc.proto", `syntax = "proto3"; package svc; import "api/common.proto";
+service Users { rpc Get(common.User) returns (common.User); }`)
+	if err := upstream.CompileAndRegister(); err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := grpc.NewServer()
+	reflectionv1alpha.RegisterServerReflectionServer(srv, reflection.NewServerReflectionV1Alpha(upstream))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	registry := reflection.NewDefaultDescriptorRegistry()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	paths, err := reflection.ImportUpstream(ctx, registry, lis.Addr().String(), false)
+	if err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	if len(paths) != 2 {
+		t.Errorf("expected api/common.proto and api/svc.proto, got %v", paths)
+	}
+	method, ok := registry.GetMethodDescriptor("/svc.Users/Get")
+	if !ok {
+		t.Fatal("/svc.Users/Get must be registered")
+	}
+	if method.Input().Fields().ByName("created") == nil {
+		t.Error("expected the imported User message")
+	}
+
+	// Local files are kept, unless replacing them is asked
+	local := reflection.NewDefaultDescriptorRegistry()
+	if err := local.RegisterProtoFile("api/common.proto", `syntax = "proto3"; package common; message User { string name = 1; string local = 2; }`); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	paths, err = reflection.ImportUpstream(ctx, local, lis.Addr().String(), false)
+	if err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	if len(paths) != 1 || paths[0] != "api/svc.proto" {
+		t.Errorf("expected api/svc.proto only, got %v", paths)
+	}
+	if method, _ := local.GetMethodDescriptor("/svc.Users/Get"); method == nil || method.Input().Fields().ByName("local") == nil {
+		t.Error("expected the imported service linked to the local User message")
+	}
+	if _, err := reflection.ImportUpstream(ctx, local, lis.Addr().String(), true); err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	if method, _ := local.GetMethodDescriptor("/svc.Users/Get"); method == nil || method.Input().Fields().ByName("created") == nil {
+		t.Error("expected the local User message replaced")
+	}
+}
+
+// Test the local reflection completed with the one of an upstream, local definitions first
+func TestServerReflection_Upstream(t *testing.T) {
+	upstream := reflection.NewDefaultDescriptorRegistry()
+	upstream.StageProtoFile(reflection.DefaultBatch, "api/svc.proto", `syntax = "proto3"; package svc;
+message User { string name = 1; }
+service Users { rpc Get(User) returns (User); }`)
+	upstream.StageProtoFile(reflection.DefaultBatch, "api/shared.proto", `syntax = "proto3"; package shared; message Upstream {}`)
+	if err := upstream.CompileAndRegister(); err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+	upstreamLis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	upstreamSrv := grpc.NewServer()
+	reflectionv1alpha.RegisterServerReflectionServer(upstreamSrv, reflection.NewServerReflectionV1Alpha(upstream))
+	go upstreamSrv.Serve(upstreamLis)
+	defer upstreamSrv.Stop()
+
+	local := reflection.NewDefaultDescriptorRegistry()
+	local.StageProtoFile(reflection.DefaultBatch, "api/shared.proto", `syntax = "proto3"; package shared; message Local {}`)
+	local.StageProtoFile(reflection.DefaultBatch, "api/orders.proto", `syntax = "proto3"; package orders;
+message Order {}
+service Orders { rpc Get(Order) returns (Order); }`)
+	if err := local.CompileAndRegister(); err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+	upstreamClient, err := reflection.NewUpstreamClient(upstreamLis.Addr().String())
+	if err != nil {
+		t.Fatalf("upstream client: %v", err)
+	}
+	defer upstreamClient.Close()
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := grpc.NewServer()
+	reflectionv1.RegisterServerReflectionServer(srv, reflection.NewServerReflectionV1(local, reflection.WithUpstream(upstreamClient)))
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := reflectionv1.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		t.Fatalf("reflection stream: %v", err)
+	}
+	ask := func(req *reflectionv1.ServerReflectionRequest) *reflectionv1.ServerReflectionResponse {
+		t.Helper()
+		if err := stream.Send(req); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("recv: %v", err)
+		}
+		return resp
+	}
+	fileOf := func(resp *reflectionv1.ServerReflectionResponse) *descriptorpb.FileDescriptorProto {
+		t.Helper()
+		files := resp.GetFileDescriptorResponse().GetFileDescriptorProto()
+		if len(files) == 0 {
+			t.Fatalf("expected a file, got %v", resp.GetErrorResponse())
+		}
+		fdp := &descriptorpb.FileDescriptorProto{}
+		if err := proto.Unmarshal(files[0], fdp); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		return fdp
+	}
+
+	resp := ask(&reflectionv1.ServerReflectionRequest{
+		MessageRequest: &reflectionv1.ServerReflectionRequest_ListServices{ListServices: "*"},
+	})
+	services := map[string]int{}
+	for _, svc := range resp.GetListServicesResponse().GetService() {
+		services[svc.GetName()]++
+	}
+	if services["orders.Orders"] != 1 || services["svc.Users"] != 1 || services["grpc.reflection.v1alpha.ServerReflection"] != 1 {
+		t.Errorf("expected local and upstream services once, got %v", services)
+	}
+
+	resp = ask(&reflectionv1.ServerReflectionRequest{
+		MessageRequest: &reflectionv1.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "svc.Users"},
+	})
+	if fdp := fileOf(resp); fdp.GetName() != "api/svc.proto" {
+		t.Errorf("expected api/svc.proto from upstream, got %s", fdp.GetName())
+	}
+
+	resp = ask(&reflectionv1.ServerReflectionRequest{
+		MessageRequest: &reflectionv1.ServerReflectionRequest_FileByFilename{FileByFilename: "api/shared.proto"},
+	})
+	if fdp := fileOf(resp); len(fdp.GetMessageType()) != 1 || fdp.GetMessageType()[0].GetName() != "Local" {
+		t.Errorf("expected the local api/shared.proto to win, got %v", fdp.GetMessageType())
+	}
+
+	resp = ask(&reflectionv1.ServerReflectionRequest{
+		MessageRequest: &reflectionv1.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "unknown.Service"},
+	})
+	if resp.GetErrorResponse().GetErrorCode() != 5 {
+		t.Errorf("expected NotFound, got %v", resp)
+	}
+}
@@ -0,0 +1,123 @@
+package grpc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/redact"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/reflection"
+	// Registers the standard error details (BadRequest, RetryInfo...) so that they can be decoded
+	_ "google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// captureCallInfo fills h with the properties of the incoming call found in ctx.
+func captureCallInfo(ctx context.Context, h *history.History, redactor *redact.Redactor) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(":authority"); len(values) > 0 {
+			h.Authority = values[0]
+		}
+		h.RequestMetadata = mergeMetadata(nil, md, redactor)
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		h.Peer = p.Addr.String()
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		h.Deadline = &deadline
+	}
+	// The transport stream knows the compression used by the client, it isn't part of the public API
+	if ts, ok := grpc.ServerTransportStreamFromContext(ctx).(interface{ RecvCompress() string }); ok {
+		h.Compression = ts.RecvCompress()
+	}
+}
+
+// mergeMetadata appends the redacted md into dst, encoding binary values in base64 so that they survive JSON.
+func mergeMetadata(dst map[string][]string, md metadata.MD, redactor *redact.Redactor) map[string][]string {
+	if len(md) == 0 {
+		return dst
+	}
+	if dst == nil {
+		dst = map[string][]string{}
+	}
+	encoded := make(map[string][]string, len(md))
+	for k, values := range md {
+		for _, v := range values {
+			if strings.HasSuffix(k, "-bin") {
+				v = base64.StdEncoding.EncodeToString([]byte(v))
+			}
+			encoded[k] = append(encoded[k], v)
+		}
+	}
+	for k, values := range redactor.Metadata(encoded) {
+		dst[k] = append(dst[k], values...)
+	}
+	return dst
+}
+
+// decodeStatusDetails converts the details of s into JSON friendly values.
+// Unknown detail types are kept as their type URL and base64 value.
+func decodeStatusDetails(s *status.Status, descriptorRegistry reflection.DescriptorRegistry, redactor *redact.Redactor) []any {
+	details := s.Proto().GetDetails()
+	if len(details) == 0 {
+		return nil
+	}
+	opts := protojson.MarshalOptions{Resolver: detailsResolver{descriptorRegistry: descriptorRegistry}}
+	res := make([]any, 0, len(details))
+	for _, d := range details {
+		if b, err := opts.Marshal(redactor.Message(d)); err == nil {
+			var obj map[string]any
+			if err := json.Unmarshal(b, &obj); err == nil {
+				res = append(res, obj)
+				continue
+			}
+		}
+		res = append(res, map[string]any{
+			"@type": d.GetTypeUrl(),
+			"value": base64.StdEncoding.EncodeToString(d.GetValue()),
+		})
+	}
+	return res
+}
+
+// detailsResolver resolves Any types from the well-known types first, then from the uploaded protos.
+type detailsResolver struct {
+	descriptorRegistry reflection.DescriptorRegistry
+}
+
+func (r detailsResolver) FindMessageByName(name protoreflect.FullName) (protoreflect.MessageType, error) {
+	if mt, err := protoregistry.GlobalTypes.FindMessageByName(name); err == nil {
+		return mt, nil
+	}
+	if r.descriptorRegistry != nil {
+		if md, ok := r.descriptorRegistry.GetMessageDescriptor(string(name)); ok {
+			return dynamicpb.NewMessageType(md), nil
+		}
+	}
+	return nil, protoregistry.NotFound
+}
+
+func (r detailsResolver) FindMessageByURL(url string) (protoreflect.MessageType, error) {
+	name := url
+	if i := strings.LastIndexByte(url, '/'); i >= 0 {
+		name = url[i+1:]
+	}
+	return r.FindMessageByName(protoreflect.FullName(name))
+}
+
+func (r detailsResolver) FindExtensionByName(field protoreflect.FullName) (protoreflect.ExtensionType, error) {
+	return protoregistry.GlobalTypes.FindExtensionByName(field)
+}
+
+func (r detailsResolver) FindExtensionByNumber(message protoreflect.FullName, field protoreflect.FieldNumber) (protoreflect.ExtensionType, error) {
+	return protoregistry.GlobalTypes.FindExtensionByNumber(message, field)
+}
@@ -2,6 +2,7 @@ package grpc
 
 import (
 	"encoding/json"
+	"log"
 	"time"
 
 	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
@@ -14,9 +15,32 @@ import (
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/types/dynamicpb"
 )
 
+// proxyRoute reports whether the Handler answers a method from the proxy backend: when it has
+// no mock, or when its shadowed mock serves the upstream answer.
+func proxyRoute(mockRegistry mocks.Registry, descriptorRegistry reflection.DescriptorRegistry, p *proxy.Proxy) func(fullMethod string) bool {
+	return func(fullMethod string) bool {
+		if p == nil {
+			return false
+		}
+		mc, hasMock := mockRegistry.GetMock(fullMethod)
+		if !hasMock {
+			return true
+		}
+		methodDescriptor, _ := descriptorRegistry.GetMethodDescriptor(fullMethod)
+		return shadowable(mc, methodDescriptor) && mc.Shadow.Serve == mocks.ServeUpstream
+	}
+}
+
+// shadowable reports whether a call can be shadowed: only unary methods can, the mock
+// answering with a single response.
+func shadowable(mc mocks.MockConfig, methodDescriptor protoreflect.MethodDescriptor) bool {
+	return mc.Shadow != nil && methodDescriptor != nil && !methodDescriptor.IsStreamingClient() && !methodDescriptor.IsStreamingServer()
+}
+
 // Handler returns a grpc.StreamHandler that applies mock logic or proxies to a backend.
 // It looks up a mock configuration by fullMethod, applies optional delay and headers,
 // builds a dynamic response or returns a gRPC status error, and falls back to proxy if no mock.
@@ -47,7 +71,7 @@ func Handler(
 			}
 			wrappedStream, ok := stream.(*wrappedServerStream)
 			if ok {
-				wrappedStream.proxified = true
+				wrappedStream.setProxified()
 			}
 
 			if grpclog.V(2) {
@@ -56,6 +80,13 @@ func Handler(
 			return p.Handle(srv, stream)
 		}
 
+		if mc.Shadow != nil && p != nil {
+			if shadowable(mc, methodDescriptor) {
+				return handleShadow(stream, mc, methodDescriptor, p)
+			}
+			log.Printf("warning: %s is not unary, its mock is served without shadowing", fullMethod)
+		}
+
 		dynReq := dynamicpb.NewMessage(methodDescriptor.Input())
 		if err := stream.RecvMsg(dynReq); err != nil {
 			return status.Errorf(codes.Internal, "failed to receive message: %v", err)
@@ -74,19 +105,27 @@ func Handler(
 			}
 		}
 
-		if mc.GrpcStatus != 0 {
-			return status.Errorf(codes.Code(mc.GrpcStatus), "%s", mc.ErrorString)
+		dyn, err := mockResponse(mc, methodDescriptor)
+		if err != nil {
+			return err
 		}
+		return stream.SendMsg(dyn)
+	}
+}
 
-		dyn := dynamicpb.NewMessage(methodDescriptor.Output())
-		raw, _ := json.Marshal(mc.MockResponse)
-		if err := protojson.Unmarshal(raw, dyn); err != nil {
-			if grpclog.V(2) {
-				grpclog.Infof("[UnknownServiceHandler] json→message: %v", err)
-			}
-			return status.Errorf(codes.Internal, "json→message: %v", err)
-		}
+// mockResponse builds the response configured by mc, or its status error.
+func mockResponse(mc mocks.MockConfig, methodDescriptor protoreflect.MethodDescriptor) (*dynamicpb.Message, error) {
+	if mc.GrpcStatus != 0 {
+		return nil, status.Errorf(codes.Code(mc.GrpcStatus), "%s", mc.ErrorString)
+	}
 
-		return stream.SendMsg(dyn)
+	dyn := dynamicpb.NewMessage(methodDescriptor.Output())
+	raw, _ := json.Marshal(mc.MockResponse)
+	if err := protojson.Unmarshal(raw, dyn); err != nil {
+		if grpclog.V(2) {
+			grpclog.Infof("[UnknownServiceHandler] json→message: %v", err)
+		}
+		return nil, status.Errorf(codes.Internal, "json→message: %v", err)
 	}
+	return dyn, nil
 }
@@ -1,32 +1,59 @@
 package grpc
 
 import (
-	"encoding/base64"
-	"encoding/json"
+	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/drift"
 	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/payload"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/redact"
 	"github.com/marcaudefroy/grpc-hot-mock/pkg/reflection"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
-	"google.golang.org/protobuf/encoding/protojson"
-	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
-	"google.golang.org/protobuf/types/dynamicpb"
 )
 
 type wrappedServerStream struct {
 	grpc.ServerStream
 	streamServerInfo *grpc.StreamServerInfo
 	historyRegistry  history.RegistryWriter
-	history          *history.History
-	proxified        bool
 	methodDescriptor protoreflect.MethodDescriptor
+	// descriptorRegistry resolves the types of status details
+	descriptorRegistry reflection.DescriptorRegistry
+	decoder            *payload.Decoder
+	redactor           *redact.Redactor
+	drift              *drift.Tracker
+
+	// mu guards history and proxified: when proxying, SendMsg, RecvMsg and the
+	// metadata methods are called from two goroutines
+	mu        sync.Mutex
+	history   *history.History
+	proxified bool
 }
 
-func StreamInterceptor(historyRegistry history.RegistryWriter, descriptorRegistry reflection.DescriptorRegistry) grpc.StreamServerInterceptor {
+const (
+	// SessionHeader groups calls of a same test session in history
+	SessionHeader = "x-hotmock-session"
+	// TagHeader labels a call in history, it can be repeated
+	TagHeader = "x-hotmock-tag"
+	// CallIDHeader is the response header carrying the history ID of the call
+	CallIDHeader = "x-hotmock-call-id"
+	// RequestIDHeader is used as history ID when the client sets it and it's not already taken
+	RequestIDHeader = "x-request-id"
+)
+
+// maxRequestIDLength bounds the client IDs kept as history ID
+const maxRequestIDLength = 128
+
+func StreamInterceptor(historyRegistry history.RegistryWriter, descriptorRegistry reflection.DescriptorRegistry, opts ...Option) grpc.StreamServerInterceptor {
+	o := newOptions(opts)
+	decoder := payload.NewDecoder(descriptorRegistry, o.redactor)
 	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
 		h := history.History{
 			ID:         uuid.NewString(),
@@ -35,28 +62,58 @@ func StreamInterceptor(historyRegistry history.RegistryWriter, descriptorRegistr
 			Messages:   []history.Message{},
 			State:      history.StateOpen,
 		}
-		historyRegistry.SaveHistory(h)
+		if md, ok := metadata.FromIncomingContext(ss.Context()); ok {
+			if values := md.Get(SessionHeader); len(values) > 0 {
+				h.Session = values[0]
+			}
+			h.Tags = md.Get(TagHeader)
+			if values := md.Get(RequestIDHeader); len(values) > 0 && usableRequestID(values[0]) {
+				h.ID = values[0]
+			}
+		}
+		// Known before the call_opened event, so that live subscribers filtering on it see the whole call
+		h.Proxified = o.proxyRoute != nil && o.proxyRoute(info.FullMethod)
+		captureCallInfo(ss.Context(), &h, o.redactor)
+		// Reserved atomically: a client ID taken by another call, even a concurrent one, is not reused
+		if !historyRegistry.CreateHistory(h) {
+			h.ID = uuid.NewString()
+			historyRegistry.SaveHistory(h)
+		}
 
 		wrappedStream := &wrappedServerStream{
-			ServerStream:     ss,
-			historyRegistry:  historyRegistry,
-			streamServerInfo: info,
-			history:          &h,
+			ServerStream:       ss,
+			historyRegistry:    historyRegistry,
+			streamServerInfo:   info,
+			history:            &h,
+			descriptorRegistry: descriptorRegistry,
+			decoder:            decoder,
+			redactor:           o.redactor,
+			drift:              o.drift,
+			proxified:          h.Proxified,
 		}
 		if method, ok := descriptorRegistry.GetMethodDescriptor(info.FullMethod); ok {
 			wrappedStream.methodDescriptor = method
 		}
+		// Set rather than sent, so that it goes along with the headers of the mock or the upstream
+		if err := wrappedStream.SetHeader(metadata.Pairs(CallIDHeader, h.ID)); err != nil {
+			log.Printf("warning: set %s header failed: %v", CallIDHeader, err)
+		}
 
 		err := handler(srv, wrappedStream)
 		endTime := time.Now()
+
+		wrappedStream.mu.Lock()
+		defer wrappedStream.mu.Unlock()
 		h.EndTime = &endTime
 		h.State = history.StateClosed
+		h.Proxified = wrappedStream.proxified
 		if s, ok := status.FromError(err); ok {
 			h.GrpcCode = int32(s.Code())
-			h.GrpcMessage = s.Message()
+			h.GrpcMessage = o.redactor.String(s.Message())
+			h.StatusDetails = decodeStatusDetails(s, descriptorRegistry, o.redactor)
 		} else {
 			h.GrpcCode = int32(codes.Unknown)
-			h.GrpcMessage = err.Error()
+			h.GrpcMessage = o.redactor.String(err.Error())
 		}
 		wrappedStream.historyRegistry.SaveHistory(h)
 
@@ -64,102 +121,94 @@ func StreamInterceptor(historyRegistry history.RegistryWriter, descriptorRegistr
 	}
 }
 
+// usableRequestID reports whether a client supplied ID can identify the call in history:
+// it must be addressable by /history/{id}.
+func usableRequestID(id string) bool {
+	return id != "" && len(id) <= maxRequestIDLength && !strings.ContainsAny(id, "/?#")
+}
+
+func (w *wrappedServerStream) SetHeader(md metadata.MD) error {
+	err := w.ServerStream.SetHeader(md)
+	if err == nil {
+		w.recordHeader(md)
+	}
+	return err
+}
+
+func (w *wrappedServerStream) SendHeader(md metadata.MD) error {
+	err := w.ServerStream.SendHeader(md)
+	if err == nil {
+		w.recordHeader(md)
+	}
+	return err
+}
+
+func (w *wrappedServerStream) SetTrailer(md metadata.MD) {
+	w.ServerStream.SetTrailer(md)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.history.ResponseTrailers = mergeMetadata(w.history.ResponseTrailers, md, w.redactor)
+}
+
+func (w *wrappedServerStream) recordHeader(md metadata.MD) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.history.ResponseHeaders = mergeMetadata(w.history.ResponseHeaders, md, w.redactor)
+}
+
+// RecordUpstreamHeader implements proxy.UpstreamMetadataRecorder
+func (w *wrappedServerStream) RecordUpstreamHeader(md metadata.MD) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.history.UpstreamHeaders = mergeMetadata(w.history.UpstreamHeaders, md, w.redactor)
+}
+
+// RecordUpstreamTrailer implements proxy.UpstreamMetadataRecorder
+func (w *wrappedServerStream) RecordUpstreamTrailer(md metadata.MD) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.history.UpstreamTrailers = mergeMetadata(w.history.UpstreamTrailers, md, w.redactor)
+}
+
 func (w *wrappedServerStream) SendMsg(m any) error {
-	w.recordMessage("send", m)
+	w.recordMessage(payload.DirectionSend, m)
 	return w.ServerStream.SendMsg(m)
 }
 
 func (w *wrappedServerStream) RecvMsg(m any) error {
 	err := w.ServerStream.RecvMsg(m)
 	if err == nil {
-		w.recordMessage("recv", m)
+		w.recordMessage(payload.DirectionRecv, m)
 	}
 	return err
 }
 
-func (w *wrappedServerStream) recordMessage(direction string, payload any) {
-	var (
-		payloadStr string
-		payloadObj any
-		recognized bool
-	)
-
-	switch m := payload.(type) {
-	case proto.Message:
-		b, err := protojson.Marshal(m)
-		if err != nil {
-			payloadStr = "<invalid proto>"
-			payloadObj = nil
-			recognized = false
-			break
-		}
-		payloadStr = string(b)
-		recognized = true
-
-		if _, ok := m.(*dynamicpb.Message); ok {
-			var tmp map[string]any
-			if err := json.Unmarshal(b, &tmp); err == nil {
-				payloadObj = tmp
-			} else {
-				payloadObj = nil
-			}
-		} else {
-			payloadObj = m
-		}
-	case []byte:
-		if w.methodDescriptor != nil {
-			var dyn *dynamicpb.Message
-			if direction == "recv" {
-				dyn = dynamicpb.NewMessage(w.methodDescriptor.Input())
-			} else {
-				dyn = dynamicpb.NewMessage(w.methodDescriptor.Output())
-			}
-			if err := proto.Unmarshal(m, dyn); err == nil {
-				b, err := protojson.Marshal(dyn)
-				if err == nil {
-					payloadStr = string(b)
-
-					var tmp map[string]interface{}
-					if err := json.Unmarshal(b, &tmp); err == nil {
-						payloadObj = tmp
-					} else {
-						payloadObj = nil
-					}
-
-					recognized = true
-					break
-				}
-			}
-		}
+func (w *wrappedServerStream) recordMessage(direction string, m any) {
+	msg := w.decoder.Decode(w.methodDescriptor, direction, m)
+	msg.Timestamp = time.Now()
 
-		payloadStr = encodeBase64(m)
-		payloadObj = nil
-		recognized = false
-	default:
-		if b, err := json.Marshal(m); err == nil {
-			payloadStr = string(b)
-			payloadObj = m
-			recognized = true
-		} else {
-			payloadStr = "<invalid json>"
-			recognized = false
-		}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	msg.Proxified = w.proxified
+	if _, raw := m.([]byte); raw && w.proxified && direction == payload.DirectionSend {
+		w.recordDrift(msg)
 	}
-
-	w.history.Messages = append(w.history.Messages, history.Message{
-		Direction:     direction,
-		Timestamp:     time.Now(),
-		Recognized:    recognized,
-		Proxified:     w.proxified,
-		PayloadString: payloadStr,
-		Payload:       payloadObj,
-	})
+	w.history.Messages = append(w.history.Messages, msg)
+	// Pushed right away so that open streams show their messages live
+	w.historyRegistry.AppendMessage(w.history.ID, msg)
 }
 
-func encodeBase64(b []byte) string {
-	return base64.StdEncoding.EncodeToString(b)
+// recordDrift accounts an upstream response in the drift report, when its method is known.
+func (w *wrappedServerStream) recordDrift(msg history.Message) {
+	if w.drift == nil || w.methodDescriptor == nil {
+		return
+	}
+	w.drift.Record(w.history.FullMethod, w.history.ID, msg.Drift, !msg.Recognized)
 }
 
-func generateID() string {
-	return uuid.New().String()
+func (w *wrappedServerStream) setProxified() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.proxified = true
+	w.history.Proxified = true
 }
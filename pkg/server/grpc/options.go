@@ -0,0 +1,55 @@
+package grpc
+
+import (
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/drift"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/redact"
+)
+
+// Option configures NewServer and StreamInterceptor.
+type Option func(*options)
+
+type options struct {
+	redactor *redact.Redactor
+	drift    *drift.Tracker
+	// reflectionMerge completes the reflection service with the one of the proxy backend
+	reflectionMerge bool
+	// proxyRoute tells beforehand which methods the Handler answers from the proxy backend
+	proxyRoute func(fullMethod string) bool
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithRedactor hides sensitive payload fields and metadata before they are saved in history.
+func WithRedactor(r *redact.Redactor) Option {
+	return func(o *options) {
+		o.redactor = r
+	}
+}
+
+// WithDriftTracker inspects the responses of the proxy backend against the registered descriptors.
+func WithDriftTracker(t *drift.Tracker) Option {
+	return func(o *options) {
+		o.drift = t
+	}
+}
+
+// WithReflectionMerge lists the services of the proxy backend in the reflection service, and forwards
+// to its reflection the files and symbols not known locally.
+func WithReflectionMerge(enabled bool) Option {
+	return func(o *options) {
+		o.reflectionMerge = enabled
+	}
+}
+
+// withProxyRoute flags in history the calls the Handler proxies as soon as they open.
+func withProxyRoute(route func(fullMethod string) bool) Option {
+	return func(o *options) {
+		o.proxyRoute = route
+	}
+}
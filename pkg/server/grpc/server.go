@@ -15,12 +15,14 @@ import (
 
 // NewServer creates a grpc.Server with:
 //   - the Reflection service registered from descriptorRegistry
+//   - the reflection of the proxy backend merged in, WithReflectionMerge
 //   - an UnknownServiceHandler using the mock/proxy Handler
 func NewServer(
 	proxyAddr string,
 	descriptorRegistry reflection.DescriptorRegistry,
 	mockRegistry mocks.Registry,
 	historyRegistry history.RegistryWriter,
+	opts ...Option,
 ) *grpc.Server {
 	var p *proxy.Proxy
 	if proxyAddr != "" {
@@ -31,13 +33,23 @@ func NewServer(
 		}
 	}
 
+	opts = append(opts, withProxyRoute(proxyRoute(mockRegistry, descriptorRegistry, p)))
 	srv := grpc.NewServer(
 		grpc.UnknownServiceHandler(Handler(mockRegistry, descriptorRegistry, historyRegistry, p)),
 		grpc.ForceServerCodecV2(proxy.NewDefaultMultiplexCodec()),
-		grpc.StreamInterceptor(StreamInterceptor(historyRegistry, descriptorRegistry)),
+		grpc.StreamInterceptor(StreamInterceptor(historyRegistry, descriptorRegistry, opts...)),
 	)
-	serverReflectionV1 := reflection.NewServerReflectionV1(descriptorRegistry)
-	serverReflectionV1alpha := reflection.NewServerReflectionV1Alpha(descriptorRegistry)
+	var reflectionOpts []reflection.ServerReflectionOption
+	if proxyAddr != "" && newOptions(opts).reflectionMerge {
+		upstream, err := reflection.NewUpstreamClient(proxyAddr)
+		if err != nil {
+			log.Printf("Unable to reach proxy reflection : %v", err)
+		} else {
+			reflectionOpts = append(reflectionOpts, reflection.WithUpstream(upstream))
+		}
+	}
+	serverReflectionV1 := reflection.NewServerReflectionV1(descriptorRegistry, reflectionOpts...)
+	serverReflectionV1alpha := reflection.NewServerReflectionV1Alpha(descriptorRegistry, reflectionOpts...)
 
 	reflectionv1.RegisterServerReflectionServer(srv, serverReflectionV1)
 
@@ -5,15 +5,23 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
 	"github.com/marcaudefroy/grpc-hot-mock/pkg/mocks"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/proxy"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/redact"
 	"github.com/marcaudefroy/grpc-hot-mock/pkg/reflection"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 
 	grpcServer "github.com/marcaudefroy/grpc-hot-mock/pkg/server/grpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
@@ -24,6 +32,7 @@ import (
 // fakeServerStream implémente grpc.ServerStream pour tester Handler
 type fakeServerStream struct {
 	method   string
+	incoming metadata.MD
 	header   metadata.MD
 	trailer  metadata.MD
 	recvData map[string]any
@@ -35,10 +44,11 @@ func newFakeServerStream(method string) *fakeServerStream {
 }
 
 func (f *fakeServerStream) Context() context.Context {
-	return grpc.NewContextWithServerTransportStream(
-		context.Background(),
-		&fakeTransport{method: f.method},
-	)
+	ctx := context.Background()
+	if f.incoming != nil {
+		ctx = metadata.NewIncomingContext(ctx, f.incoming)
+	}
+	return grpc.NewContextWithServerTransportStream(ctx, &fakeTransport{method: f.method})
 }
 func (f *fakeServerStream) SetHeader(md metadata.MD) error  { f.header = md; return nil }
 func (f *fakeServerStream) SendHeader(md metadata.MD) error { f.header = md; return nil }
@@ -286,3 +296,349 @@ service EventService { rpc GetEvent(EventRequest) returns (Event); }`
 		t.Errorf("unexpected %+v", obj)
 	}
 }
+
+// rawServerStream is a concurrency-safe grpc.ServerStream exchanging raw frames, like the proxy does
+type rawServerStream struct {
+	fakeServerStream
+	mu   sync.Mutex
+	recv [][]byte
+}
+
+func (f *rawServerStream) SendMsg(m any) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.msgs = append(f.msgs, m)
+	return nil
+}
+
+func (f *rawServerStream) RecvMsg(m any) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.recv) == 0 {
+		return io.EOF
+	}
+	*(m.(*[]byte)) = f.recv[0]
+	f.recv = f.recv[1:]
+	return nil
+}
+
+func TestStreamInterceptor_ConcurrentLiveRecording(t *testing.T) {
+	dr := reflection.NewDefaultDescriptorRegistry()
+	hr := &history.DefaultRegistry{}
+	interceptor := grpcServer.StreamInterceptor(hr, dr)
+
+	const count = 50
+	stream := &rawServerStream{fakeServerStream: fakeServerStream{method: "/example.Watcher/Watch"}}
+	for range count {
+		stream.recv = append(stream.recv, []byte("ping"))
+	}
+
+	openChecked := make(chan struct{})
+	handler := func(_ any, ss grpc.ServerStream) error {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for {
+				var msg []byte
+				if err := ss.RecvMsg(&msg); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range count {
+				_ = ss.SendMsg([]byte("pong"))
+			}
+		}()
+		wg.Wait()
+
+		// Messages must be visible while the call is still open
+		histories := hr.GetHistories()
+		if len(histories) != 1 || histories[0].State != history.StateOpen {
+			t.Errorf("expected one open call, got %+v", histories)
+		} else if len(histories[0].Messages) != 2*count {
+			t.Errorf("expected %d live messages, got %d", 2*count, len(histories[0].Messages))
+		}
+		close(openChecked)
+		return nil
+	}
+
+	err := interceptor(nil, stream, &grpc.StreamServerInfo{FullMethod: "/example.Watcher/Watch"}, handler)
+	if err != nil {
+		t.Fatalf("interceptor error: %v", err)
+	}
+	<-openChecked
+
+	histories := hr.GetHistories()
+	if len(histories) != 1 {
+		t.Fatalf("expected 1 history, got %d", len(histories))
+	}
+	if histories[0].State != history.StateClosed || len(histories[0].Messages) != 2*count {
+		t.Errorf("unexpected closed history: state=%s messages=%d", histories[0].State, len(histories[0].Messages))
+	}
+}
+
+func TestServer_ProxyCapturesMetadataAndStatusDetails(t *testing.T) {
+	codec := proxy.NewDefaultMultiplexCodec()
+
+	// Upstream answering with headers, trailers and a detailed error
+	upstream := grpc.NewServer(
+		grpc.ForceServerCodecV2(codec),
+		grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+			var req []byte
+			if err := stream.RecvMsg(&req); err != nil {
+				return err
+			}
+			_ = stream.SendHeader(metadata.Pairs("x-upstream-header", "h"))
+			stream.SetTrailer(metadata.Pairs("x-upstream-trailer", "t"))
+			st, _ := status.New(codes.FailedPrecondition, "boom").WithDetails(&errdetails.ErrorInfo{Reason: "QUOTA"})
+			return st.Err()
+		}),
+	)
+	upstreamLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() { _ = upstream.Serve(upstreamLis) }()
+	defer upstream.Stop()
+
+	dr := reflection.NewDefaultDescriptorRegistry()
+	mr := &mocks.DefaultRegistry{}
+	hr := &history.DefaultRegistry{}
+	srv := grpcServer.NewServer(upstreamLis.Addr().String(), dr, mr, hr)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() { _ = srv.Serve(lis) }()
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient(lis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodecV2(codec)),
+	)
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-request", "r")
+	proxified := true
+	sub := hr.Subscribe(history.Query{Proxified: &proxified}, 16)
+	defer sub.Close()
+	var header, trailer metadata.MD
+	var resp []byte
+	err = conn.Invoke(ctx, "/example.Greeter/SayHello", []byte{}, &resp, grpc.Header(&header), grpc.Trailer(&trailer))
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition from upstream, got %v", err)
+	}
+	if got := header.Get("x-upstream-header"); len(got) != 1 || got[0] != "h" {
+		t.Errorf("upstream header not forwarded to the client: %v", header)
+	}
+	if got := trailer.Get("x-upstream-trailer"); len(got) != 1 || got[0] != "t" {
+		t.Errorf("upstream trailer not forwarded to the client: %v", trailer)
+	}
+
+	page := hr.Query(history.Query{Method: "/example.Greeter/SayHello"})
+	if len(page.Histories) != 1 {
+		t.Fatalf("expected 1 history, got %d", len(page.Histories))
+	}
+	h := page.Histories[0]
+	if !h.Proxified || h.GrpcCode != int32(codes.FailedPrecondition) {
+		t.Errorf("unexpected outcome proxified=%v code=%d", h.Proxified, h.GrpcCode)
+	}
+	if got := h.RequestMetadata["x-request"]; len(got) != 1 || got[0] != "r" {
+		t.Errorf("request metadata not captured: %v", h.RequestMetadata)
+	}
+	if h.Peer == "" || h.Authority == "" || h.Deadline == nil {
+		t.Errorf("call info not captured: peer=%q authority=%q deadline=%v", h.Peer, h.Authority, h.Deadline)
+	}
+	if got := h.UpstreamHeaders["x-upstream-header"]; len(got) != 1 {
+		t.Errorf("upstream headers not captured: %v", h.UpstreamHeaders)
+	}
+	if got := h.UpstreamTrailers["x-upstream-trailer"]; len(got) != 1 {
+		t.Errorf("upstream trailers not captured: %v", h.UpstreamTrailers)
+	}
+	if got := h.ResponseHeaders["x-upstream-header"]; len(got) != 1 {
+		t.Errorf("response headers not captured: %v", h.ResponseHeaders)
+	}
+	if len(h.StatusDetails) != 1 {
+		t.Fatalf("expected 1 status detail, got %v", h.StatusDetails)
+	}
+	if detail, _ := h.StatusDetails[0].(map[string]any); detail["reason"] != "QUOTA" {
+		t.Errorf("unexpected status detail %v", h.StatusDetails[0])
+	}
+
+	// The call is flagged proxified from its first event
+	var types []history.EventType
+	for len(sub.C) > 0 {
+		types = append(types, (<-sub.C).Type)
+	}
+	if len(types) < 3 || types[0] != history.EventCallOpened || types[len(types)-1] != history.EventCallClosed {
+		t.Errorf("proxified subscriber missed events of the call: %v", types)
+	}
+}
+
+func TestStreamInterceptor_CallID(t *testing.T) {
+	dr := reflection.NewDefaultDescriptorRegistry()
+	hr := &history.DefaultRegistry{}
+	interceptor := grpcServer.StreamInterceptor(hr, dr)
+	handler := func(any, grpc.ServerStream) error { return nil }
+	info := &grpc.StreamServerInfo{FullMethod: "/example.Greeter/SayHello"}
+
+	call := func(requestID string) string {
+		stream := newFakeServerStream(info.FullMethod)
+		if requestID != "" {
+			stream.incoming = metadata.Pairs(grpcServer.RequestIDHeader, requestID)
+		}
+		if err := interceptor(nil, stream, info, handler); err != nil {
+			t.Fatalf("interceptor error: %v", err)
+		}
+		ids := stream.header.Get(grpcServer.CallIDHeader)
+		if len(ids) != 1 {
+			t.Fatalf("expected the call ID in the response header, got %v", stream.header)
+		}
+		if _, ok := hr.GetHistory(ids[0]); !ok {
+			t.Errorf("no history for the returned call ID %s", ids[0])
+		}
+		return ids[0]
+	}
+
+	if id := call(""); id == "" {
+		t.Error("expected a generated call ID")
+	}
+	if id := call("test-42"); id != "test-42" {
+		t.Errorf("expected the client request ID to be used, got %s", id)
+	}
+	// Already taken or not addressable: a generated ID is used instead
+	if id := call("test-42"); id == "test-42" {
+		t.Error("a reused request ID must not replace the previous call")
+	}
+	if id := call("a/b"); id == "a/b" {
+		t.Error("a request ID with a slash must not be used")
+	}
+	if n := len(hr.GetHistories()); n != 4 {
+		t.Errorf("expected 4 calls in history, got %d", n)
+	}
+}
+
+func TestStreamInterceptor_Redaction(t *testing.T) {
+	dr := reflection.NewDefaultDescriptorRegistry()
+	hello := `syntax = "proto3"; package example;
+message HelloRequest { string name = 1; }
+message HelloReply   { string message = 1; }
+service Greeter{rpc SayHello(HelloRequest) returns(HelloReply);}`
+	if err := dr.RegisterProtoFile("hello.proto", hello); err != nil {
+		t.Fatalf("register proto failed: %v", err)
+	}
+	mr := &mocks.DefaultRegistry{}
+	mr.RegisterMock(mocks.MockConfig{Service: "example.Greeter", Method: "SayHello", MockResponse: map[string]any{"message": "hi"}})
+	hr := &history.DefaultRegistry{}
+
+	redactor, err := redact.New(redact.Rules{FieldPaths: []string{"name", "example.HelloReply.message"}})
+	if err != nil {
+		t.Fatalf("new redactor: %v", err)
+	}
+	interceptor := grpcServer.StreamInterceptor(hr, dr, grpcServer.WithRedactor(redactor))
+	handler := grpcServer.Handler(mr, dr, hr, nil)
+
+	stream := newFakeServerStream("/example.Greeter/SayHello")
+	stream.recvData = map[string]any{"name": "world"}
+	err = interceptor(nil, stream, &grpc.StreamServerInfo{FullMethod: "/example.Greeter/SayHello"}, handler)
+	if err != nil {
+		t.Fatalf("handler error: %v", err)
+	}
+
+	// The client still receives the real response
+	out, _ := protojson.Marshal(stream.msgs[0].(proto.Message))
+	if !strings.Contains(string(out), `"hi"`) {
+		t.Errorf("response sent to the client must not be redacted, got %s", out)
+	}
+
+	h := hr.GetHistories()[0]
+	for _, m := range h.Messages {
+		if !strings.Contains(m.PayloadString, redact.Placeholder) {
+			t.Errorf("%s payload not redacted: %s", m.Direction, m.PayloadString)
+		}
+	}
+}
+
+func TestServer_ShadowMock(t *testing.T) {
+	hello := `syntax = "proto3"; package example;
+message HelloRequest { string name = 1; }
+message HelloReply   { string message = 1; }
+service Greeter{rpc SayHello(HelloRequest) returns(HelloReply);}`
+	serve := func(proxyAddr string, mc mocks.MockConfig, hr history.RegisterReadWriter) string {
+		dr := reflection.NewDefaultDescriptorRegistry()
+		if err := dr.RegisterProtoFile("hello.proto", hello); err != nil {
+			t.Fatalf("register proto failed: %v", err)
+		}
+		mr := &mocks.DefaultRegistry{}
+		mr.RegisterMock(mc)
+		srv := grpcServer.NewServer(proxyAddr, dr, mr, hr)
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		go func() { _ = srv.Serve(lis) }()
+		t.Cleanup(srv.Stop)
+		return lis.Addr().String()
+	}
+
+	// A slow backend, that the client must not wait for
+	upstreamDelay := time.Second
+	upstream := serve("", mocks.MockConfig{Service: "example.Greeter", Method: "SayHello", MockResponse: map[string]any{"message": "real"}, DelayMs: int(upstreamDelay.Milliseconds())}, &history.DefaultRegistry{})
+	hr := &history.DefaultRegistry{}
+	addr := serve(upstream, mocks.MockConfig{
+		Service: "example.Greeter", Method: "SayHello", MockResponse: map[string]any{"message": "mocked"},
+		Shadow: &mocks.ShadowConfig{Serve: mocks.ServeMock},
+	}, hr)
+
+	codec := proxy.NewDefaultMultiplexCodec()
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodecV2(codec)),
+	)
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var resp []byte
+	start := time.Now()
+	if err := conn.Invoke(ctx, "/example.Greeter/SayHello", []byte{0x0a, 0x01, 'a'}, &resp); err != nil {
+		t.Fatalf("invoke: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= upstreamDelay {
+		t.Errorf("the mock answer waited for the backend: %v", elapsed)
+	}
+	if !strings.Contains(string(resp), "mocked") {
+		t.Errorf("expected the mock response to be served, got %q", resp)
+	}
+
+	// The comparison is recorded once the backend answered
+	var page history.Page
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		page = hr.Query(history.Query{Method: "/example.Greeter/SayHello"})
+		if len(page.Histories) == 1 && page.Histories[0].Shadow != nil {
+			break
+		}
+	}
+	if len(page.Histories) != 1 || page.Histories[0].Shadow == nil {
+		t.Fatalf("expected a shadowed call, got %+v", page.Histories)
+	}
+	shadow := page.Histories[0].Shadow
+	if shadow.Served != mocks.ServeMock || !shadow.Diverged || len(shadow.Messages) != 1 {
+		t.Fatalf("unexpected shadow %+v", shadow)
+	}
+	if len(shadow.Differences) != 1 || shadow.Differences[0].Path != "responses[0].message" ||
+		shadow.Differences[0].Expected != "real" || shadow.Differences[0].Actual != "mocked" {
+		t.Errorf("unexpected differences %+v", shadow.Differences)
+	}
+}
@@ -0,0 +1,193 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/diff"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/mocks"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/payload"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// shadowTimeout bounds the upstream call of a shadowed call served by the mock, which outlives the client call
+const shadowTimeout = 30 * time.Second
+
+// handleShadow answers a unary call from the side configured by mc.Shadow, sends it to the
+// other side as well, and records how both answers differ.
+// The upstream is called concurrently with the mock. When the mock is served, the call ends
+// right after its answer and the differences are recorded once the upstream answered.
+func handleShadow(stream grpc.ServerStream, mc mocks.MockConfig, methodDescriptor protoreflect.MethodDescriptor, p *proxy.Proxy) error {
+	fullMethod, _ := grpc.MethodFromServerStream(stream)
+
+	req := dynamicpb.NewMessage(methodDescriptor.Input())
+	if err := stream.RecvMsg(req); err != nil {
+		return status.Errorf(codes.Internal, "failed to receive message: %v", err)
+	}
+	raw, err := proto.Marshal(req)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to encode message: %v", err)
+	}
+
+	ctx, cancel := stream.Context(), context.CancelFunc(func() {})
+	if mc.Shadow.Serve != mocks.ServeUpstream {
+		ctx, cancel = context.WithTimeout(context.WithoutCancel(ctx), shadowTimeout)
+	}
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	upstreamCh := make(chan proxy.CallResult, 1)
+	go func() {
+		defer cancel()
+		upstreamCh <- p.Call(ctx, fullMethod, md, [][]byte{raw})
+	}()
+
+	mockResp, mockErr := mockResponse(mc, methodDescriptor)
+	mockStatus := status.Convert(mockErr)
+
+	var served error
+	var upstream proxy.CallResult
+	if mc.Shadow.Serve == mocks.ServeUpstream {
+		upstream = <-upstreamCh
+		served = serveUpstream(stream, upstream)
+	} else {
+		if mc.DelayMs > 0 {
+			time.Sleep(time.Duration(mc.DelayMs) * time.Millisecond)
+		}
+		if len(mc.Headers) > 0 {
+			if err := stream.SendHeader(metadata.New(mc.Headers)); err != nil {
+				return err
+			}
+		}
+		served = mockErr
+		if mockErr == nil {
+			if err := stream.SendMsg(mockResp); err != nil {
+				return err
+			}
+		}
+		if w, ok := stream.(*wrappedServerStream); ok {
+			go func() {
+				w.recordShadow(mc, methodDescriptor, mockResp, mockStatus, <-upstreamCh)
+			}()
+		}
+		return served
+	}
+
+	if w, ok := stream.(*wrappedServerStream); ok {
+		w.recordShadow(mc, methodDescriptor, mockResp, mockStatus, upstream)
+	}
+	return served
+}
+
+// serveUpstream forwards the upstream answer to the client.
+func serveUpstream(stream grpc.ServerStream, upstream proxy.CallResult) error {
+	if w, ok := stream.(*wrappedServerStream); ok {
+		w.setProxified()
+	}
+	if header := proxy.ForwardableMetadata(upstream.Header); len(header) > 0 {
+		if err := stream.SendHeader(header); err != nil {
+			return err
+		}
+	}
+	for _, msg := range upstream.Responses {
+		if err := stream.SendMsg(msg); err != nil {
+			return err
+		}
+	}
+	stream.SetTrailer(proxy.ForwardableMetadata(upstream.Trailer))
+	return upstream.Status.Err()
+}
+
+// recordShadow stores the answer of the side not served and its differences with the served one.
+func (w *wrappedServerStream) recordShadow(mc mocks.MockConfig, methodDescriptor protoreflect.MethodDescriptor, mockResp *dynamicpb.Message, mockStatus *status.Status, upstream proxy.CallResult) {
+	mockMessages := []history.Message{}
+	if mockResp != nil {
+		mockMessages = append(mockMessages, w.decoder.Decode(methodDescriptor, payload.DirectionSend, mockResp))
+	}
+	upstreamMessages := []history.Message{}
+	for _, b := range upstream.Responses {
+		upstreamMessages = append(upstreamMessages, w.decoder.Decode(methodDescriptor, payload.DirectionSend, b))
+	}
+
+	shadow := &history.Shadow{
+		Served:      mocks.ServeMock,
+		GrpcCode:    int32(upstream.Status.Code()),
+		GrpcMessage: w.redactor.String(upstream.Status.Message()),
+		Messages:    upstreamMessages,
+	}
+	if mc.Shadow.Serve == mocks.ServeUpstream {
+		shadow.Served = mocks.ServeUpstream
+		shadow.GrpcCode = int32(mockStatus.Code())
+		shadow.GrpcMessage = w.redactor.String(mockStatus.Message())
+		shadow.Messages = mockMessages
+	}
+
+	ignore := diff.Ignore(mc.Shadow.IgnoreFields)
+	shadow.Differences = diff.Values(
+		map[string]any{"status": w.statusValue(upstream.Status)},
+		map[string]any{"status": w.statusValue(mockStatus)},
+		ignore,
+	)
+	for i := 0; i < max(len(upstreamMessages), len(mockMessages)); i++ {
+		path := fmt.Sprintf("responses[%d]", i)
+		switch {
+		case i >= len(mockMessages):
+			shadow.Differences = append(shadow.Differences, diff.Difference{Path: path, Expected: upstreamMessages[i].Payload})
+		case i >= len(upstreamMessages):
+			shadow.Differences = append(shadow.Differences, diff.Difference{Path: path, Actual: mockMessages[i].Payload})
+		default:
+			shadow.Differences = append(shadow.Differences, w.diffResponse(path, methodDescriptor, upstream.Responses[i], mockResp, ignore)...)
+		}
+	}
+	shadow.Diverged = len(shadow.Differences) > 0
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.history.Shadow = shadow
+	// The call may have been saved closed before the upstream answered
+	if w.history.State == history.StateClosed {
+		w.historyRegistry.UpdateHistory(w.history.ID, func(h *history.History) bool {
+			h.Shadow = shadow
+			return true
+		})
+	}
+	// Upstream responses served to the client are already accounted by SendMsg
+	if mc.Shadow.Serve != mocks.ServeUpstream {
+		for _, m := range upstreamMessages {
+			w.recordDrift(m)
+		}
+	}
+}
+
+// statusValue returns the comparable form of a status, redacted.
+func (w *wrappedServerStream) statusValue(s *status.Status) map[string]any {
+	value := map[string]any{
+		"code":    float64(s.Code()),
+		"message": w.redactor.String(s.Message()),
+	}
+	if details := decodeStatusDetails(s, w.descriptorRegistry, w.redactor); len(details) > 0 {
+		value["details"] = details
+	}
+	return value
+}
+
+// diffResponse compares the upstream response (expected) with the mock one (actual), field by field.
+// Both are redacted first, the differences show their values.
+func (w *wrappedServerStream) diffResponse(path string, methodDescriptor protoreflect.MethodDescriptor, upstream []byte, mockResp proto.Message, ignore diff.Ignore) []diff.Difference {
+	expected := dynamicpb.NewMessage(methodDescriptor.Output())
+	if err := proto.Unmarshal(upstream, expected); err != nil {
+		return []diff.Difference{{Path: path, Expected: "undecodable response: " + err.Error()}}
+	}
+	diffs, err := diff.Messages(w.redactor.Message(expected), w.redactor.Message(mockResp), ignore)
+	if err != nil {
+		return []diff.Difference{{Path: path, Expected: err.Error()}}
+	}
+	return diff.Prefix(path, diffs)
+}
@@ -0,0 +1,254 @@
+package http
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxArchiveSize bounds both the uploaded archive and the total size of its extracted .proto files
+const maxArchiveSize = 64 << 20
+
+// archiveFilter selects the .proto files of an archive and maps them to import paths.
+type archiveFilter struct {
+	// root is stripped from the paths, files outside of it are skipped
+	root    string
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// parseArchiveFilter reads the root, include and exclude (repeatable) query parameters.
+func parseArchiveFilter(values url.Values) (archiveFilter, error) {
+	f := archiveFilter{root: strings.Trim(values.Get("root"), "/")}
+	for _, key := range []string{"include", "exclude"} {
+		for _, pattern := range values[key] {
+			re, err := globToRegexp(pattern)
+			if err != nil {
+				return f, fmt.Errorf("invalid %s %q: %w", key, pattern, err)
+			}
+			if key == "include" {
+				f.include = append(f.include, re)
+			} else {
+				f.exclude = append(f.exclude, re)
+			}
+		}
+	}
+	return f, nil
+}
+
+// globToRegexp translates a glob where "*" and "?" stay within a path segment and "**" spans several.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// importPath returns the import path of an archive entry, and false when the entry is filtered out.
+func (f archiveFilter) importPath(name string) (string, bool) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if !strings.HasSuffix(name, ".proto") {
+		return "", false
+	}
+	if f.root != "" {
+		rest, ok := strings.CutPrefix(name, f.root+"/")
+		if !ok {
+			return "", false
+		}
+		name = rest
+	}
+	if len(f.include) > 0 && !matchAny(f.include, name) {
+		return "", false
+	}
+	if matchAny(f.exclude, name) {
+		return "", false
+	}
+	return name, true
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// readArchive extracts the .proto files selected by f from a zip or tar.gz archive, recognized by
+// its content, keyed by import path.
+func readArchive(data []byte, f archiveFilter) (map[string]string, error) {
+	files := map[string]string{}
+	total := 0
+	add := func(name string, r io.Reader) error {
+		importPath, ok := f.importPath(name)
+		if !ok {
+			return nil
+		}
+		content, err := io.ReadAll(io.LimitReader(r, int64(maxArchiveSize-total+1)))
+		if err != nil {
+			return fmt.Errorf("read %s: %w", name, err)
+		}
+		if total += len(content); total > maxArchiveSize {
+			return fmt.Errorf("extracted files exceed %d bytes", maxArchiveSize)
+		}
+		files[importPath] = string(content)
+		return nil
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid zip: %w", err)
+		}
+		for _, zf := range zr.File {
+			if zf.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := zf.Open()
+			if err != nil {
+				return nil, fmt.Errorf("open %s: %w", zf.Name, err)
+			}
+			err = add(zf.Name, rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip: %w", err)
+		}
+		defer gz.Close()
+		tr := tar.NewReader(gz)
+		for {
+			header, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid tar: %w", err)
+			}
+			if header.Typeflag != tar.TypeReg {
+				continue
+			}
+			if err := add(header.Name, tr); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, errors.New("unsupported archive: expected zip or tar.gz")
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New("no .proto file selected in the archive")
+	}
+	return files, nil
+}
+
+// ingestArchive stages in batch the .proto files of the archive sent as request body, or as the "archive"
+// part of a multipart form, and returns their import paths. Nothing is staged on error.
+func (s *Server) ingestArchive(w http.ResponseWriter, r *http.Request, batch string) ([]string, int, error) {
+	filter, err := parseArchiveFilter(r.URL.Query())
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxArchiveSize)
+	var body io.Reader = r.Body
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		if err := r.ParseMultipartForm(maxArchiveSize); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("error parsing multipart form: %w", err)
+		}
+		file, _, err := r.FormFile("archive")
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("no archive uploaded: %w", err)
+		}
+		defer file.Close()
+		body = file
+	}
+	data, err := io.ReadAll(body)
+	if maxBytesErr := (*http.MaxBytesError)(nil); errors.As(err, &maxBytesErr) {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("archive exceeds %d bytes", maxArchiveSize)
+	}
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("error reading archive: %w", err)
+	}
+
+	files, err := readArchive(data, filter)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		s.descriptorRegistry.StageProtoFile(batch, p, files[p])
+	}
+	return paths, http.StatusAccepted, nil
+}
+
+// handleUploadProtoArchive ingests the .proto files of an archive, then compiles and registers them.
+func (s *Server) handleUploadProtoArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	batch := registerBatch()
+	defer s.releaseBatch(batch)
+	paths, statusCode, err := s.ingestArchive(w, r, batch)
+	if err != nil {
+		writeError(w, statusCode, err.Error())
+		return
+	}
+	warnings, ok := s.compileAndRegister(w, batch)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"files": paths, "diagnostics": warnings})
+}
+
+// handleIngestProtoArchive ingests the .proto files of an archive without compilation.
+func (s *Server) handleIngestProtoArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	paths, statusCode, err := s.ingestArchive(w, r, stagingBatch(r))
+	if err != nil {
+		writeError(w, statusCode, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string][]string{"files": paths})
+}
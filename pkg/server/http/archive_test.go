@@ -0,0 +1,109 @@
+package http_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/mocks"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/reflection"
+	httpServer "github.com/marcaudefroy/grpc-hot-mock/pkg/server/http"
+)
+
+var archiveFiles = map[string]string{
+	"repo/proto/api/common.proto":       `syntax = "proto3"; package common; message User { string name = 1; }`,
+	"repo/proto/api/svc.proto":          `syntax = "proto3"; package svc; import "api/common.proto"; service Users { rpc Get(common.User) returns (common.User); }`,
+	"repo/proto/internal/broken.proto":  `not a proto`,
+	"repo/README.md":                    `# protos`,
+	"repo/other/api/outside_root.proto": `not a proto either`,
+}
+
+func zipArchive(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range archiveFiles {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("zip create: %v", err)
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			t.Fatalf("zip write: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func tarGzArchive(t *testing.T) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range archiveFiles {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("tar write: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar close: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("gzip close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestHandleProtoArchive(t *testing.T) {
+	for name, archive := range map[string]func(*testing.T) []byte{"zip": zipArchive, "tar.gz": tarGzArchive} {
+		t.Run(name, func(t *testing.T) {
+			dr := reflection.NewDefaultDescriptorRegistry()
+			mux := httpServer.NewServer(dr, &mocks.DefaultRegistry{}, &history.DefaultRegistry{})
+
+			req := httptest.NewRequest(http.MethodPost, "/protos/register/archive?root=repo/proto&exclude=internal/**", bytes.NewReader(archive(t)))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+			}
+			var resp map[string][]string
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatalf("decode failed: %v", err)
+			}
+			if files := resp["files"]; len(files) != 2 || files[0] != "api/common.proto" || files[1] != "api/svc.proto" {
+				t.Errorf("unexpected files %v", files)
+			}
+			if _, ok := dr.GetMethodDescriptor("/svc.Users/Get"); !ok {
+				t.Error("/svc.Users/Get must be registered")
+			}
+		})
+	}
+
+	dr := reflection.NewDefaultDescriptorRegistry()
+	mux := httpServer.NewServer(dr, &mocks.DefaultRegistry{}, &history.DefaultRegistry{})
+	req := httptest.NewRequest(http.MethodPost, "/protos/ingest/archive?root=repo/proto&include=**/common.proto", bytes.NewReader(zipArchive(t)))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if pending := dr.PendingFiles(); len(pending) != 1 || pending[0] != "api/common.proto" {
+		t.Errorf("expected only api/common.proto ingested, got %v", pending)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/protos/ingest/archive", bytes.NewReader([]byte("not an archive")))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unsupported archive, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,250 @@
+package http
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/payload"
+)
+
+// Export formats of /history/export
+const (
+	ExportJSONL  = "jsonl"
+	ExportHAR    = "har"
+	ExportFrames = "frames"
+)
+
+// handleHistoryExport dumps the calls matching the /history filters in the requested format.
+func (s *Server) handleHistoryExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q, err := parseHistoryQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ExportJSONL
+	}
+	if format != ExportJSONL && format != ExportHAR && format != ExportFrames {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown format %q, expected %s, %s or %s", format, ExportJSONL, ExportHAR, ExportFrames))
+		return
+	}
+
+	page := s.historyRegistry.Query(q)
+	for i := range page.Histories {
+		s.redecode(&page.Histories[i])
+	}
+	if page.NextCursor != "" {
+		w.Header().Set(NextCursorHeader, page.NextCursor)
+	}
+
+	switch format {
+	case ExportJSONL:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="history.jsonl"`)
+		enc := json.NewEncoder(w)
+		for _, h := range page.Histories {
+			if err := enc.Encode(h); err != nil {
+				log.Printf("warning: write export failed: %v", err)
+				return
+			}
+		}
+	case ExportHAR:
+		w.Header().Set("Content-Disposition", `attachment; filename="history.har"`)
+		writeJSON(w, http.StatusOK, toHAR(page.Histories))
+	case ExportFrames:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="history.frames"`)
+		if err := s.writeFrames(w, page.Histories); err != nil {
+			log.Printf("warning: write export failed: %v", err)
+		}
+	}
+}
+
+// writeFrames writes each call as a uvarint length-prefixed JSON header, the call without
+// its payloads, followed by one gRPC length-prefixed frame per message of the header.
+// Messages whose bytes are lost, like truncated ones, are left out of the header.
+func (s *Server) writeFrames(w io.Writer, histories []history.History) error {
+	bw := bufio.NewWriter(w)
+	var prefix [binary.MaxVarintLen64]byte
+	for _, h := range histories {
+		var frames [][]byte
+		messages := make([]history.Message, 0, len(h.Messages))
+		for _, m := range h.Messages {
+			// The bytes of unrecognized messages escaped redaction
+			if !m.Recognized && s.redactor.RedactsPayloads() {
+				continue
+			}
+			b, err := s.decoder.Encode(h.FullMethod, m)
+			if err != nil {
+				continue
+			}
+			frames = append(frames, b)
+			m.PayloadString = ""
+			m.Payload = nil
+			messages = append(messages, m)
+		}
+		h.Messages = messages
+
+		header, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+		n := binary.PutUvarint(prefix[:], uint64(len(header)))
+		bw.Write(prefix[:n])
+		bw.Write(header)
+		for _, f := range frames {
+			// Uncompressed flag and big endian length, as on the wire
+			var frameHeader [5]byte
+			binary.BigEndian.PutUint32(frameHeader[1:], uint32(len(f)))
+			bw.Write(frameHeader[:])
+			bw.Write(f)
+		}
+	}
+	return bw.Flush()
+}
+
+// har is a HAR 1.2 inspired document: HTTP/2 requests carry the gRPC messages instead of a body.
+type har struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"` // milliseconds, -1 while the call is open
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	GRPC            harGRPC     `json:"_grpc"`
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Headers     []harHeader  `json:"headers"`
+	Messages    []harMessage `json:"_messages"`
+}
+
+type harResponse struct {
+	Status      int          `json:"status"`
+	StatusText  string       `json:"statusText"`
+	HTTPVersion string       `json:"httpVersion"`
+	Headers     []harHeader  `json:"headers"`
+	Trailers    []harHeader  `json:"_trailers"`
+	Messages    []harMessage `json:"_messages"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harMessage struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Recognized bool      `json:"recognized"`
+	Truncated  bool      `json:"truncated,omitempty"`
+	Text       string    `json:"text"`
+}
+
+// harGRPC holds the gRPC specifics, custom fields are prefixed by an underscore in HAR
+type harGRPC struct {
+	ID            string   `json:"id"`
+	FullMethod    string   `json:"fullMethod"`
+	State         string   `json:"state"`
+	Code          int32    `json:"code"`
+	Message       string   `json:"message,omitempty"`
+	StatusDetails []any    `json:"statusDetails,omitempty"`
+	Proxified     bool     `json:"proxified"`
+	Session       string   `json:"session,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+}
+
+func toHAR(histories []history.History) har {
+	doc := har{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "grpc-hot-mock", Version: "1"},
+		Entries: make([]harEntry, 0, len(histories)),
+	}}
+	for _, h := range histories {
+		e := harEntry{
+			StartedDateTime: h.StartTime,
+			Time:            -1,
+			ServerIPAddress: h.Peer,
+			Request: harRequest{
+				Method:      http.MethodPost,
+				URL:         "grpc://" + h.Authority + h.FullMethod,
+				HTTPVersion: "HTTP/2",
+				Headers:     harHeaders(h.RequestMetadata),
+				Messages:    []harMessage{},
+			},
+			Response: harResponse{
+				Status:      http.StatusOK,
+				StatusText:  "OK",
+				HTTPVersion: "HTTP/2",
+				Headers:     harHeaders(h.ResponseHeaders),
+				Trailers:    harHeaders(h.ResponseTrailers),
+				Messages:    []harMessage{},
+			},
+			GRPC: harGRPC{
+				ID:            h.ID,
+				FullMethod:    h.FullMethod,
+				State:         string(h.State),
+				Code:          h.GrpcCode,
+				Message:       h.GrpcMessage,
+				StatusDetails: h.StatusDetails,
+				Proxified:     h.Proxified,
+				Session:       h.Session,
+				Tags:          h.Tags,
+			},
+		}
+		if h.EndTime != nil {
+			e.Time = float64(h.EndTime.Sub(h.StartTime)) / float64(time.Millisecond)
+		}
+		for _, m := range h.Messages {
+			hm := harMessage{Timestamp: m.Timestamp, Recognized: m.Recognized, Truncated: m.Truncated, Text: m.PayloadString}
+			if m.Direction == payload.DirectionRecv {
+				e.Request.Messages = append(e.Request.Messages, hm)
+			} else {
+				e.Response.Messages = append(e.Response.Messages, hm)
+			}
+		}
+		doc.Log.Entries = append(doc.Log.Entries, e)
+	}
+	return doc
+}
+
+// harHeaders flattens metadata into HAR headers, sorted by name for stable output.
+func harHeaders(md map[string][]string) []harHeader {
+	headers := []harHeader{}
+	for k, values := range md {
+		for _, v := range values {
+			headers = append(headers, harHeader{Name: k, Value: v})
+		}
+	}
+	sort.SliceStable(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+	return headers
+}
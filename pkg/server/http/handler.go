@@ -1,14 +1,24 @@
 package http
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"mime"
 	"mime/multipart"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
 	"github.com/marcaudefroy/grpc-hot-mock/pkg/mocks"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/reflection"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
 )
 
 type BulkUploadRequest struct {
@@ -36,20 +46,110 @@ func (s *Server) handleUploadProtoJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Phase 1: ingest all
+	// Phase 1: stage all
 	for _, f := range req.Files {
 		if f.Filename == "" || f.Content == "" {
 			writeError(w, http.StatusBadRequest, "filename and content required for all files")
 			return
 		}
-		s.descriptorRegistry.IngestProtoFile(f.Filename, f.Content)
+	}
+	batch := registerBatch()
+	defer s.releaseBatch(batch)
+	for _, f := range req.Files {
+		s.descriptorRegistry.StageProtoFile(batch, f.Filename, f.Content)
 	}
 	// Phase 2: compile and register all
-	if err := s.descriptorRegistry.CompileAndRegister(); err != nil {
-		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to compile files: %v", err))
+	warnings, ok := s.compileAndRegister(w, batch)
+	if !ok {
 		return
 	}
-	writeJSON(w, http.StatusCreated, nil)
+	writeJSON(w, http.StatusCreated, map[string][]reflection.Diagnostic{"diagnostics": warnings})
+}
+
+// handleUploadDescriptorSet registers a compiled FileDescriptorSet (protoc --descriptor_set_out, buf build),
+// in binary form or, with a JSON content type, in its protobuf JSON form.
+func (s *Server) handleUploadDescriptorSet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	// Bounded like the archives, it's read whole in memory
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxArchiveSize))
+	if maxBytesErr := (*http.MaxBytesError)(nil); errors.As(err, &maxBytesErr) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("descriptor set exceeds %d bytes", maxArchiveSize))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read body: "+err.Error())
+		return
+	}
+	var set descriptorpb.FileDescriptorSet
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		err = protojson.Unmarshal(body, &set)
+	} else {
+		err = proto.Unmarshal(body, &set)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid descriptor set: "+err.Error())
+		return
+	}
+	if len(set.GetFile()) == 0 {
+		writeError(w, http.StatusBadRequest, "no file in the descriptor set")
+		return
+	}
+
+	paths, err := s.descriptorRegistry.RegisterDescriptorSet(&set)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to register descriptor set: %v", err))
+		return
+	}
+	s.redecodeHistory()
+	writeJSON(w, http.StatusCreated, map[string][]string{"registered": paths})
+}
+
+// upstreamImportTimeout bounds the import of the upstream descriptors, waiting for the upstream included
+const upstreamImportTimeout = 30 * time.Second
+
+// ImportUpstreamRequest is the optional payload of /protos/import/upstream.
+type ImportUpstreamRequest struct {
+	// Target is the upstream address, the proxy backend by default
+	Target string `json:"target"`
+	// Replace lets the upstream files replace the local ones of the same path
+	Replace bool `json:"replace"`
+}
+
+// handleImportUpstream registers the descriptors served by the reflection service of an upstream.
+func (s *Server) handleImportUpstream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req ImportUpstreamRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+			return
+		}
+	}
+	target := req.Target
+	if target == "" {
+		target = s.replayTarget
+	}
+	if target == "" {
+		writeError(w, http.StatusBadRequest, "target is required when no proxy backend is configured")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), upstreamImportTimeout)
+	defer cancel()
+	paths, err := reflection.ImportUpstream(ctx, s.descriptorRegistry, target, req.Replace)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("failed to import upstream descriptors: %v", err))
+		return
+	}
+	s.redecodeHistory()
+	writeJSON(w, http.StatusCreated, map[string][]string{"registered": paths})
 }
 
 // handleIngestProto ingests multiple .proto sources without compilation.
@@ -72,7 +172,10 @@ func (s *Server) handleIngestProtoJSON(w http.ResponseWriter, r *http.Request) {
 			writeError(w, http.StatusBadRequest, "filename and content required for all files")
 			return
 		}
-		s.descriptorRegistry.IngestProtoFile(f.Filename, f.Content)
+	}
+	batch := stagingBatch(r)
+	for _, f := range req.Files {
+		s.descriptorRegistry.StageProtoFile(batch, f.Filename, f.Content)
 	}
 	writeJSON(w, http.StatusCreated, nil)
 }
@@ -85,18 +188,19 @@ func (s *Server) handleUploadProtoFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	statusCode, err := s.injestProtoFileFromRequest(r)
+	batch := registerBatch()
+	defer s.releaseBatch(batch)
+	statusCode, err := s.injestProtoFileFromRequest(r, batch)
 	if err != nil {
 		writeError(w, statusCode, err.Error())
 		return
 	}
 	// Phase 2: compile and register all
-	if err := s.descriptorRegistry.CompileAndRegister(); err != nil {
-		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to compile files: %v", err))
+	warnings, ok := s.compileAndRegister(w, batch)
+	if !ok {
 		return
 	}
-
-	writeJSON(w, http.StatusCreated, nil)
+	writeJSON(w, http.StatusCreated, map[string][]reflection.Diagnostic{"diagnostics": warnings})
 }
 
 func (s *Server) handleIngestProtoFile(w http.ResponseWriter, r *http.Request) {
@@ -104,7 +208,7 @@ func (s *Server) handleIngestProtoFile(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	statusCode, err := s.injestProtoFileFromRequest(r)
+	statusCode, err := s.injestProtoFileFromRequest(r, stagingBatch(r))
 	if err != nil {
 		writeError(w, statusCode, err.Error())
 		return
@@ -113,7 +217,7 @@ func (s *Server) handleIngestProtoFile(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusAccepted, nil)
 }
 
-func (s *Server) injestProtoFileFromRequest(r *http.Request) (int, error) {
+func (s *Server) injestProtoFileFromRequest(r *http.Request, batch string) (int, error) {
 	err := r.ParseMultipartForm(64 << 20) // 64MB max
 	if err != nil {
 		return http.StatusBadRequest, fmt.Errorf("error parsing multipart form: %w", err)
@@ -131,7 +235,7 @@ func (s *Server) injestProtoFileFromRequest(r *http.Request) (int, error) {
 			return http.StatusInternalServerError, fmt.Errorf("error reading file: %w", err)
 		}
 
-		s.descriptorRegistry.IngestProtoFile(fullPath, string(content))
+		s.descriptorRegistry.StageProtoFile(batch, fullPath, string(content))
 	}
 	return http.StatusAccepted, nil
 }
@@ -175,17 +279,34 @@ func extractFullFilename(header *multipart.FileHeader) (string, error) {
 	return filename, nil
 }
 
-// handleCompile compiles and registers all previously ingested .proto sources.
+// handleCompile compiles and registers the .proto sources ingested in a batch, the default one unless ?batch is set.
 func (s *Server) handleCompile(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	if err := s.descriptorRegistry.CompileAndRegister(); err != nil {
-		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to compile files: %v", err))
+	warnings, ok := s.compileAndRegister(w, stagingBatch(r))
+	if !ok {
 		return
 	}
-	writeJSON(w, http.StatusOK, nil)
+	writeJSON(w, http.StatusOK, map[string][]reflection.Diagnostic{"diagnostics": warnings})
+}
+
+// compileAndRegister compiles and registers the files staged in batch, and returns the warnings of the compiler.
+// On failure, the batch is discarded, every diagnostic is answered and it returns false.
+func (s *Server) compileAndRegister(w http.ResponseWriter, batch string) ([]reflection.Diagnostic, bool) {
+	warnings, err := s.descriptorRegistry.CompileBatch(batch)
+	if err != nil {
+		body := map[string]any{"error": fmt.Sprintf("failed to compile files: %v", err)}
+		var compileErr *reflection.CompileError
+		if errors.As(err, &compileErr) {
+			body["diagnostics"] = compileErr.Diagnostics
+		}
+		writeJSON(w, http.StatusBadRequest, body)
+		return nil, false
+	}
+	s.redecodeHistory()
+	return warnings, true
 }
 
 // handleAddMock registers a new mock configuration.
@@ -204,6 +325,19 @@ func (s *Server) handleAddMock(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusMethodNotAllowed, "service and method are required")
 		return
 	}
+	if mc.Shadow != nil {
+		switch mc.Shadow.Serve {
+		case "", mocks.ServeMock, mocks.ServeUpstream:
+		default:
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid shadow serve %q: expected %q or %q", mc.Shadow.Serve, mocks.ServeMock, mocks.ServeUpstream))
+			return
+		}
+		md, ok := s.descriptorRegistry.GetMethodDescriptor("/" + mc.Service + "/" + mc.Method)
+		if ok && (md.IsStreamingClient() || md.IsStreamingServer()) {
+			writeError(w, http.StatusBadRequest, "only unary methods can be shadowed")
+			return
+		}
+	}
 	s.mockRegistry.RegisterMock(mc)
 	writeJSON(w, http.StatusCreated, nil)
 }
@@ -214,8 +348,44 @@ func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	history := s.historyRegistry.GetHistories()
-	writeJSON(w, http.StatusOK, history)
+	q, err := parseHistoryQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	page := s.historyRegistry.Query(q)
+	for i := range page.Histories {
+		s.redecode(&page.Histories[i])
+	}
+	if page.NextCursor != "" {
+		w.Header().Set(NextCursorHeader, page.NextCursor)
+	}
+	writeJSON(w, http.StatusOK, page.Histories)
+}
+
+// handleHistoryByID returns (GET) or deletes (DELETE) a single history entry.
+func (s *Server) handleHistoryByID(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	switch r.Method {
+	case http.MethodGet:
+		h, ok := s.historyRegistry.GetHistory(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, "history not found")
+			return
+		}
+		s.redecode(&h)
+		writeJSON(w, http.StatusOK, h)
+	case http.MethodDelete:
+		if !s.historyRegistry.DeleteHistory(id) {
+			writeError(w, http.StatusNotFound, "history not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"message": "history deleted"})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
 }
 
 func (s *Server) clearHistory(w http.ResponseWriter, r *http.Request) {
@@ -228,6 +398,87 @@ func (s *Server) clearHistory(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]string{"message": "history cleared"})
 }
 
+// handleHistoryStats reports the occupancy of the history store, when the store supports it.
+func (s *Server) handleHistoryStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	statser, ok := s.historyRegistry.(interface{ Stats() history.Stats })
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "history store doesn't expose stats")
+		return
+	}
+	writeJSON(w, http.StatusOK, statser.Stats())
+}
+
+// handleRedaction returns the redaction rules applied to the history.
+// They are only set at startup, so that the admin API can't be used to reveal secrets.
+func (s *Server) handleRedaction(w http.ResponseWriter, r *http.Request) {
+	if s.redactor == nil {
+		writeError(w, http.StatusNotImplemented, "redaction is not enabled")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.redactor.Rules())
+}
+
+// handleDrift reports (GET) or resets (DELETE) the mismatches between the proxy backend
+// responses and the registered descriptors, by method.
+func (s *Server) handleDrift(w http.ResponseWriter, r *http.Request) {
+	if s.drift == nil {
+		writeError(w, http.StatusNotImplemented, "drift detection is not enabled")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.drift.Report())
+	case http.MethodDelete:
+		s.drift.Reset()
+		writeJSON(w, http.StatusOK, map[string]string{"message": "drift report reset"})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleProtoFile unregisters (DELETE) a proto file. With ?cascade=true the files importing it
+// are unregistered as well, otherwise they are reported with a 409.
+func (s *Server) handleProtoFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	cascade := false
+	if v := r.URL.Query().Get("cascade"); v != "" {
+		var err error
+		if cascade, err = strconv.ParseBool(v); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid cascade: %v", err))
+			return
+		}
+	}
+
+	removed, err := s.descriptorRegistry.UnregisterFile(r.PathValue("path"), cascade)
+	var dependentsErr *reflection.DependentsError
+	switch {
+	case errors.Is(err, reflection.ErrFileNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, reflection.ErrBuiltinFile):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.As(err, &dependentsErr):
+		writeJSON(w, http.StatusConflict, map[string]any{
+			"error":      err.Error() + ", unregister them first or use cascade=true",
+			"dependents": dependentsErr.Dependents,
+		})
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, map[string][]string{"unregistered": removed})
+	}
+}
+
 func writeError(w http.ResponseWriter, status int, message string) {
 	writeJSON(w, status, map[string]string{"error": message})
 }
@@ -1,16 +1,30 @@
 package http_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
 	"github.com/marcaudefroy/grpc-hot-mock/pkg/mocks"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/redact"
 	"github.com/marcaudefroy/grpc-hot-mock/pkg/reflection"
 	httpServer "github.com/marcaudefroy/grpc-hot-mock/pkg/server/http"
+	"golang.org/x/net/websocket"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
 )
 
 func TestHandleRegisterProtoJSON(t *testing.T) {
@@ -96,6 +110,147 @@ func TestHandleIngestAndCompile(t *testing.T) {
 	}
 }
 
+func TestHandleCompileDiagnostics(t *testing.T) {
+	dr := reflection.NewDefaultDescriptorRegistry()
+	mux := httpServer.NewServer(dr, &mocks.DefaultRegistry{}, &history.DefaultRegistry{})
+
+	register := func(content string) (int, map[string]any) {
+		payload := map[string]any{"files": []map[string]string{{"filename": "a.proto", "content": content}}}
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(http.MethodPost, "/protos/register/json", bytes.NewReader(body))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		var resp map[string]any
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode JSON body: %v", err)
+		}
+		return rec.Code, resp
+	}
+
+	code, resp := register("syntax = \"proto3\";\nmessage A {\n  Unknown x = 1;\n  Other y = 2;\n}\n")
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", code)
+	}
+	diagnostics, _ := resp["diagnostics"].([]any)
+	if len(diagnostics) != 2 {
+		t.Fatalf("expected both errors, got %v", resp)
+	}
+	first, _ := diagnostics[0].(map[string]any)
+	if first["severity"] != "error" || first["file"] != "a.proto" || first["line"] != float64(3) || first["snippet"] != "  Unknown x = 1;" {
+		t.Errorf("unexpected diagnostic %v", first)
+	}
+
+	code, resp = register("syntax = \"proto3\";\nimport \"google/protobuf/empty.proto\";\nmessage A {}\n")
+	if code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %v", code, resp)
+	}
+	if warnings, _ := resp["diagnostics"].([]any); len(warnings) != 1 {
+		t.Errorf("expected the unused import warning, got %v", resp)
+	}
+}
+
+func TestHandleStaging(t *testing.T) {
+	dr := reflection.NewDefaultDescriptorRegistry()
+	mux := httpServer.NewServer(dr, &mocks.DefaultRegistry{}, &history.DefaultRegistry{})
+	do := func(method, target string, body any) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != nil {
+			b, _ := json.Marshal(body)
+			reader = bytes.NewReader(b)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, target, reader))
+		return rec
+	}
+	files := func(files ...string) map[string]any {
+		var list []map[string]string
+		for i := 0; i < len(files); i += 2 {
+			list = append(list, map[string]string{"filename": files[i], "content": files[i+1]})
+		}
+		return map[string]any{"files": list}
+	}
+
+	do(http.MethodPost, "/protos/ingest/json?batch=alice", files("a.proto", `syntax = "proto3"; package a; message A {}`, "b.proto", `syntax = "proto3"; package b;`))
+	do(http.MethodPost, "/protos/ingest/json", files("c.proto", `syntax = "proto3"; package c; message C {`))
+
+	rec := do(http.MethodGet, "/protos/ingest?batch=alice", nil)
+	var staged []httpServer.StagedFileInfo
+	if err := json.NewDecoder(rec.Body).Decode(&staged); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(staged) != 2 || staged[0].Batch != "alice" || staged[0].Path != "a.proto" || staged[0].Size == 0 {
+		t.Errorf("unexpected staged files %+v", staged)
+	}
+
+	if rec := do(http.MethodDelete, "/protos/ingest/b.proto?batch=alice", nil); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 discarding b.proto, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/protos/ingest/b.proto?batch=alice", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a file not staged, got %d", rec.Code)
+	}
+
+	// A failed compilation discards the default batch only
+	if rec := do(http.MethodPost, "/protos/ingest/compile", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 compiling c.proto, got %d", rec.Code)
+	}
+	if pending := dr.PendingFiles(); len(pending) != 1 || pending[0] != "a.proto" {
+		t.Errorf("expected a.proto staged only, got %v", pending)
+	}
+
+	// Registering leaves the staged files alone
+	if rec := do(http.MethodPost, "/protos/register/json", files("d.proto", `syntax = "proto3"; package d; message D {}`)); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+	if _, ok := dr.GetMessageDescriptor("a.A"); ok {
+		t.Error("a.A must stay staged")
+	}
+	// Even when it fails, and names a shared batch
+	if rec := do(http.MethodPost, "/protos/register/json?batch=alice", files("e.proto", `syntax = "proto3"; package e; message E {`)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	if pending := dr.PendingFiles(); len(pending) != 1 || pending[0] != "a.proto" {
+		t.Errorf("expected a.proto still staged, got %v", pending)
+	}
+	if rec := do(http.MethodPost, "/protos/ingest/compile?batch=alice", nil); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 compiling batch alice, got %d", rec.Code)
+	}
+	if _, ok := dr.GetMessageDescriptor("a.A"); !ok {
+		t.Error("a.A must be registered")
+	}
+	if rec := do(http.MethodDelete, "/protos/ingest?batch=alice", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a compiled batch, got %d", rec.Code)
+	}
+
+	// A register request failing before its compilation leaves nothing staged
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("files", "f.proto")
+	part.Write([]byte(`syntax = "proto3"; package f;`))
+	// An empty file fails to be read
+	mw.CreateFormFile("files", "g.proto")
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/protos/register/file", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code == http.StatusCreated {
+		t.Fatalf("expected the empty file to fail, got %d", rec.Code)
+	}
+	if staged := dr.StagedFiles(); len(staged) != 0 {
+		t.Errorf("expected the private batch discarded, got %+v", staged)
+	}
+
+	// The private batches of the register requests in progress are not listed
+	dr.StageProtoFile("register-in-progress", "h.proto", `syntax = "proto3"; package h;`)
+	staged = nil
+	if err := json.NewDecoder(do(http.MethodGet, "/protos/ingest", nil).Body).Decode(&staged); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(staged) != 0 {
+		t.Errorf("expected no staged file listed, got %+v", staged)
+	}
+}
+
 func TestHandleAddMock(t *testing.T) {
 	dr := reflection.NewDefaultDescriptorRegistry()
 	mr := &mocks.DefaultRegistry{}
@@ -120,6 +275,28 @@ func TestHandleAddMock(t *testing.T) {
 	if _, exists := mr.GetMock("/svc/M"); !exists {
 		t.Error("mock not properly registered")
 	}
+
+	// Only unary methods can be shadowed
+	if err := dr.RegisterProtoFile("chat.proto", `syntax = "proto3"; package example;
+message Line { string text = 1; }
+service Chat { rpc Talk(stream Line) returns (stream Line); }`); err != nil {
+		t.Fatalf("register proto failed: %v", err)
+	}
+	body = []byte(`{"service":"example.Chat","method":"Talk","shadow":{"serve":"mock"}}`)
+	req = httptest.NewRequest(http.MethodPost, "/mocks", bytes.NewReader(body))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a shadowed streaming method, got %d", rec.Code)
+	}
+
+	body = []byte(`{"service":"svc","method":"M","shadow":{"serve":"upstrem"}}`)
+	req = httptest.NewRequest(http.MethodPost, "/mocks", bytes.NewReader(body))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown shadow side, got %d", rec.Code)
+	}
 }
 
 func TestHandleHistoryAndClear(t *testing.T) {
@@ -146,6 +323,549 @@ func TestHandleHistoryAndClear(t *testing.T) {
 	assertNoErrorInBody(t, rec.Body)
 }
 
+func TestHandleHistoryQueryAndByID(t *testing.T) {
+	dr := reflection.NewDefaultDescriptorRegistry()
+	mr := &mocks.DefaultRegistry{}
+	hr := &history.DefaultRegistry{}
+	mux := httpServer.NewServer(dr, mr, hr)
+
+	now := time.Now()
+	hr.SaveHistory(history.History{ID: "a", StartTime: now, FullMethod: "/grpc.reflection.v1.ServerReflection/ServerReflectionInfo"})
+	hr.SaveHistory(history.History{ID: "b", StartTime: now.Add(time.Millisecond), FullMethod: "/example.Greeter/SayHello"})
+	hr.SaveHistory(history.History{ID: "c", StartTime: now.Add(2 * time.Millisecond), FullMethod: "/example.Greeter/SayHello"})
+
+	// Filter + pagination
+	req := httptest.NewRequest(http.MethodGet, "/history?exclude_reflection=true&limit=1", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", rec.Code)
+	}
+	var histories []history.History
+	if err := json.NewDecoder(rec.Body).Decode(&histories); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if len(histories) != 1 || histories[0].ID != "b" {
+		t.Fatalf("unexpected first page %+v", histories)
+	}
+	cursor := rec.Header().Get(httpServer.NextCursorHeader)
+	if cursor == "" {
+		t.Fatal("expected a next cursor header")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/history?exclude_reflection=true&limit=1&cursor="+cursor, nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	histories = nil
+	_ = json.NewDecoder(rec.Body).Decode(&histories)
+	if len(histories) != 1 || histories[0].ID != "c" {
+		t.Fatalf("unexpected second page %+v", histories)
+	}
+	if rec.Header().Get(httpServer.NextCursorHeader) != "" {
+		t.Error("expected no cursor on last page")
+	}
+
+	// Invalid filter
+	req = httptest.NewRequest(http.MethodGet, "/history?method_regex=(", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid regex, got %d", rec.Code)
+	}
+
+	// Get by ID
+	req = httptest.NewRequest(http.MethodGet, "/history/b", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK on /history/b, got %d", rec.Code)
+	}
+	var h history.History
+	_ = json.NewDecoder(rec.Body).Decode(&h)
+	if h.ID != "b" {
+		t.Errorf("unexpected history %+v", h)
+	}
+
+	// Delete by ID
+	req = httptest.NewRequest(http.MethodDelete, "/history/b", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 OK on delete, got %d", rec.Code)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/history/b", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 after delete, got %d", rec.Code)
+	}
+}
+
+func TestHandleRedecodeAfterCompile(t *testing.T) {
+	dr := reflection.NewDefaultDescriptorRegistry()
+	mr := &mocks.DefaultRegistry{}
+	hr := &history.DefaultRegistry{}
+	mux := httpServer.NewServer(dr, mr, hr)
+
+	// HelloRequest{name: "Alice"} recorded before its proto is known
+	raw := []byte{0x0a, 0x05, 'A', 'l', 'i', 'c', 'e'}
+	hr.SaveHistory(history.History{
+		ID:         "a",
+		StartTime:  time.Now(),
+		FullMethod: "/example.Greeter/SayHello",
+		State:      history.StateClosed,
+		Messages:   []history.Message{{Direction: "recv", PayloadString: "CgVBbGljZQ==", RawPayload: raw}},
+	})
+
+	payload := map[string]any{"files": []map[string]string{{
+		"filename": "greeter.proto",
+		"content": `syntax = "proto3"; package example;
+message HelloRequest { string name = 1; }
+message HelloReply { string message = 1; }
+service Greeter { rpc SayHello(HelloRequest) returns (HelloReply); }`,
+	}}}
+	body, _ := json.Marshal(payload)
+	req := httptest.NewRequest(http.MethodPost, "/protos/register/json", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201 Created, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Compiling re-decodes the stored history
+	h, _ := hr.GetHistory("a")
+	if m := h.Messages[0]; !m.Recognized {
+		t.Fatalf("expected the message to be decoded after compile, got %+v", m)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/history/redecode", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"redecoded":0`) {
+		t.Errorf("expected nothing left to redecode, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandleHistoryExport(t *testing.T) {
+	dr := reflection.NewDefaultDescriptorRegistry()
+	mr := &mocks.DefaultRegistry{}
+	hr := &history.DefaultRegistry{}
+	mux := httpServer.NewServer(dr, mr, hr)
+
+	now := time.Now()
+	raw := []byte{0x08, 0x2a}
+	hr.SaveHistory(history.History{ID: "a", StartTime: now, FullMethod: "/example.Greeter/SayHello", State: history.StateClosed,
+		Messages: []history.Message{{Direction: "recv", PayloadString: "CCo=", RawPayload: raw}}})
+	hr.SaveHistory(history.History{ID: "b", StartTime: now.Add(time.Millisecond), FullMethod: "/example.Other/Watch", State: history.StateClosed})
+
+	export := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/history/export?"+query, nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200 OK on %s, got %d: %s", query, rec.Code, rec.Body.String())
+		}
+		return rec
+	}
+
+	rec := export("format=jsonl")
+	if lines := strings.Count(rec.Body.String(), "\n"); lines != 2 {
+		t.Errorf("expected one line per call, got %d", lines)
+	}
+
+	rec = export("format=har&method_prefix=/example.Greeter/")
+	var doc struct {
+		Log struct {
+			Entries []struct {
+				Request struct {
+					URL string `json:"url"`
+				} `json:"request"`
+			} `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&doc); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if len(doc.Log.Entries) != 1 || !strings.HasSuffix(doc.Log.Entries[0].Request.URL, "/example.Greeter/SayHello") {
+		t.Errorf("unexpected HAR entries %+v", doc.Log.Entries)
+	}
+
+	rec = export("format=frames&method=/example.Greeter/SayHello")
+	r := bufio.NewReader(rec.Body)
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		t.Fatalf("read header size failed: %v", err)
+	}
+	header := make([]byte, size)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatalf("read header failed: %v", err)
+	}
+	var h history.History
+	if err := json.Unmarshal(header, &h); err != nil || h.ID != "a" || len(h.Messages) != 1 {
+		t.Fatalf("unexpected header %s: %v", header, err)
+	}
+	frame := make([]byte, 5+len(raw))
+	if _, err := io.ReadFull(r, frame); err != nil {
+		t.Fatalf("read frame failed: %v", err)
+	}
+	if binary.BigEndian.Uint32(frame[1:5]) != uint32(len(raw)) || !bytes.Equal(frame[5:], raw) {
+		t.Errorf("unexpected frame %x", frame)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/history/export?format=xml", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown format, got %d", rec.Code)
+	}
+}
+
+func TestHandleRedaction(t *testing.T) {
+	dr := reflection.NewDefaultDescriptorRegistry()
+	mr := &mocks.DefaultRegistry{}
+	hr := &history.DefaultRegistry{}
+	redactor, err := redact.New(redact.Rules{FieldPaths: []string{"name"}})
+	if err != nil {
+		t.Fatalf("new redactor failed: %v", err)
+	}
+	mux := httpServer.NewServer(dr, mr, hr, httpServer.WithRedactor(redactor))
+
+	// Recorded before redaction dropped the bytes of unrecognized messages
+	hr.SaveHistory(history.History{ID: "a", FullMethod: "/example.Greeter/SayHello", State: history.StateClosed,
+		Messages: []history.Message{{Direction: "recv", PayloadString: "CgVBbGljZQ==", RawPayload: []byte{0x0a, 0x05, 'A', 'l', 'i', 'c', 'e'}}}})
+
+	req := httptest.NewRequest(http.MethodGet, "/history/export?format=frames", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if bytes.Contains(rec.Body.Bytes(), []byte("Alice")) {
+		t.Errorf("unrecognized bytes exported despite redaction: %q", rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/redaction", strings.NewReader(`{}`))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected rules to be read-only, got %d", rec.Code)
+	}
+	if rules := redactor.Rules(); len(rules.FieldPaths) != 1 {
+		t.Errorf("rules changed at runtime: %+v", rules)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/redaction", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"name"`) {
+		t.Errorf("unexpected rules %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandleHistoryStream(t *testing.T) {
+	dr := reflection.NewDefaultDescriptorRegistry()
+	mr := &mocks.DefaultRegistry{}
+	hr := &history.DefaultRegistry{}
+	srv := httptest.NewServer(httpServer.NewServer(dr, mr, hr))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/history/stream?exclude_reflection=true", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("stream request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	hr.SaveHistory(history.History{ID: "r", FullMethod: "/grpc.reflection.v1.ServerReflection/ServerReflectionInfo", State: history.StateOpen})
+	hr.SaveHistory(history.History{ID: "a", FullMethod: "/example.Greeter/SayHello", State: history.StateOpen})
+
+	scanner := bufio.NewScanner(resp.Body)
+	var event, data string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if v, ok := strings.CutPrefix(line, "event: "); ok {
+			event = v
+		}
+		if v, ok := strings.CutPrefix(line, "data: "); ok {
+			data = v
+			break
+		}
+	}
+	if event != string(history.EventCallOpened) {
+		t.Fatalf("expected call_opened event, got %q", event)
+	}
+	var e history.Event
+	if err := json.Unmarshal([]byte(data), &e); err != nil {
+		t.Fatalf("invalid event data %q: %v", data, err)
+	}
+	if e.History.ID != "a" {
+		t.Errorf("expected event on call a, got %+v", e)
+	}
+}
+
+func TestHandleHistoryWebSocket(t *testing.T) {
+	dr := reflection.NewDefaultDescriptorRegistry()
+	mr := &mocks.DefaultRegistry{}
+	hr := &history.DefaultRegistry{}
+	srv := httptest.NewServer(httpServer.NewServer(dr, mr, hr))
+	defer srv.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/history/ws?method=/example.Greeter/SayHello", "", srv.URL)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	defer ws.Close()
+
+	// The subscription is registered asynchronously after the handshake
+	deadline := time.Now().Add(5 * time.Second)
+	_ = ws.SetReadDeadline(deadline)
+	received := make(chan struct{})
+	defer close(received)
+	go func() {
+		for i := 0; time.Now().Before(deadline); i++ {
+			select {
+			case <-received:
+				return
+			default:
+			}
+			hr.SaveHistory(history.History{ID: fmt.Sprint(i), FullMethod: "/example.Greeter/SayHello", State: history.StateOpen})
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	var e history.Event
+	if err := websocket.JSON.Receive(ws, &e); err != nil {
+		t.Fatalf("receive failed: %v", err)
+	}
+	if e.Type != history.EventCallOpened || e.History.FullMethod != "/example.Greeter/SayHello" {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
+
+func TestHandleHistoryWait(t *testing.T) {
+	dr := reflection.NewDefaultDescriptorRegistry()
+	mr := &mocks.DefaultRegistry{}
+	hr := &history.DefaultRegistry{}
+	mux := httpServer.NewServer(dr, mr, hr)
+
+	call := func(id, userID string) history.History {
+		return history.History{
+			ID:         id,
+			StartTime:  time.Now(),
+			FullMethod: "/example.UserService/GetUser",
+			State:      history.StateClosed,
+			Messages:   []history.Message{{Direction: "recv", Payload: map[string]any{"user": map[string]any{"id": userID}}}},
+		}
+	}
+	hr.SaveHistory(call("a", "42"))
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/history/wait?method=/example.UserService/GetUser&match=user.id=42&count=2&timeout=5s", nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		done <- rec
+	}()
+	time.Sleep(50 * time.Millisecond)
+	hr.SaveHistory(call("b", "7"))
+	hr.SaveHistory(call("c", "42"))
+
+	rec := <-done
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var matched []history.History
+	if err := json.NewDecoder(rec.Body).Decode(&matched); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if len(matched) != 2 || matched[0].ID != "a" || matched[1].ID != "c" {
+		t.Errorf("expected calls a and c, got %+v", matched)
+	}
+
+	// Not enough calls: 408 with what was seen
+	req := httptest.NewRequest(http.MethodGet, "/history/wait?match=user.id=42&count=3&timeout=50ms", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestTimeout {
+		t.Fatalf("expected 408, got %d", rec.Code)
+	}
+	matched = nil
+	if err := json.NewDecoder(rec.Body).Decode(&matched); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if len(matched) != 2 {
+		t.Errorf("expected the 2 calls seen so far, got %+v", matched)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/history/wait?match=user.id", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid matcher, got %d", rec.Code)
+	}
+}
+
+func TestHandleUnregisterProtoFile(t *testing.T) {
+	dr := reflection.NewDefaultDescriptorRegistry()
+	mr := &mocks.DefaultRegistry{}
+	hr := &history.DefaultRegistry{}
+	mux := httpServer.NewServer(dr, mr, hr)
+
+	dr.StageProtoFile(reflection.DefaultBatch, "api/common.proto", `syntax = "proto3"; package common; message User {}`)
+	dr.StageProtoFile(reflection.DefaultBatch, "api/svc.proto", `syntax = "proto3"; package svc; import "api/common.proto";
+service Users { rpc Get(common.User) returns (common.User); }`)
+	if err := dr.CompileAndRegister(); err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+
+	del := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, target, nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := del("/protos/api/common.proto")
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "api/svc.proto") {
+		t.Fatalf("expected 409 listing the dependents, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = del("/protos/api/common.proto?cascade=true")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, ok := dr.GetMethodDescriptor("/svc.Users/Get"); ok {
+		t.Error("dependent method must be unregistered")
+	}
+	if rec := del("/protos/api/common.proto"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestHandleIntrospection(t *testing.T) {
+	dr := reflection.NewDefaultDescriptorRegistry()
+	mr := &mocks.DefaultRegistry{}
+	hr := &history.DefaultRegistry{}
+	mux := httpServer.NewServer(dr, mr, hr)
+
+	dr.StageProtoFile(reflection.DefaultBatch, "common.proto", `syntax = "proto3"; package common;
+message User { message Address { string city = 1; } string name = 1; Address address = 2; map<string, int64> scores = 3; optional string nickname = 4; }`)
+	dr.StageProtoFile(reflection.DefaultBatch, "svc.proto", `syntax = "proto3"; package svc; import "common.proto"; import "google/protobuf/empty.proto";
+service Users { rpc Get(google.protobuf.Empty) returns (common.User); rpc Watch(google.protobuf.Empty) returns (stream common.User); }`)
+	if err := dr.CompileAndRegister(); err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+	dr.StageProtoFile(reflection.DefaultBatch, "later.proto", `syntax = "proto3"; package later;`)
+	mr.RegisterMock(mocks.MockConfig{Service: "svc.Users", Method: "Get"})
+
+	get := func(target string, v any) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if v != nil && rec.Code == http.StatusOK {
+			if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+				t.Fatalf("%s: decode failed: %v", target, err)
+			}
+		}
+		return rec
+	}
+
+	var files []httpServer.ProtoFileInfo
+	get("/protos", &files)
+	if len(files) != 3 {
+		t.Fatalf("expected 3 files without the well-known ones, got %+v", files)
+	}
+	if files[0].Path != "common.proto" || files[0].Status != httpServer.FileRegistered || files[0].Package != "common" {
+		t.Errorf("unexpected common.proto info %+v", files[0])
+	}
+	if files[1].Path != "later.proto" || files[1].Status != httpServer.FilePending {
+		t.Errorf("expected later.proto pending, got %+v", files[1])
+	}
+	if len(files[2].Dependencies) != 2 || files[2].Services[0] != "svc.Users" {
+		t.Errorf("unexpected svc.proto info %+v", files[2])
+	}
+
+	var services []httpServer.ServiceInfo
+	get("/services", &services)
+	if len(services) != 1 || services[0].Name != "svc.Users" || len(services[0].Methods) != 2 {
+		t.Errorf("unexpected services %+v", services)
+	}
+
+	var methods []httpServer.MethodInfo
+	get("/services/svc.Users/methods", &methods)
+	if len(methods) != 2 || !methods[0].Mocked || methods[1].Mocked || !methods[1].ServerStreaming || methods[1].OutputType != "common.User" {
+		t.Errorf("unexpected methods %+v", methods)
+	}
+	if rec := get("/services/svc.Nope/methods", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown service, got %d", rec.Code)
+	}
+
+	var msg httpServer.MessageInfo
+	get("/messages/common.User", &msg)
+	if len(msg.Fields) != 4 || msg.Fields[1].Type != "common.User.Address" || msg.Fields[2].Type != "map<string, int64>" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	if msg.Fields[0].Optional || !msg.Fields[3].Optional || msg.Fields[3].Oneof != "" {
+		t.Errorf("expected only the proto3 optional field to be optional, got %+v", msg.Fields)
+	}
+	if len(msg.Messages) != 1 || msg.Messages[0] != "common.User.Address" {
+		t.Errorf("expected the nested Address message, got %+v", msg.Messages)
+	}
+	if rec := get("/messages/common.User.Address", nil); rec.Code != http.StatusOK {
+		t.Errorf("expected nested messages to be found, got %d", rec.Code)
+	}
+
+	rec := get("/protos/graph?format=dot", nil)
+	if !strings.Contains(rec.Body.String(), `"svc.proto" -> "google/protobuf/empty.proto"`) {
+		t.Errorf("unexpected graph %s", rec.Body.String())
+	}
+}
+
+func TestHandleUploadDescriptorSet(t *testing.T) {
+	dr := reflection.NewDefaultDescriptorRegistry()
+	mr := &mocks.DefaultRegistry{}
+	hr := &history.DefaultRegistry{}
+	mux := httpServer.NewServer(dr, mr, hr)
+
+	compiler := reflection.NewDefaultDescriptorRegistry()
+	compiler.StageProtoFile(reflection.DefaultBatch, "hello.proto", `syntax = "proto3"; package example;
+message HelloRequest { string name = 1; }
+service Greeter { rpc SayHello(HelloRequest) returns (HelloRequest); }`)
+	if err := compiler.CompileAndRegister(); err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+	fds := compiler.GetFileDescriptors()
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{protodesc.ToFileDescriptorProto(fds[len(fds)-1])}}
+
+	upload := func(contentType string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/protos/register/descriptorset", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	binary, _ := proto.Marshal(set)
+	if rec := upload("application/octet-stream", binary); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, ok := dr.GetMethodDescriptor("/example.Greeter/SayHello"); !ok {
+		t.Error("/example.Greeter/SayHello must be registered")
+	}
+
+	jsonSet, _ := protojson.Marshal(set)
+	if rec := upload("application/json", jsonSet); rec.Code != http.StatusCreated {
+		t.Errorf("expected 201 for a JSON descriptor set, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := upload("application/octet-stream", []byte("garbage")); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid descriptor set, got %d", rec.Code)
+	}
+	if rec := upload("application/octet-stream", make([]byte, 64<<20+1)); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for an oversized descriptor set, got %d", rec.Code)
+	}
+}
+
 // Helper
 func assertNoErrorInBody(t *testing.T, body *bytes.Buffer) {
 	var resp map[string]any
@@ -0,0 +1,328 @@
+package http
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/reflection"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Status of a proto file in /protos
+const (
+	// FileRegistered files are compiled and served
+	FileRegistered = "registered"
+	// FilePending files are ingested and wait for a compilation, a previous version may be served meanwhile
+	FilePending = "pending"
+	// FileBuiltin files are the well-known types preloaded at startup
+	FileBuiltin = "builtin"
+)
+
+// ProtoFileInfo describes a file of /protos.
+type ProtoFileInfo struct {
+	Path         string   `json:"path"`
+	Package      string   `json:"package,omitempty"`
+	Dependencies []string `json:"dependencies"`
+	Status       string   `json:"status"`
+	Messages     int      `json:"messages"`
+	Services     []string `json:"services"`
+}
+
+// ServiceInfo describes a service of /services.
+type ServiceInfo struct {
+	Name    string   `json:"name"`
+	File    string   `json:"file"`
+	Methods []string `json:"methods"`
+}
+
+// MethodInfo describes a method of /services/{name}/methods.
+type MethodInfo struct {
+	Name            string `json:"name"`
+	FullMethod      string `json:"full_method"`
+	InputType       string `json:"input_type"`
+	OutputType      string `json:"output_type"`
+	ClientStreaming bool   `json:"client_streaming"`
+	ServerStreaming bool   `json:"server_streaming"`
+	Mocked          bool   `json:"mocked"`
+}
+
+// MessageInfo describes a message of /messages/{fullName}.
+type MessageInfo struct {
+	FullName string      `json:"full_name"`
+	File     string      `json:"file"`
+	Fields   []FieldInfo `json:"fields"`
+	// Messages and Enums are the full names of the nested types
+	Messages []string `json:"messages"`
+	Enums    []string `json:"enums"`
+}
+
+// FieldInfo describes a message field. Type is the scalar kind ("string", "int64"...), the full
+// name of the message or enum, or "map<key, value>" for maps.
+type FieldInfo struct {
+	Name     string `json:"name"`
+	JSONName string `json:"json_name"`
+	Number   int32  `json:"number"`
+	Type     string `json:"type"`
+	Repeated bool   `json:"repeated,omitempty"`
+	// Optional is set for fields tracking their presence
+	Optional bool   `json:"optional,omitempty"`
+	Oneof    string `json:"oneof,omitempty"`
+}
+
+// files returns the registered files, well-known ones only when requested with ?builtin=true.
+func (s *Server) files(r *http.Request) ([]protoreflect.FileDescriptor, error) {
+	builtin := false
+	if v := r.URL.Query().Get("builtin"); v != "" {
+		var err error
+		if builtin, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid builtin: %w", err)
+		}
+	}
+	var files []protoreflect.FileDescriptor
+	for _, fd := range s.descriptorRegistry.GetFileDescriptors() {
+		if builtin || !reflection.IsBuiltinFile(fd) {
+			files = append(files, fd)
+		}
+	}
+	return files, nil
+}
+
+// handleProtos lists the proto files with their package, imports and status.
+// Ingested files not compiled yet are listed as pending.
+func (s *Server) handleProtos(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	files, err := s.files(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	pending := map[string]bool{}
+	for _, f := range s.stagedFiles() {
+		pending[f.Filename] = true
+	}
+
+	infos := []ProtoFileInfo{}
+	for _, fd := range files {
+		info := ProtoFileInfo{
+			Path:         fd.Path(),
+			Package:      string(fd.Package()),
+			Dependencies: imports(fd),
+			Status:       FileRegistered,
+			Messages:     fd.Messages().Len(),
+			Services:     []string{},
+		}
+		for i := 0; i < fd.Services().Len(); i++ {
+			info.Services = append(info.Services, string(fd.Services().Get(i).FullName()))
+		}
+		switch {
+		case pending[fd.Path()]:
+			info.Status = FilePending
+			delete(pending, fd.Path())
+		case reflection.IsBuiltinFile(fd):
+			info.Status = FileBuiltin
+		}
+		infos = append(infos, info)
+	}
+	// Never compiled: nothing is known besides the name
+	for path := range pending {
+		infos = append(infos, ProtoFileInfo{Path: path, Dependencies: []string{}, Status: FilePending, Services: []string{}})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Path < infos[j].Path })
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func imports(fd protoreflect.FileDescriptor) []string {
+	deps := make([]string, 0, fd.Imports().Len())
+	for i := 0; i < fd.Imports().Len(); i++ {
+		deps = append(deps, fd.Imports().Get(i).Path())
+	}
+	return deps
+}
+
+// handleProtosGraph returns the import graph of the proto files, as JSON or, with ?format=dot, as Graphviz.
+// Well-known files appear when they are imported.
+func (s *Server) handleProtosGraph(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	files, err := s.files(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	type edge struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	graph := struct {
+		Nodes []string `json:"nodes"`
+		Edges []edge   `json:"edges"`
+	}{Nodes: []string{}, Edges: []edge{}}
+	nodes := map[string]bool{}
+	addNode := func(path string) {
+		if !nodes[path] {
+			nodes[path] = true
+			graph.Nodes = append(graph.Nodes, path)
+		}
+	}
+	for _, fd := range files {
+		addNode(fd.Path())
+		for _, dep := range imports(fd) {
+			addNode(dep)
+			graph.Edges = append(graph.Edges, edge{From: fd.Path(), To: dep})
+		}
+	}
+	sort.Strings(graph.Nodes)
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, graph)
+	case "dot":
+		var b strings.Builder
+		b.WriteString("digraph protos {\n")
+		for _, n := range graph.Nodes {
+			fmt.Fprintf(&b, "  %q;\n", n)
+		}
+		for _, e := range graph.Edges {
+			fmt.Fprintf(&b, "  %q -> %q;\n", e.From, e.To)
+		}
+		b.WriteString("}\n")
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		if _, err := w.Write([]byte(b.String())); err != nil {
+			log.Printf("warning: write response failed: %v", err)
+		}
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported format %q: expected json or dot", r.URL.Query().Get("format")))
+	}
+}
+
+// handleServices lists the registered services and their methods.
+func (s *Server) handleServices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	files, err := s.files(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	services := []ServiceInfo{}
+	for _, fd := range files {
+		for i := 0; i < fd.Services().Len(); i++ {
+			svc := fd.Services().Get(i)
+			info := ServiceInfo{Name: string(svc.FullName()), File: fd.Path(), Methods: []string{}}
+			for j := 0; j < svc.Methods().Len(); j++ {
+				info.Methods = append(info.Methods, string(svc.Methods().Get(j).Name()))
+			}
+			services = append(services, info)
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	writeJSON(w, http.StatusOK, services)
+}
+
+// handleServiceMethods describes the methods of a service, and whether a mock is registered for them.
+func (s *Server) handleServiceMethods(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	name := protoreflect.FullName(r.PathValue("name"))
+	for _, fd := range s.descriptorRegistry.GetFileDescriptors() {
+		svc := fd.Services().ByName(name.Name())
+		if svc == nil || svc.FullName() != name {
+			continue
+		}
+		methods := []MethodInfo{}
+		for i := 0; i < svc.Methods().Len(); i++ {
+			m := svc.Methods().Get(i)
+			fullMethod := fmt.Sprintf("/%s/%s", svc.FullName(), m.Name())
+			_, mocked := s.mockRegistry.GetMock(fullMethod)
+			methods = append(methods, MethodInfo{
+				Name:            string(m.Name()),
+				FullMethod:      fullMethod,
+				InputType:       string(m.Input().FullName()),
+				OutputType:      string(m.Output().FullName()),
+				ClientStreaming: m.IsStreamingClient(),
+				ServerStreaming: m.IsStreamingServer(),
+				Mocked:          mocked,
+			})
+		}
+		writeJSON(w, http.StatusOK, methods)
+		return
+	}
+	writeError(w, http.StatusNotFound, fmt.Sprintf("service %s not found", name))
+}
+
+// handleMessage describes a message, nested messages included ("package.Outer.Inner").
+func (s *Server) handleMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	name := r.PathValue("fullName")
+	md, ok := s.descriptorRegistry.GetMessageDescriptor(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("message %s not found", name))
+		return
+	}
+
+	info := MessageInfo{
+		FullName: string(md.FullName()),
+		File:     md.ParentFile().Path(),
+		Fields:   []FieldInfo{},
+		Messages: []string{},
+		Enums:    []string{},
+	}
+	for i := 0; i < md.Fields().Len(); i++ {
+		fd := md.Fields().Get(i)
+		// proto3 optional fields sit in a synthetic oneof, which isn't a oneof of the message
+		oneof := fd.ContainingOneof()
+		if oneof != nil && oneof.IsSynthetic() {
+			oneof = nil
+		}
+		field := FieldInfo{
+			Name:     string(fd.Name()),
+			JSONName: fd.JSONName(),
+			Number:   int32(fd.Number()),
+			Type:     fieldType(fd),
+			Repeated: fd.IsList(),
+			Optional: fd.HasPresence() && fd.Message() == nil && oneof == nil,
+		}
+		if oneof != nil {
+			field.Oneof = string(oneof.Name())
+		}
+		info.Fields = append(info.Fields, field)
+	}
+	for i := 0; i < md.Messages().Len(); i++ {
+		if nested := md.Messages().Get(i); !nested.IsMapEntry() {
+			info.Messages = append(info.Messages, string(nested.FullName()))
+		}
+	}
+	for i := 0; i < md.Enums().Len(); i++ {
+		info.Enums = append(info.Enums, string(md.Enums().Get(i).FullName()))
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func fieldType(fd protoreflect.FieldDescriptor) string {
+	switch {
+	case fd.IsMap():
+		return fmt.Sprintf("map<%s, %s>", fieldType(fd.MapKey()), fieldType(fd.MapValue()))
+	case fd.Message() != nil:
+		return string(fd.Message().FullName())
+	case fd.Enum() != nil:
+		return string(fd.Enum().FullName())
+	}
+	return fd.Kind().String()
+}
@@ -0,0 +1,108 @@
+package http
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
+)
+
+// NextCursorHeader carries the cursor of the next history page, it is absent on the last page.
+const NextCursorHeader = "X-Next-Cursor"
+
+// parseHistoryQuery builds a history.Query from the URL query parameters:
+//
+//	method, method_prefix, method_regex   filter on the full method (exact, prefix, regexp)
+//	state                                 OPEN or CLOSED
+//	code                                  final gRPC code
+//	proxified                             true or false
+//	since, until                          RFC3339 bounds on the start time
+//	session, tag                          values of the x-hotmock-session / x-hotmock-tag headers
+//	payload                               substring searched in message payloads
+//	exclude_reflection                    drop grpc.reflection.* calls
+//	limit, cursor                         pagination
+func parseHistoryQuery(values url.Values) (history.Query, error) {
+	q := history.Query{
+		Method:          values.Get("method"),
+		MethodPrefix:    values.Get("method_prefix"),
+		Session:         values.Get("session"),
+		Tag:             values.Get("tag"),
+		PayloadContains: values.Get("payload"),
+		Cursor:          values.Get("cursor"),
+	}
+
+	if v := values.Get("method_regex"); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid method_regex: %w", err)
+		}
+		q.MethodRegex = re
+	}
+
+	if v := values.Get("state"); v != "" {
+		state := history.State(v)
+		if state != history.StateOpen && state != history.StateClosed {
+			return q, fmt.Errorf("invalid state %q: expected %s or %s", v, history.StateOpen, history.StateClosed)
+		}
+		q.State = state
+	}
+
+	if v := values.Get("code"); v != "" {
+		code, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return q, fmt.Errorf("invalid code: %w", err)
+		}
+		c := int32(code)
+		q.GrpcCode = &c
+	}
+
+	if v := values.Get("proxified"); v != "" {
+		proxified, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid proxified: %w", err)
+		}
+		q.Proxified = &proxified
+	}
+
+	var err error
+	if q.Since, err = parseTime(values, "since"); err != nil {
+		return q, err
+	}
+	if q.Until, err = parseTime(values, "until"); err != nil {
+		return q, err
+	}
+
+	if v := values.Get("exclude_reflection"); v != "" {
+		if q.ExcludeReflection, err = strconv.ParseBool(v); err != nil {
+			return q, fmt.Errorf("invalid exclude_reflection: %w", err)
+		}
+	}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return q, fmt.Errorf("invalid limit %q", v)
+		}
+		q.Limit = limit
+	}
+
+	if q.Cursor != "" && !history.ValidCursor(q.Cursor) {
+		return q, fmt.Errorf("invalid cursor %q", q.Cursor)
+	}
+	return q, nil
+}
+
+func parseTime(values url.Values, key string) (time.Time, error) {
+	v := values.Get(key)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,30 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
+)
+
+// handleRedecode decodes again every unrecognized message of the history with the current descriptors.
+func (s *Server) handleRedecode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"redecoded": s.redecodeHistory()})
+}
+
+// redecodeHistory decodes the stored messages recorded before their protos were compiled.
+// It returns the number of updated calls.
+func (s *Server) redecodeHistory() int {
+	return s.historyRegistry.UpdateHistories(s.decoder.Redecode)
+}
+
+// redecode lazily decodes the unrecognized messages of a history read from the registry,
+// and stores the result so that it's done only once.
+func (s *Server) redecode(h *history.History) {
+	if s.decoder.Redecode(h) {
+		s.historyRegistry.UpdateHistory(h.ID, s.decoder.Redecode)
+	}
+}
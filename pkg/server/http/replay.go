@@ -0,0 +1,260 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/diff"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/payload"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/proxy"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// defaultReplayTimeout bounds each replayed call when the request doesn't set one
+const defaultReplayTimeout = 30 * time.Second
+
+// ReplayRequest is the payload of /history/replay.
+// Calls are selected by IDs, or else by the /history query parameters of the request.
+type ReplayRequest struct {
+	// Target is the upstream address, the proxy backend by default
+	Target string   `json:"target"`
+	IDs    []string `json:"ids"`
+	// IgnoreFields are response fields left out of the comparison ("items.updatedAt"),
+	// "status.code" and "status.message" ignore the status
+	IgnoreFields []string `json:"ignoreFields"`
+	// Metadata overrides the recorded metadata, to restore redacted credentials for instance
+	Metadata  map[string]string `json:"metadata"`
+	TimeoutMs int               `json:"timeoutMs"`
+}
+
+// ReplayReport sums up a replay.
+type ReplayReport struct {
+	Total   int            `json:"total"`
+	Passed  int            `json:"passed"`
+	Failed  int            `json:"failed"`
+	Results []ReplayResult `json:"results"`
+}
+
+// ReplayResult compares a recorded call with its replay.
+type ReplayResult struct {
+	ID           string            `json:"id"`
+	ReplayID     string            `json:"replayId,omitempty"`
+	FullMethod   string            `json:"fullMethod"`
+	ExpectedCode int32             `json:"expectedCode"`
+	ActualCode   int32             `json:"actualCode"`
+	Match        bool              `json:"match"`
+	Differences  []diff.Difference `json:"differences,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// handleHistoryReplay sends recorded calls again to an upstream, records the new exchanges
+// and reports how their status and responses differ from the recorded ones.
+func (s *Server) handleHistoryReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req ReplayRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+			return
+		}
+	}
+	target := req.Target
+	if target == "" {
+		target = s.replayTarget
+	}
+	if target == "" {
+		writeError(w, http.StatusBadRequest, "target is required when no proxy backend is configured")
+		return
+	}
+
+	var calls []history.History
+	if len(req.IDs) > 0 {
+		for _, id := range req.IDs {
+			h, ok := s.historyRegistry.GetHistory(id)
+			if !ok {
+				writeError(w, http.StatusNotFound, fmt.Sprintf("history %s not found", id))
+				return
+			}
+			calls = append(calls, h)
+		}
+	} else {
+		q, err := parseHistoryQuery(r.URL.Query())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		calls = s.historyRegistry.Query(q).Histories
+	}
+
+	p, err := proxy.New(target)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid target: %v", err))
+		return
+	}
+	defer p.Close()
+
+	timeout := defaultReplayTimeout
+	if req.TimeoutMs > 0 {
+		timeout = time.Duration(req.TimeoutMs) * time.Millisecond
+	}
+	report := ReplayReport{Results: []ReplayResult{}}
+	for _, h := range calls {
+		// Open calls have no outcome to compare with yet
+		if h.State != history.StateClosed {
+			continue
+		}
+		s.redecode(&h)
+		res := s.replay(r.Context(), p, h, req, timeout)
+		report.Total++
+		if res.Match {
+			report.Passed++
+		} else {
+			report.Failed++
+		}
+		report.Results = append(report.Results, res)
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (s *Server) replay(ctx context.Context, p *proxy.Proxy, h history.History, req ReplayRequest, timeout time.Duration) ReplayResult {
+	res := ReplayResult{ID: h.ID, FullMethod: h.FullMethod, ExpectedCode: h.GrpcCode}
+
+	var requests [][]byte
+	var expected []history.Message
+	for _, m := range h.Messages {
+		if m.Direction != payload.DirectionRecv {
+			expected = append(expected, m)
+			continue
+		}
+		b, err := s.decoder.Encode(h.FullMethod, m)
+		if err != nil {
+			res.Error = fmt.Sprintf("request %d can't be replayed: %v", len(requests), err)
+			return res
+		}
+		requests = append(requests, b)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	call := p.Call(ctx, h.FullMethod, replayMetadata(h.RequestMetadata, req.Metadata), requests)
+	end := time.Now()
+
+	method, _ := s.descriptorRegistry.GetMethodDescriptor(h.FullMethod)
+	replayed := history.History{
+		ID:               uuid.NewString(),
+		StartTime:        start,
+		EndTime:          &end,
+		FullMethod:       h.FullMethod,
+		Messages:         []history.Message{},
+		State:            history.StateClosed,
+		GrpcCode:         int32(call.Status.Code()),
+		GrpcMessage:      s.redactor.String(call.Status.Message()),
+		Proxified:        true,
+		Session:          h.Session,
+		Tags:             h.Tags,
+		ReplayOf:         h.ID,
+		RequestMetadata:  h.RequestMetadata,
+		UpstreamHeaders:  s.redactor.Metadata(call.Header),
+		UpstreamTrailers: s.redactor.Metadata(call.Trailer),
+	}
+	for _, m := range h.Messages {
+		if m.Direction == payload.DirectionRecv {
+			replayed.Messages = append(replayed.Messages, m)
+		}
+	}
+	var actual []history.Message
+	for _, b := range call.Responses {
+		m := s.decoder.Decode(method, payload.DirectionSend, b)
+		m.Timestamp = end
+		m.Proxified = true
+		actual = append(actual, m)
+		replayed.Messages = append(replayed.Messages, m)
+	}
+	s.historyRegistry.SaveHistory(replayed)
+
+	res.ReplayID = replayed.ID
+	res.ActualCode = replayed.GrpcCode
+	ignore := diff.Ignore(req.IgnoreFields)
+	res.Differences = diff.Prefix("status", diff.Values(
+		map[string]any{"code": float64(h.GrpcCode), "message": h.GrpcMessage},
+		map[string]any{"code": float64(replayed.GrpcCode), "message": replayed.GrpcMessage},
+		statusIgnore(ignore),
+	))
+	res.Differences = append(res.Differences, s.diffResponses(h.FullMethod, method, expected, actual, ignore)...)
+	res.Match = len(res.Differences) == 0
+	return res
+}
+
+// statusIgnore keeps the rules about the status, relative to it.
+func statusIgnore(ignore diff.Ignore) diff.Ignore {
+	var res diff.Ignore
+	for _, rule := range ignore {
+		if rest, ok := strings.CutPrefix(rule, "status."); ok {
+			res = append(res, rest)
+		}
+	}
+	return res
+}
+
+// diffResponses compares responses pairwise: field by field when both are decoded with
+// the method descriptor, byte by byte otherwise.
+func (s *Server) diffResponses(fullMethod string, method protoreflect.MethodDescriptor, expected, actual []history.Message, ignore diff.Ignore) []diff.Difference {
+	var diffs []diff.Difference
+	for i := 0; i < max(len(expected), len(actual)); i++ {
+		path := fmt.Sprintf("responses[%d]", i)
+		switch {
+		case i >= len(actual):
+			diffs = append(diffs, diff.Difference{Path: path, Expected: expected[i].Payload})
+			continue
+		case i >= len(expected):
+			diffs = append(diffs, diff.Difference{Path: path, Actual: actual[i].Payload})
+			continue
+		}
+		e, a := expected[i], actual[i]
+		if method != nil && e.Recognized && a.Recognized {
+			diffs = append(diffs, diff.Prefix(path, diff.Values(e.Payload, a.Payload, ignore))...)
+			continue
+		}
+		eb, err := s.decoder.Encode(fullMethod, e)
+		if err != nil || !bytes.Equal(eb, a.RawPayload) {
+			diffs = append(diffs, diff.Difference{
+				Path:     path,
+				Expected: e.PayloadString,
+				Actual:   a.PayloadString,
+			})
+		}
+	}
+	return diffs
+}
+
+// replayMetadata rebuilds the metadata of a recorded call: binary values are recorded in base64.
+func replayMetadata(recorded map[string][]string, overrides map[string]string) metadata.MD {
+	md := metadata.MD{}
+	for k, values := range recorded {
+		for _, v := range values {
+			if strings.HasSuffix(k, "-bin") {
+				if b, err := base64.StdEncoding.DecodeString(v); err == nil {
+					v = string(b)
+				}
+			}
+			md.Append(k, v)
+		}
+	}
+	for k, v := range overrides {
+		md.Set(k, v)
+	}
+	return md
+}
@@ -0,0 +1,88 @@
+package http_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/mocks"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/reflection"
+	grpcServer "github.com/marcaudefroy/grpc-hot-mock/pkg/server/grpc"
+	httpServer "github.com/marcaudefroy/grpc-hot-mock/pkg/server/http"
+)
+
+const greeterProto = `syntax = "proto3"; package example;
+message HelloRequest { string name = 1; }
+message HelloReply { string message = 1; int64 at = 2; }
+service Greeter { rpc SayHello(HelloRequest) returns (HelloReply); }`
+
+// startUpstream serves the Greeter with a mock answering reply.
+func startUpstream(t *testing.T, reply map[string]any) string {
+	t.Helper()
+	dr := reflection.NewDefaultDescriptorRegistry()
+	if err := dr.RegisterProtoFile("greeter.proto", greeterProto); err != nil {
+		t.Fatalf("register proto failed: %v", err)
+	}
+	mr := &mocks.DefaultRegistry{}
+	mr.RegisterMock(mocks.MockConfig{Service: "example.Greeter", Method: "SayHello", MockResponse: reply})
+	srv := grpcServer.NewServer("", dr, mr, &history.DefaultRegistry{})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+func TestHandleHistoryReplay(t *testing.T) {
+	target := startUpstream(t, map[string]any{"message": "Hello Bob", "at": 2})
+
+	dr := reflection.NewDefaultDescriptorRegistry()
+	if err := dr.RegisterProtoFile("greeter.proto", greeterProto); err != nil {
+		t.Fatalf("register proto failed: %v", err)
+	}
+	hr := &history.DefaultRegistry{}
+	mux := httpServer.NewServer(dr, &mocks.DefaultRegistry{}, hr, httpServer.WithReplayTarget(target))
+
+	// HelloRequest{name: "Alice"} answered by HelloReply{message: "Hello Alice", at: 1}
+	hr.SaveHistory(history.History{
+		ID: "a", StartTime: time.Now(), FullMethod: "/example.Greeter/SayHello", State: history.StateClosed,
+		Messages: []history.Message{
+			{Direction: "recv", Recognized: true, PayloadString: `{"name":"Alice"}`, Payload: map[string]any{"name": "Alice"}},
+			{Direction: "send", Recognized: true, PayloadString: `{"message":"Hello Alice","at":"1"}`, Payload: map[string]any{"message": "Hello Alice", "at": "1"}},
+		},
+	})
+
+	body, _ := json.Marshal(httpServer.ReplayRequest{IDs: []string{"a"}, IgnoreFields: []string{"at"}})
+	req := httptest.NewRequest(http.MethodPost, "/history/replay", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var report httpServer.ReplayReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if report.Total != 1 || report.Failed != 1 || len(report.Results) != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	res := report.Results[0]
+	if res.Error != "" {
+		t.Fatalf("unexpected error %s", res.Error)
+	}
+	if len(res.Differences) != 1 || res.Differences[0].Path != "responses[0].message" || res.Differences[0].Actual != "Hello Bob" {
+		t.Errorf("expected only the message to differ, got %+v", res.Differences)
+	}
+
+	replayed, ok := hr.GetHistory(res.ReplayID)
+	if !ok || replayed.ReplayOf != "a" || len(replayed.Messages) != 2 {
+		t.Errorf("expected the replay to be recorded, got %+v", replayed)
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/drift"
 	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
 	"github.com/marcaudefroy/grpc-hot-mock/pkg/mocks"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/payload"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/redact"
 	"github.com/marcaudefroy/grpc-hot-mock/pkg/reflection"
 )
 
@@ -14,6 +17,35 @@ type Server struct {
 	mockRegistry       mocks.Registry
 	descriptorRegistry reflection.DescriptorRegistry
 	historyRegistry    history.RegisterReadWriter
+	redactor           *redact.Redactor
+	decoder            *payload.Decoder
+	replayTarget       string
+	drift              *drift.Tracker
+}
+
+// Option configures optional features of the Server.
+type Option func(*Server)
+
+// WithRedactor exposes the redaction rules on /redaction, and keeps the bytes of unrecognized messages
+// out of the frames export when payloads are redacted.
+func WithRedactor(r *redact.Redactor) Option {
+	return func(s *Server) {
+		s.redactor = r
+	}
+}
+
+// WithReplayTarget sets the upstream address calls are replayed against by default, usually the proxy backend.
+func WithReplayTarget(addr string) Option {
+	return func(s *Server) {
+		s.replayTarget = addr
+	}
+}
+
+// WithDriftTracker exposes the drift of the proxy backend responses on /drift.
+func WithDriftTracker(t *drift.Tracker) Option {
+	return func(s *Server) {
+		s.drift = t
+	}
 }
 
 func logRequest(handler http.HandlerFunc) http.HandlerFunc {
@@ -24,20 +56,47 @@ func logRequest(handler http.HandlerFunc) http.HandlerFunc {
 }
 
 // NewServer returns an http.ServeMux with all config routes registered.
-func NewServer(dr reflection.DescriptorRegistry, mr mocks.Registry, hr history.RegisterReadWriter) *http.ServeMux {
+func NewServer(dr reflection.DescriptorRegistry, mr mocks.Registry, hr history.RegisterReadWriter, opts ...Option) *http.ServeMux {
 	mux := http.NewServeMux()
 	s := &Server{mockRegistry: mr, descriptorRegistry: dr, historyRegistry: hr}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.decoder = payload.NewDecoder(dr, s.redactor)
 
 	mux.HandleFunc("/protos/register/json", logRequest(s.handleUploadProtoJSON))
 	mux.HandleFunc("/protos/register/file", logRequest(s.handleUploadProtoFile))
+	mux.HandleFunc("/protos/register/descriptorset", logRequest(s.handleUploadDescriptorSet))
+	mux.HandleFunc("/protos/register/archive", logRequest(s.handleUploadProtoArchive))
+	mux.HandleFunc("/protos/import/upstream", logRequest(s.handleImportUpstream))
 
 	mux.HandleFunc("/protos/ingest/json", logRequest(s.handleIngestProtoJSON))
 	mux.HandleFunc("/protos/ingest/file", logRequest(s.handleIngestProtoFile))
+	mux.HandleFunc("/protos/ingest/archive", logRequest(s.handleIngestProtoArchive))
 	mux.HandleFunc("/protos/ingest/compile", logRequest(s.handleCompile))
+	mux.HandleFunc("/protos/ingest", logRequest(s.handleStaged))
+	mux.HandleFunc("/protos/ingest/{path...}", logRequest(s.handleStagedFile))
+	mux.HandleFunc("/protos/{path...}", logRequest(s.handleProtoFile))
+	mux.HandleFunc("/protos", logRequest(s.handleProtos))
+	mux.HandleFunc("/protos/graph", logRequest(s.handleProtosGraph))
+	mux.HandleFunc("/services", logRequest(s.handleServices))
+	mux.HandleFunc("/services/{name}/methods", logRequest(s.handleServiceMethods))
+	mux.HandleFunc("/messages/{fullName}", logRequest(s.handleMessage))
 
 	mux.HandleFunc("/mocks", logRequest(s.handleAddMock))
 
 	mux.HandleFunc("/history", logRequest(s.handleHistory))
 	mux.HandleFunc("/history/clear", logRequest(s.clearHistory))
+	mux.HandleFunc("/history/redecode", logRequest(s.handleRedecode))
+	mux.HandleFunc("/history/export", logRequest(s.handleHistoryExport))
+	mux.HandleFunc("/history/replay", logRequest(s.handleHistoryReplay))
+	mux.HandleFunc("/history/stats", logRequest(s.handleHistoryStats))
+	mux.HandleFunc("/history/stream", logRequest(s.handleHistoryStream))
+	mux.HandleFunc("/history/ws", logRequest(s.handleHistoryWebSocket))
+	mux.HandleFunc("/history/wait", logRequest(s.handleHistoryWait))
+
+	mux.HandleFunc("/redaction", logRequest(s.handleRedaction))
+	mux.HandleFunc("/drift", logRequest(s.handleDrift))
+	mux.HandleFunc("/history/{id}", logRequest(s.handleHistoryByID))
 	return mux
 }
@@ -0,0 +1,92 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/reflection"
+)
+
+// StagedFileInfo describes a file of /protos/ingest, waiting for the compilation of its batch.
+type StagedFileInfo struct {
+	Batch string `json:"batch"`
+	Path  string `json:"path"`
+	Size  int    `json:"size"`
+}
+
+// stagingBatch returns the batch of the ingest endpoints, set with ?batch.
+func stagingBatch(r *http.Request) string {
+	if batch := r.URL.Query().Get("batch"); batch != "" {
+		return batch
+	}
+	return reflection.DefaultBatch
+}
+
+// registerBatchPrefix names the private batches of the register requests
+const registerBatchPrefix = "register-"
+
+// registerBatch returns a batch of its own for a register request, ?batch is ignored so
+// that a failed compilation never discards the files ingested by others.
+// The batch must be released once the request is done.
+func registerBatch() string {
+	return registerBatchPrefix + uuid.NewString()
+}
+
+// releaseBatch discards what a register request left in its batch, when it failed before compiling.
+func (s *Server) releaseBatch(batch string) {
+	_, _ = s.descriptorRegistry.DiscardStaged(batch, "")
+}
+
+// stagedFiles lists the staged files of the ingest endpoints, without the private batches of
+// the register requests in progress.
+func (s *Server) stagedFiles() []reflection.StagedFile {
+	var files []reflection.StagedFile
+	for _, f := range s.descriptorRegistry.StagedFiles() {
+		if !strings.HasPrefix(f.Batch, registerBatchPrefix) {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// handleStaged lists the staged files, of every batch unless ?batch is set, or discards a batch.
+func (s *Server) handleStaged(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		batch := r.URL.Query().Get("batch")
+		files := []StagedFileInfo{}
+		for _, f := range s.stagedFiles() {
+			if batch == "" || f.Batch == batch {
+				files = append(files, StagedFileInfo{Batch: f.Batch, Path: f.Filename, Size: len(f.Content)})
+			}
+		}
+		writeJSON(w, http.StatusOK, files)
+	case http.MethodDelete:
+		s.discardStaged(w, stagingBatch(r), "")
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleStagedFile discards a staged file.
+func (s *Server) handleStagedFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	s.discardStaged(w, stagingBatch(r), r.PathValue("path"))
+}
+
+func (s *Server) discardStaged(w http.ResponseWriter, batch, filename string) {
+	discarded, err := s.descriptorRegistry.DiscardStaged(batch, filename)
+	switch {
+	case errors.Is(err, reflection.ErrNotStaged):
+		writeError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, map[string][]string{"discarded": discarded})
+	}
+}
@@ -0,0 +1,158 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// eventBuffer is the number of events a live subscriber may lag behind before losing some
+	eventBuffer = 256
+	// keepAliveInterval prevents proxies from closing idle live connections
+	keepAliveInterval = 15 * time.Second
+)
+
+// handleHistoryStream pushes history events as Server-Sent Events.
+// It accepts the same filters as /history, pagination excepted.
+func (s *Server) handleHistoryStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q, err := parseHistoryQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	sub := s.historyRegistry.Subscribe(q, eventBuffer)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	var reported uint64
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("warning: marshal history event failed: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+			if marker, ok := droppedMarker(sub, &reported); ok {
+				data, _ := json.Marshal(marker)
+				if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", marker.Type, data); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// handleHistoryWebSocket pushes history events as JSON text frames over a WebSocket.
+// It accepts the same filters as /history, pagination excepted.
+func (s *Server) handleHistoryWebSocket(w http.ResponseWriter, r *http.Request) {
+	q, err := parseHistoryQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	wsServer := websocket.Server{
+		// Accept clients without Origin header (CLI tools, test suites)
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			s.streamHistoryEvents(ws, q)
+		},
+	}
+	wsServer.ServeHTTP(w, r)
+}
+
+func (s *Server) streamHistoryEvents(ws *websocket.Conn, q history.Query) {
+	defer ws.Close()
+
+	sub := s.historyRegistry.Subscribe(q, eventBuffer)
+	defer sub.Close()
+
+	// The client isn't expected to talk, reading only detects when it goes away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var discard string
+		for {
+			if err := websocket.Message.Receive(ws, &discard); err != nil {
+				return
+			}
+		}
+	}()
+
+	var reported uint64
+	for {
+		select {
+		case <-closed:
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if err := websocket.JSON.Send(ws, e); err != nil {
+				return
+			}
+			if marker, ok := droppedMarker(sub, &reported); ok {
+				if err := websocket.JSON.Send(ws, marker); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// droppedEvent is sent on live streams when the subscriber lost events because it was too slow
+type droppedEvent struct {
+	Type    history.EventType `json:"type"`
+	Dropped uint64            `json:"dropped"`
+}
+
+// droppedMarker returns the marker for the events sub lost since the last one, reported
+// holds the count already notified.
+func droppedMarker(sub *history.Subscription, reported *uint64) (droppedEvent, bool) {
+	dropped := sub.Dropped()
+	if dropped == *reported {
+		return droppedEvent{}, false
+	}
+	marker := droppedEvent{Type: history.EventsDropped, Dropped: dropped - *reported}
+	*reported = dropped
+	return marker, true
+}
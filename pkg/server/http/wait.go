@@ -0,0 +1,171 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcaudefroy/grpc-hot-mock/pkg/history"
+)
+
+const (
+	defaultWaitTimeout = 5 * time.Second
+	maxWaitTimeout     = 5 * time.Minute
+)
+
+// payloadMatcher requires a message payload field, by path of JSON names ("user.id"), to hold a value.
+// Lists are traversed: "items.sku" matches when any item has the sku.
+type payloadMatcher struct {
+	path  []string
+	value string
+}
+
+// parsePayloadMatchers reads the "match" parameters, formatted as path=value.
+func parsePayloadMatchers(values url.Values) ([]payloadMatcher, error) {
+	var matchers []payloadMatcher
+	for _, v := range values["match"] {
+		path, value, ok := strings.Cut(v, "=")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("invalid match %q: expected path=value", v)
+		}
+		matchers = append(matchers, payloadMatcher{path: strings.Split(path, "."), value: value})
+	}
+	return matchers, nil
+}
+
+func (m payloadMatcher) match(v any) bool {
+	if list, ok := v.([]any); ok {
+		for _, item := range list {
+			if m.match(item) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(m.path) == 0 {
+		switch v := v.(type) {
+		case string:
+			return v == m.value
+		case nil, map[string]any:
+			return false
+		default:
+			return fmt.Sprint(v) == m.value
+		}
+	}
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return false
+	}
+	return payloadMatcher{path: m.path[1:], value: m.value}.match(obj[m.path[0]])
+}
+
+// matchPayload reports whether one message of h satisfies every matcher.
+func matchPayload(h history.History, matchers []payloadMatcher) bool {
+	if len(matchers) == 0 {
+		return true
+	}
+	for _, msg := range h.Messages {
+		ok := true
+		for _, m := range matchers {
+			if !m.match(msg.Payload) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// handleHistoryWait blocks until count calls match the /history filters and payload matchers,
+// then returns them. Calls recorded before the request count, "since" scopes them.
+// After timeout it answers 408 with the calls matched so far.
+func (s *Server) handleHistoryWait(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	values := r.URL.Query()
+	q, err := parseHistoryQuery(values)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	q.Limit, q.Cursor = 0, ""
+	matchers, err := parsePayloadMatchers(values)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	count := 1
+	if v := values.Get("count"); v != "" {
+		if count, err = strconv.Atoi(v); err != nil || count < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid count %q", v))
+			return
+		}
+	}
+	timeout := defaultWaitTimeout
+	if v := values.Get("timeout"); v != "" {
+		if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid timeout %q", v))
+			return
+		}
+		timeout = min(timeout, maxWaitTimeout)
+	}
+
+	// Subscribe before looking at the saved calls, so that none is missed in between
+	sub := s.historyRegistry.Subscribe(q, eventBuffer)
+	defer sub.Close()
+
+	seen := map[string]bool{}
+	matched := []history.History{}
+	check := func(h history.History) {
+		if seen[h.ID] {
+			return
+		}
+		s.redecode(&h)
+		if q.Match(h) && matchPayload(h, matchers) {
+			seen[h.ID] = true
+			matched = append(matched, h)
+		}
+	}
+	scan := func() {
+		for _, h := range s.historyRegistry.Query(q).Histories {
+			check(h)
+		}
+	}
+	scan()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var dropped uint64
+	for len(matched) < count {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timer.C:
+			writeJSON(w, http.StatusRequestTimeout, matched)
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			// Events of message carry the new message only, the call is read back whole
+			if h, ok := s.historyRegistry.GetHistory(e.History.ID); ok {
+				check(h)
+			}
+			// Events are lost only while the buffer is full, so the loss is noticed on the
+			// buffered events that follow it. The saved calls are then scanned again
+			if d := sub.Dropped(); d != dropped {
+				dropped = d
+				scan()
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, matched[:count])
+}